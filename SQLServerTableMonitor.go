@@ -1,94 +1,376 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/katasec/dstream/config"
 	"github.com/katasec/dstream/topics"
+	"github.com/katasec/dstream/utils"
 	"github.com/nats-io/nats.go"
 )
 
+// ErrSerialization is returned for changes that cannot be serialized to JSON
+var ErrSerialization = errors.New("failed to serialize change")
+
 type SQLServerTableMonitor struct {
 	dbConn          *sql.DB
+	database        string // Source database name used in event subjects
 	tableName       string
+	tableConfig     config.TableConfig
 	pollInterval    time.Duration
 	maxPollInterval time.Duration
 	natsConn        *nats.Conn
-	lastLSNs        map[string][]byte
+	position        Position // Last delivered position
+	polledLSN       []byte   // Highest LSN up to which a poll found no changes after the position
 	lsnMutex        sync.Mutex
-	columns         []string // Cached column names
+	columns         []string // Cached column names of the active capture instance
+	keyColumns      []string // Primary key columns hashed to pick an event's partition
+	partitions      int      // Partitions the table's events are spread over
+
+	captureInstance CaptureInstance  // Capture instance currently being read
+	nextInstance    *CaptureInstance // Newer capture instance to switch to once the current one is drained
+	lastDDLLSN      []byte           // Last ddl_history entry seen for the current capture instance
+	status          string
+	statusMutex     sync.Mutex
+
+	signalTable          string                       // Optional table polled for snapshot signals
+	incremental          *SnapshotProgress            // Incremental snapshot in progress, if any
+	snapshotMutex        sync.Mutex                   // Guards incremental
+	saveSnapshotProgress func(SnapshotProgress) error // Persists snapshot progress to the checkpoint store
+	publishEvent         func(*nats.Msg) error        // Stores a change event in the event stream
+	deadLetter           func(DeadLetter) error       // Stores a change that could not be serialized in the dead letter stream
+	saveCheckpoint       func(Position, int) error    // Checkpoints the position once the events before it are delivered, with the number of events since the previous checkpoint
+	purgeEvents          func(context.Context) error  // Drops the table's events that were not delivered yet
+	rewindCheckpoint     func([]byte) error           // Moves the stored checkpoint back to an earlier LSN
+	rewinds              chan pendingRewind           // Rewind requests waiting to be applied between batches
 }
 
-// NewSQLServerTableMonitor creates a new SQLServerTableMonitor2
-func NewSQLServerTableMonitor(dbConn *sql.DB, tableName string, natsConn *nats.Conn, pollInterval, maxPollInterval time.Duration) *SQLServerTableMonitor {
-	// Fetch column names once and store them in the struct
-	columns, err := fetchColumnNames(dbConn, tableName)
+// NewSQLServerTableMonitor creates a new SQLServerTableMonitor reading the table's oldest capture instance
+func NewSQLServerTableMonitor(ctx context.Context, dbConn *sql.DB, tableConfig config.TableConfig, natsConn *nats.Conn, pollInterval, maxPollInterval time.Duration) (*SQLServerTableMonitor, error) {
+	tableName := tableConfig.Name
+
+	// Resolve the capture instance to read from
+	instances, err := fetchCaptureInstances(ctx, dbConn, tableName)
 	if err != nil {
-		log.Fatalf("Failed to fetch column names for table %s: %v", tableName, err)
+		return nil, fmt.Errorf("failed to fetch capture instances for table %s: %w", tableName, err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no CDC capture instance found for table %s", tableName)
+	}
+	keyColumns, err := fetchPrimaryKeyColumns(ctx, dbConn, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch primary key columns for table %s: %w", tableName, err)
 	}
 
-	return &SQLServerTableMonitor{
+	m := &SQLServerTableMonitor{
 		dbConn:          dbConn,
 		tableName:       tableName,
+		tableConfig:     tableConfig,
+		keyColumns:      keyColumns,
+		partitions:      1,
 		natsConn:        natsConn,
 		pollInterval:    pollInterval,
 		maxPollInterval: maxPollInterval,
-		lastLSNs:        make(map[string][]byte),
-		columns:         columns,
+		status:          MonitorStatusStreaming,
+
+		saveSnapshotProgress: func(SnapshotProgress) error { return nil },
+		publishEvent:         natsConn.PublishMsg,
+		deadLetter:           func(DeadLetter) error { return nil },
+		saveCheckpoint:       func(Position, int) error { return nil },
+		purgeEvents:          func(context.Context) error { return nil },
+		rewindCheckpoint:     func([]byte) error { return nil },
+		rewinds:              make(chan pendingRewind, 1),
+	}
+
+	// Start from the oldest instance; refreshSchema moves to newer ones once drained
+	if err := m.useCaptureInstance(ctx, instances[0], SchemaChangeKindInitial); err != nil {
+		return nil, fmt.Errorf("failed to initialize schema for table %s: %w", tableName, err)
 	}
+
+	return m, nil
 }
 
-// StartMonitor begins monitoring changes for the table and publishes them to NATS
-func (m *SQLServerTableMonitor) StartMonitor(lastLSN []byte) error {
+// Position returns the last delivered position
+func (m *SQLServerTableMonitor) Position() Position {
+	m.lsnMutex.Lock()
+	defer m.lsnMutex.Unlock()
+	return m.position
+}
+
+// setPosition updates the last delivered position
+func (m *SQLServerTableMonitor) setPosition(position Position) {
+	m.lsnMutex.Lock()
+	defer m.lsnMutex.Unlock()
+	m.position = position
+}
+
+// Status returns the current monitor status
+func (m *SQLServerTableMonitor) Status() string {
+	m.statusMutex.Lock()
+	defer m.statusMutex.Unlock()
+	return m.status
+}
+
+// setStatus updates the monitor status
+func (m *SQLServerTableMonitor) setStatus(status string) {
+	m.statusMutex.Lock()
+	defer m.statusMutex.Unlock()
+	m.status = status
+}
+
+// useCaptureInstance switches the monitor to a capture instance and reloads its column metadata
+func (m *SQLServerTableMonitor) useCaptureInstance(ctx context.Context, ci CaptureInstance, kind string) error {
+	columns, err := fetchCapturedColumns(ctx, m.dbConn, ci.Name)
+	if err != nil {
+		return err
+	}
+
+	// DDL recorded before we started reading this instance is already reflected in its columns
+	ddlChanges, err := fetchDDLChanges(ctx, m.dbConn, ci.Name, nil)
+	if err != nil {
+		return err
+	}
+
+	m.captureInstance = ci
+	m.nextInstance = nil
+	m.columns = columns
+	m.lastDDLLSN = nil
+	if len(ddlChanges) > 0 {
+		m.lastDDLLSN = ddlChanges[len(ddlChanges)-1].LSN
+	}
+
+	log.Printf("Using capture instance %s for table %s with columns: %s", ci.Name, m.tableName, strings.Join(columns, ", "))
+	return m.checkSourceColumns(ctx, kind, nil)
+}
+
+// refreshSchema picks up DDL changes and new capture instances for the table
+func (m *SQLServerTableMonitor) refreshSchema(ctx context.Context) error {
+	ddlChanges, err := fetchDDLChanges(ctx, m.dbConn, m.captureInstance.Name, m.lastDDLLSN)
+	if err != nil {
+		return err
+	}
+	for i := range ddlChanges {
+		ddl := ddlChanges[i]
+		log.Printf("DDL change detected for table %s: %s", m.tableName, ddl.Command)
+		m.lastDDLLSN = ddl.LSN
+		if err := m.checkSourceColumns(ctx, SchemaChangeKindDDL, &ddl); err != nil {
+			return err
+		}
+	}
+
+	if m.nextInstance != nil {
+		return nil
+	}
+
+	instances, err := fetchCaptureInstances(ctx, m.dbConn, m.tableName)
+	if err != nil {
+		return err
+	}
+	for i := range instances {
+		if instances[i].Name != m.captureInstance.Name && bytes.Compare(instances[i].StartLSN, m.captureInstance.StartLSN) > 0 {
+			log.Printf("New capture instance %s found for table %s; draining %s first", instances[i].Name, m.tableName, m.captureInstance.Name)
+			m.nextInstance = &instances[i]
+			break
+		}
+	}
+	return nil
+}
+
+// checkSourceColumns compares the source table with the captured columns, updates the status and emits a schema change event
+func (m *SQLServerTableMonitor) checkSourceColumns(ctx context.Context, kind string, ddl *DDLChange) error {
+	sourceColumns, err := fetchColumnNames(ctx, m.dbConn, m.tableName)
+	if err != nil {
+		return fmt.Errorf("failed to fetch column names for table %s: %w", m.tableName, err)
+	}
+
+	missing := missingColumns(sourceColumns, m.columns)
+	if len(missing) > 0 {
+		log.Printf("Table %s has columns not captured by %s: %s. Pausing until a new capture instance is created.",
+			m.tableName, m.captureInstance.Name, strings.Join(missing, ", "))
+		m.setStatus(MonitorStatusAwaitingCaptureInstance)
+	} else {
+		m.setStatus(MonitorStatusStreaming)
+	}
+
+	return m.publishSchemaChange(m.newSchemaChangeEvent(kind, ddl, missing))
+}
+
+// StartMonitor begins monitoring changes after the given position and publishes them to NATS. It
+// returns nil once ctx is cancelled; changes delivered after the last checkpoint are redelivered by
+// whichever monitor picks the table up next.
+func (m *SQLServerTableMonitor) StartMonitor(ctx context.Context, start Position) error {
 	backoff := NewBackoffManager(m.pollInterval, m.maxPollInterval)
-	m.lastLSNs[m.tableName] = lastLSN
+	m.setPosition(start)
+	subs, err := m.subscribeAdmin()
+	if err != nil {
+		return err
+	}
+	defer utils.Unsubscribe(subs)
 
 	for {
-		log.Printf("Polling changes for table %s, since LSN: %s", m.tableName, hex.EncodeToString(lastLSN))
-		changes, newLSN, err := m.fetchCDCChanges(m.lastLSNs[m.tableName])
+		m.applyPendingRewind(ctx)
+
+		if err := m.refreshSchema(ctx); err != nil {
+			log.Printf("Error refreshing schema for %s: %v", m.tableName, err)
+			if sleep(ctx, backoff.GetInterval()) != nil {
+				return nil
+			}
+			continue
+		}
+
+		if err := m.checkSignals(ctx); err != nil {
+			log.Printf("Error checking signals for %s: %v", m.tableName, err)
+		}
+
+		// Without a newer capture instance to drain into, a paused table waits for one to appear
+		if m.nextInstance == nil && m.Status() == MonitorStatusAwaitingCaptureInstance {
+			log.Printf("Table %s is %s; next check in %s", m.tableName, MonitorStatusAwaitingCaptureInstance, m.maxPollInterval)
+			if sleep(ctx, m.maxPollInterval) != nil {
+				return nil
+			}
+			continue
+		}
+
+		// Make sure no changes after the current position were removed by CDC cleanup
+		position, err := m.checkRetentionGap(ctx, m.Position())
+		if err != nil {
+			var gapErr *RetentionGapError
+			if errors.As(err, &gapErr) {
+				return err
+			}
+			log.Printf("Error checking retention for %s: %v", m.tableName, err)
+			if sleep(ctx, backoff.GetInterval()) != nil {
+				return nil
+			}
+			continue
+		}
+		m.setPosition(position)
+
+		var upperLSN []byte
+		if m.nextInstance != nil {
+			upperLSN = m.nextInstance.StartLSN
+		}
+
+		// Read the next incremental snapshot chunk, if one is running, before fetching changes
+		var chunk *snapshotChunk
+		if m.nextInstance == nil {
+			var err error
+			if chunk, err = m.readIncrementalChunk(ctx); err != nil {
+				log.Printf("Error reading snapshot chunk for %s: %v", m.tableName, err)
+			}
+		}
+
+		// Every change up to the max LSN read before the poll is visible to it
+		maxLSN, err := fetchMaxLSN(ctx, m.dbConn)
+		if err != nil {
+			log.Printf("Error fetching max LSN for %s: %v", m.tableName, err)
+			if sleep(ctx, backoff.GetInterval()) != nil {
+				return nil
+			}
+			continue
+		}
+
+		log.Printf("Polling changes for table %s, since position: %s", m.tableName, position)
+		changes, newLSN, err := m.fetchCDCChanges(ctx, position, upperLSN)
 		if err != nil {
 			log.Printf("Error fetching changes for %s: %v", m.tableName, err)
-			time.Sleep(backoff.GetInterval()) // Wait on error
+			if sleep(ctx, backoff.GetInterval()) != nil { // Wait on error
+				return nil
+			}
 			continue
 		}
 
+		if chunk != nil {
+			changes = chunk.interleave(changes)
+		}
+
+		uncommitted := 0
 		if len(changes) > 0 {
 			log.Printf("Changes detected for table %s; publishing...", m.tableName)
-			for _, change := range changes {
-				if err := m.publishChangeToNATS(change); err != nil {
-					log.Printf("Failed to publish change for table %s: %v", m.tableName, err)
-				}
+			if uncommitted, err = m.deliverChanges(ctx, changes); err != nil {
+				return fencedError(err)
+			}
+		}
+
+		// Every change up to newLSN is acknowledged by the sink; only now complete the checkpoint
+		if newLSN != nil {
+			if err := m.commitCheckpoint(ctx, Position{LSN: newLSN}, uncommitted); err != nil {
+				return fencedError(err)
+			}
+		}
+
+		if chunk != nil {
+			if err := m.completeIncrementalChunk(chunk); err != nil {
+				log.Printf("Failed to save snapshot progress for %s: %v", m.tableName, err)
 			}
-			m.lsnMutex.Lock()
-			m.lastLSNs[m.tableName] = newLSN
-			m.lsnMutex.Unlock()
+		}
+
+		if len(changes) > 0 {
 			backoff.ResetInterval()
+		} else if m.nextInstance != nil {
+			// The old capture instance is drained up to the new instance's start; switch over and
+			// continue just before it so that the switch is not mistaken for a retention gap
+			next := *m.nextInstance
+			if err := m.useCaptureInstance(ctx, next, SchemaChangeKindCaptureInstanceChanged); err != nil {
+				log.Printf("Error switching capture instance for %s: %v", m.tableName, err)
+				if sleep(ctx, backoff.GetInterval()) != nil {
+					return nil
+				}
+				backoff.IncreaseInterval()
+				continue
+			}
+			if lastLSN := m.Position().LSN; !isZeroLSN(lastLSN) && bytes.Compare(lastLSN, next.StartLSN) < 0 {
+				m.setPosition(Position{LSN: decrementLSN(next.StartLSN)})
+			}
+			continue
 		} else {
+			// An idle table has nothing to lose when CDC cleanup moves past its position
+			m.polledLSN = polledUpTo(maxLSN, upperLSN)
 			backoff.IncreaseInterval()
 			log.Printf("No changes found for table %s. Next poll in %s", m.tableName, backoff.GetInterval())
 		}
 
-		time.Sleep(backoff.GetInterval())
+		if sleep(ctx, backoff.GetInterval()) != nil {
+			return nil
+		}
 	}
 }
 
-// fetchCDCChanges queries CDC changes and returns relevant events
-func (m *SQLServerTableMonitor) fetchCDCChanges(lastLSN []byte) ([]map[string]interface{}, []byte, error) {
-	columnList := "ct.__$start_lsn, ct.__$operation, " + strings.Join(m.columns, ", ")
+// fetchCDCChanges queries CDC changes after a position and returns relevant events and the LSN of the
+// last transaction read. A non-nil upperLSN limits the result to changes below it.
+func (m *SQLServerTableMonitor) fetchCDCChanges(ctx context.Context, position Position, upperLSN []byte) ([]map[string]interface{}, []byte, error) {
+	columnList := "ct.__$start_lsn, ct.__$seqval, ct.__$operation, " + serverTimeToUTC("sys.fn_cdc_map_lsn_to_time(ct.__$start_lsn)") + ", " + quoteColumns("ct", m.columns)
+
+	// A partly delivered transaction is read again in full so its transaction metadata stays
+	// complete; resumeAfter then drops the rows that were already delivered
+	lowerBound := "ct.__$start_lsn > @lastLSN"
+	if position.SeqVal != nil {
+		lowerBound = "ct.__$start_lsn >= @lastLSN"
+	}
+	upperBound := ""
+	args := []interface{}{sql.Named("lastLSN", position.LSN)}
+	if upperLSN != nil {
+		upperBound = "AND ct.__$start_lsn < @upperLSN"
+		args = append(args, sql.Named("upperLSN", upperLSN))
+	}
 	query := fmt.Sprintf(`
         SELECT %s
-        FROM cdc.dbo_%s_CT AS ct
-        WHERE ct.__$start_lsn > @lastLSN
-        ORDER BY ct.__$start_lsn
-    `, columnList, m.tableName)
+        FROM cdc.[%s_CT] AS ct
+        WHERE %s %s
+        ORDER BY ct.__$start_lsn, ct.__$seqval, ct.__$operation
+    `, columnList, m.captureInstance.Name, lowerBound, upperBound)
 
-	rows, err := m.dbConn.Query(query, sql.Named("lastLSN", lastLSN))
+	rows, err := m.dbConn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to query CDC table for %s: %w", m.tableName, err)
 	}
@@ -98,42 +380,151 @@ func (m *SQLServerTableMonitor) fetchCDCChanges(lastLSN []byte) ([]map[string]in
 	var latestLSN []byte
 
 	for rows.Next() {
-		var lsn []byte
+		var lsn, seqVal []byte
 		var operation int
-		columnData := make([]interface{}, len(m.columns)+2)
+		var commitTime time.Time
+		columnData := make([]interface{}, len(m.columns)+4)
 		columnData[0] = &lsn
-		columnData[1] = &operation
+		columnData[1] = &seqVal
+		columnData[2] = &operation
+		columnData[3] = &commitTime
 		for i := range m.columns {
-			columnData[i+2] = new(sql.NullString)
+			columnData[i+4] = new(sql.NullString)
 		}
 
 		if err := rows.Scan(columnData...); err != nil {
 			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		change := parseChange(lsn, operation, m.columns, columnData)
+		change := parseChange(Position{LSN: lsn, SeqVal: seqVal, Operation: operation}, commitTime, m.columns, columnData[4:])
 		changes = append(changes, change)
 		latestLSN = lsn
 	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read CDC rows for %s: %w", m.tableName, err)
+	}
+
+	grouped := groupTransactions(changes, m.tableConfig.TransactionMarkers)
+	return resumeAfter(grouped, position), latestLSN, nil
+}
+
+// deliverChanges publishes changes in order, retrying each one until the event stream stores it.
+// The monitor stalls on a failing change rather than skipping it, except for changes that cannot be
+// serialized, which are dead-lettered. The position is checkpointed every
+// checkpointRowInterval events; the number of events published since the last checkpoint is returned.
+// Delivery stops with ctx.Err() when ctx is cancelled.
+func (m *SQLServerTableMonitor) deliverChanges(ctx context.Context, changes []map[string]interface{}) (int, error) {
+	backoff := NewBackoffManager(m.pollInterval, m.maxPollInterval)
+	uncommitted := 0
+	for _, change := range changes {
+		for {
+			err := m.publishChangeToNATS(change)
+			if errors.Is(err, ErrSerialization) {
+				err = m.deadLetterChange(change, err)
+			}
+			if err == nil {
+				backoff.ResetInterval()
+				break
+			}
+			log.Printf("Failed to publish change for table %s, retrying in %s: %v", m.tableName, backoff.GetInterval(), err)
+			if err := sleep(ctx, backoff.GetInterval()); err != nil {
+				return uncommitted, err
+			}
+			backoff.IncreaseInterval()
+		}
+
+		uncommitted++
+		if position, ok := changePosition(change); ok && uncommitted >= checkpointRowInterval {
+			if err := m.commitCheckpoint(ctx, position, uncommitted); err != nil {
+				return uncommitted, err
+			}
+			uncommitted = 0
+		}
+	}
+	return uncommitted, nil
+}
 
-	return changes, latestLSN, nil
+// commitCheckpoint checkpoints the position, retrying until it is accepted, and makes it the
+// monitor's current position. Retrying stops with ctx.Err() when ctx is cancelled, and a save refused
+// for its fencing token is returned at once since another instance now streams the table.
+func (m *SQLServerTableMonitor) commitCheckpoint(ctx context.Context, position Position, eventCount int) error {
+	backoff := NewBackoffManager(m.pollInterval, m.maxPollInterval)
+	for {
+		err := m.saveCheckpoint(position, eventCount)
+		if err == nil {
+			m.setPosition(position)
+			return nil
+		}
+		if errors.Is(err, ErrStaleFencingToken) {
+			return err
+		}
+		log.Printf("Failed to save checkpoint for table %s, retrying in %s: %v", m.tableName, backoff.GetInterval(), err)
+		if err := sleep(ctx, backoff.GetInterval()); err != nil {
+			return err
+		}
+		backoff.IncreaseInterval()
+	}
 }
 
-// publishChangeToNATS publishes a CDC change to a NATS topic
+// publishChangeToNATS stores a CDC change in the event stream, in the partition of its primary key, and
+// waits until the stream has persisted it. The publisher delivers it to the sink from there.
 func (m *SQLServerTableMonitor) publishChangeToNATS(change map[string]interface{}) error {
+	if metadata := changeMetadata(change); metadata != nil {
+		metadata["TableName"] = m.tableName
+	}
+
 	data, err := json.Marshal(change)
 	if err != nil {
-		return fmt.Errorf("failed to marshal change: %w", err)
+		return fmt.Errorf("%w: %v", ErrSerialization, err)
 	}
-	return m.natsConn.Publish(topics.CDC.Event, data)
+	return m.publishEvent(newEventMessage(m.database, m.tableName, data, change, eventPartition(change, m.keyColumns, m.partitions)))
 }
 
-// parseChange processes a row into a structured change
-func parseChange(lsn []byte, operation int, columns []string, columnData []interface{}) map[string]interface{} {
-	operationType := map[int]string{2: "Insert", 4: "Update", 1: "Delete"}[operation]
+// deadLetterChange stores a change that could not be serialized in the dead letter stream, in its printed form
+func (m *SQLServerTableMonitor) deadLetterChange(change map[string]interface{}, cause error) error {
+	now := time.Now().UTC()
+	return m.deadLetter(DeadLetter{
+		TableName:     m.tableName,
+		Source:        DeadLetterSourceFetcher,
+		Data:          []byte(fmt.Sprintf("%v", change)),
+		Error:         cause.Error(),
+		Attempts:      1,
+		FirstFailedAt: now,
+		LastFailedAt:  now,
+	})
+}
+
+// publishSchemaChange publishes a schema change event to NATS
+func (m *SQLServerTableMonitor) publishSchemaChange(event SchemaChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema change: %w", err)
+	}
+	return m.natsConn.Publish(topics.CDC.Schema, data)
+}
+
+// quoteColumns returns a comma separated, bracket quoted column list prefixed with the table alias
+func quoteColumns(alias string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = fmt.Sprintf("%s.[%s]", alias, strings.ReplaceAll(col, "]", "]]"))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// serverTimeToUTC wraps a SQL expression for a datetime in the database server's time zone, such as a CDC
+// commit time, so that it yields the datetimeoffset in UTC. The server's current UTC offset is applied, so
+// times from before a daylight saving change are off by the change.
+func serverTimeToUTC(expr string) string {
+	return fmt.Sprintf("SWITCHOFFSET(TODATETIMEOFFSET(%s, DATEPART(TZOFFSET, SYSDATETIMEOFFSET())), 0)", expr)
+}
+
+// parseChange processes a row into a structured change. commitTime is the transaction's commit time in UTC.
+func parseChange(position Position, commitTime time.Time, columns []string, columnData []interface{}) map[string]interface{} {
+	operationType := map[int]string{2: "Insert", 4: "Update", 1: "Delete"}[position.Operation]
 	data := map[string]interface{}{}
 	for i, col := range columns {
-		if val, ok := columnData[i+2].(*sql.NullString); ok && val.Valid {
+		if val, ok := columnData[i].(*sql.NullString); ok && val.Valid {
 			data[col] = val.String
 		} else {
 			data[col] = nil
@@ -141,17 +532,21 @@ func parseChange(lsn []byte, operation int, columns []string, columnData []inter
 	}
 	return map[string]interface{}{
 		"metadata": map[string]interface{}{
-			"LSN":           hex.EncodeToString(lsn),
+			"LSN":           hex.EncodeToString(position.LSN),
+			"SeqVal":        hex.EncodeToString(position.SeqVal),
+			"OperationCode": position.Operation,
 			"OperationType": operationType,
+			"CommitTime":    commitTime.UTC().Format(time.RFC3339Nano),
 		},
 		"data": data,
 	}
 }
 
 // fetchColumnNames fetches column names for a specified table
-func fetchColumnNames(db *sql.DB, tableName string) ([]string, error) {
-	query := `SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_NAME = @tableName`
-	rows, err := db.Query(query, sql.Named("tableName", tableName))
+func fetchColumnNames(ctx context.Context, db *sql.DB, tableName string) ([]string, error) {
+	schema, table := splitTableName(tableName)
+	query := `SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = @schema AND TABLE_NAME = @tableName ORDER BY ORDINAL_POSITION`
+	rows, err := db.QueryContext(ctx, query, sql.Named("schema", schema), sql.Named("tableName", table))
 	if err != nil {
 		return nil, err
 	}
@@ -167,3 +562,11 @@ func fetchColumnNames(db *sql.DB, tableName string) ([]string, error) {
 	}
 	return columns, rows.Err()
 }
+
+// fencedError returns err when it reports that the monitor was fenced off, and nil for a cancelled context
+func fencedError(err error) error {
+	if errors.Is(err, ErrStaleFencingToken) {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // BackoffManager handles exponential backoff logic for polling intervals.
 type BackoffManager struct {
@@ -35,3 +38,15 @@ func (b *BackoffManager) IncreaseInterval() {
 func (b *BackoffManager) ResetInterval() {
 	b.currentInterval = b.initialInterval
 }
+
+// sleep waits for the given duration, returning ctx.Err() early if the context is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,35 +1,64 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/katasec/dstream/utils"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
+// Polling intervals used when a table's configuration does not specify valid ones
+const (
+	defaultPollInterval    = 5 * time.Second
+	defaultMaxPollInterval = 30 * time.Second
+)
+
+// eventPublishTimeout is how long to wait for the event stream to store a published event
+const eventPublishTimeout = 10 * time.Second
+
 // ChangeDataFetcher struct represents a worker that fetches CDC data and publishes it
 type ChangeDataFetcher struct {
-	name string
-	conn *nats.Conn
-	db   *sql.DB
+	name        string
+	conn        *nats.Conn
+	js          jetstream.JetStream
+	events      jetstream.Stream // Buffers change events until the publisher delivered them
+	db          *sql.DB
+	database    string // Source database name used in event subjects
+	partitions  int    // Partitions each table's events are spread over
+	signalTable string
+	instanceID  string // Recorded with every checkpoint this fetcher saves
 }
 
-// NewChangeDataFetcher creates a new worker that fetches CDC data
-func NewChangeDataFetcher(name string, conn *nats.Conn, db *sql.DB) *ChangeDataFetcher {
+// NewChangeDataFetcher creates a new worker that fetches CDC data and publishes it to the events stream
+func NewChangeDataFetcher(name string, conn *nats.Conn, js jetstream.JetStream, events jetstream.Stream, db *sql.DB, database string, partitions int, signalTable string, instanceID string) *ChangeDataFetcher {
 	cdcFetcher := &ChangeDataFetcher{
-		name: name,
-		conn: conn,
-		db:   db,
+		name:        name,
+		conn:        conn,
+		js:          js,
+		events:      events,
+		db:          db,
+		database:    database,
+		partitions:  max(partitions, 1),
+		signalTable: signalTable,
+		instanceID:  instanceID,
 	}
 
 	return cdcFetcher
 }
 
-// FetchLastLSN fetches the last LSN for a given table from the checkpoint worker
-func (w *ChangeDataFetcher) FetchLastLSN(tableName string) []byte {
+// FetchLastPosition fetches the last delivered position for a given table from the checkpoint worker.
+// The returned bool is false when no checkpoint was stored for the table.
+func (w *ChangeDataFetcher) FetchLastPosition(tableName string) (Position, bool, error) {
 	topic := "checkpoint.load"
 	req := LoadLastLSNRequest{TableName: tableName}
 	reqData, _ := json.Marshal(req)
@@ -37,56 +66,365 @@ func (w *ChangeDataFetcher) FetchLastLSN(tableName string) []byte {
 	// Use NATS Request-Reply to get the last LSN
 	msg, err := w.conn.Request(topic, reqData, 2*time.Second)
 	if err != nil {
-		log.Fatalf("[%s] Failed to fetch last LSN for table '%s': %v", w.name, tableName, err)
+		return Position{}, false, fmt.Errorf("failed to fetch last LSN for table '%s': %w", tableName, err)
 	}
 
 	var resp LoadLastLSNResponse
 	if err := json.Unmarshal(msg.Data, &resp); err != nil {
-		log.Fatalf("[%s] Failed to parse last LSN response: %v", w.name, err)
+		return Position{}, false, fmt.Errorf("failed to parse last LSN response: %w", err)
 	}
 
 	if resp.Error != "" {
-		log.Fatalf("[%s] Error in last LSN response: %s", w.name, resp.Error)
+		return Position{}, false, fmt.Errorf("error in last LSN response: %s", resp.Error)
 	}
 
-	log.Printf("[%s] Fetched last LSN for table '%s': %s", w.name, tableName, hex.EncodeToString(resp.LastLSN))
-	return resp.LastLSN
+	position := Position{LSN: resp.LastLSN, SeqVal: resp.LastSeqVal, Operation: resp.LastOperation}
+	log.Printf("[%s] Fetched last position for table '%s': %s", w.name, tableName, position)
+	return position, resp.Found, nil
 }
 
-// ProcessCDCChanges processes CDC changes for a given table and publishes them
-func (w *ChangeDataFetcher) ProcessCDCChanges(tableName string, lastLSN []byte) {
+// ProcessCDCChanges snapshots the table if required and then processes CDC changes for it and publishes them
+// to the event stream until ctx is cancelled. Checkpoints follow the events through the stream, carrying
+// the given fencing token, and are saved by the publisher once the events before them are delivered.
+// It returns nil once ctx is cancelled or another instance took the table over, and an error when the
+// table cannot be streamed.
+func (w *ChangeDataFetcher) ProcessCDCChanges(ctx context.Context, table config.TableConfig, lastPosition Position, hasCheckpoint bool, token int64) error {
+	pollInterval, err := table.GetPollInterval()
+	if err != nil {
+		log.Printf("[%s] Invalid poll_interval for table '%s', using %s: %v", w.name, table.Name, defaultPollInterval, err)
+		pollInterval = defaultPollInterval
+	}
+	maxPollInterval, err := table.GetMaxPollInterval()
+	if err != nil {
+		log.Printf("[%s] Invalid max_poll_interval for table '%s', using %s: %v", w.name, table.Name, defaultMaxPollInterval, err)
+		maxPollInterval = defaultMaxPollInterval
+	}
 
-	monitor := NewSQLServerTableMonitor(w.db, tableName, w.conn, 5*time.Second, 30*time.Second)
-	err := monitor.StartMonitor(lastLSN)
+	monitor, err := NewSQLServerTableMonitor(ctx, w.db, table, w.conn, pollInterval, maxPollInterval)
+	if err != nil {
+		return err
+	}
+	monitor.database = w.database
+	monitor.partitions = w.partitions
+	monitor.signalTable = w.signalTable
+	monitor.saveSnapshotProgress = func(p SnapshotProgress) error {
+		return w.SaveSnapshotProgress(table.Name, p)
+	}
+	monitor.publishEvent = w.publishEvent
+	monitor.deadLetter = w.publishDeadLetter
+	monitor.saveCheckpoint = func(position Position, eventCount int) error {
+		return w.StreamCheckpoint(table.Name, position, eventCount, token)
+	}
+	monitor.purgeEvents = func(ctx context.Context) error {
+		return w.PurgeEvents(ctx, table.Name)
+	}
+	monitor.rewindCheckpoint = func(lsn []byte) error {
+		return w.RewindCheckpoint(table.Name, lsn)
+	}
+	lastPosition, err = w.snapshotIfNeeded(ctx, monitor, table, lastPosition, hasCheckpoint, token)
+	if err == nil {
+		err = monitor.StartMonitor(ctx, lastPosition)
+	}
+	if errors.Is(err, ErrStaleFencingToken) {
+		log.Printf("[%s] Stopped monitoring table '%s': another instance took it over: %v", w.name, table.Name, err)
+		return nil
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted snapshots and handoffs resume on the next start
+		return nil
+	}
 	if err != nil {
-		log.Fatalf("[%s] Error monitoring table '%s': %v", w.name, tableName, err)
+		return fmt.Errorf("error monitoring table '%s': %w", table.Name, err)
 	}
+	return nil
 }
 
-// SaveLastLSN saves the last LSN for a given table via the checkpoint worker
-func (w *ChangeDataFetcher) SaveLastLSN(tableName string, lastLSN []byte) {
-	topic := "checkpoint.save"
-	req := SaveLastLSNRequest{
-		TableName: tableName,
-		LastLSN:   lastLSN,
+// snapshotIfNeeded runs or resumes a snapshot according to the table's snapshot mode and
+// returns the position from which CDC streaming should continue
+func (w *ChangeDataFetcher) snapshotIfNeeded(ctx context.Context, monitor *SQLServerTableMonitor, table config.TableConfig, lastPosition Position, hasCheckpoint bool, token int64) (Position, error) {
+	mode, err := table.GetSnapshotMode()
+	if err != nil {
+		return Position{}, err
 	}
-	reqData, _ := json.Marshal(req)
 
-	if err := w.conn.Publish(topic, reqData); err != nil {
-		log.Fatalf("[%s] Failed to save last LSN for table '%s': %v", w.name, tableName, err)
+	progress, err := w.FetchSnapshotProgress(table.Name)
+	if err != nil {
+		return Position{}, err
+	}
+	if progress != nil && progress.Incremental && progress.Status == SnapshotStatusRunning {
+		log.Printf("[%s] Resuming incremental snapshot of table '%s' after key %v", w.name, table.Name, progress.LastKey)
+		monitor.incremental = progress
+	}
+	if mode == SnapshotModeNever {
+		return lastPosition, nil
+	}
+
+	available := true
+	if hasCheckpoint {
+		if available, err = monitor.CheckpointAvailable(ctx, lastPosition.LSN); err != nil {
+			return Position{}, fmt.Errorf("failed to check checkpoint for table '%s': %w", table.Name, err)
+		}
+	}
+	if !shouldSnapshot(mode, hasCheckpoint, available, progress) {
+		return lastPosition, nil
+	}
+
+	progress, err = monitor.RunSnapshot(ctx, progress, monitor.saveSnapshotProgress)
+	if err != nil {
+		return Position{}, fmt.Errorf("snapshot failed for table '%s': %w", table.Name, err)
+	}
+
+	// Hand off to CDC: the handoff checkpoint follows the snapshot events through the stream, and the
+	// snapshot is only marked complete once the publisher delivered them and saved the checkpoint
+	handoff := Position{LSN: progress.HandoffLSN}
+	if err := w.StreamCheckpoint(table.Name, handoff, 0, token); err != nil {
+		return Position{}, fmt.Errorf("failed to hand off snapshot of table '%s': %w", table.Name, err)
+	}
+	if err := w.waitForPosition(ctx, table.Name, handoff); err != nil {
+		return Position{}, fmt.Errorf("failed to hand off snapshot of table '%s': %w", table.Name, err)
+	}
+	progress.Status = SnapshotStatusCompleted
+	progress.UpdatedAt = time.Now().UTC()
+	if err := w.SaveSnapshotProgress(table.Name, *progress); err != nil {
+		return Position{}, fmt.Errorf("failed to complete snapshot for table '%s': %w", table.Name, err)
+	}
+
+	log.Printf("[%s] Snapshot of table '%s' completed; streaming from LSN %s", w.name, table.Name, hex.EncodeToString(progress.HandoffLSN))
+	return Position{LSN: progress.HandoffLSN}, nil
+}
+
+// waitForPosition waits until the checkpoint saved for a table reached the given position
+func (w *ChangeDataFetcher) waitForPosition(ctx context.Context, tableName string, position Position) error {
+	backoff := NewBackoffManager(100*time.Millisecond, 5*time.Second)
+	for {
+		lastPosition, found, err := w.FetchLastPosition(tableName)
+		if err != nil {
+			return err
+		}
+		if found && comparePositions(lastPosition, position) >= 0 {
+			return nil
+		}
+		if err := sleep(ctx, backoff.GetInterval()); err != nil {
+			return err
+		}
+		backoff.IncreaseInterval()
+	}
+}
+
+// FetchSnapshotProgress fetches the snapshot progress for a given table from the checkpoint worker
+func (w *ChangeDataFetcher) FetchSnapshotProgress(tableName string) (*SnapshotProgress, error) {
+	reqData, _ := json.Marshal(LoadSnapshotRequest{TableName: tableName})
+
+	msg, err := w.conn.Request(topics.Checkpoints.LoadSnapshot, reqData, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch snapshot progress for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[LoadSnapshotResponse](msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("error in snapshot progress response: %s", resp.Error)
+	}
+	return resp.Progress, nil
+}
+
+// SaveSnapshotProgress saves the snapshot progress for a given table via the checkpoint worker
+func (w *ChangeDataFetcher) SaveSnapshotProgress(tableName string, progress SnapshotProgress) error {
+	reqData, _ := json.Marshal(SaveSnapshotRequest{TableName: tableName, Progress: progress})
+
+	msg, err := w.conn.Request(topics.Checkpoints.SaveSnapshot, reqData, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot progress for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[SaveSnapshotResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// publishEvent stores a message in the event stream and waits for the stream to acknowledge it. It is not
+// tied to the table's context, so a batch in flight is stored completely when streaming stops.
+func (w *ChangeDataFetcher) publishEvent(msg *nats.Msg) error {
+	ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+	defer cancel()
+	if _, err := w.js.PublishMsg(ctx, msg); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", msg.Subject, err)
+	}
+	return nil
+}
+
+// publishDeadLetter stores a change that could not be published in the dead letter stream
+func (w *ChangeDataFetcher) publishDeadLetter(letter DeadLetter) error {
+	ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+	defer cancel()
+	return publishDeadLetter(ctx, w.js, letter)
+}
+
+// StreamCheckpoint publishes a checkpoint marker for a table behind the events published before it, with
+// a copy in every partition. The publisher saves the position with the given fencing token once the events
+// before it are delivered in all partitions. The token is validated first, so that a monitor whose table
+// was taken over stops at its next checkpoint; the error then wraps ErrStaleFencingToken.
+func (w *ChangeDataFetcher) StreamCheckpoint(tableName string, position Position, eventCount int, token int64) error {
+	if err := w.ValidateFencingToken(tableName, token); err != nil {
+		return err
+	}
+	for _, msg := range newCheckpointMessages(w.database, w.saveRequest(tableName, position, eventCount, token), w.partitions) {
+		if err := w.publishEvent(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateFencingToken checks via the checkpoint worker that no other instance claimed the table with a
+// newer fencing token. The error wraps ErrStaleFencingToken when one did.
+func (w *ChangeDataFetcher) ValidateFencingToken(tableName string, token int64) error {
+	reqData, _ := json.Marshal(ValidateFencingTokenRequest{TableName: tableName, FencingToken: token})
+
+	msg, err := w.conn.Request(topics.Checkpoints.Validate, reqData, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to validate fencing token for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[ValidateFencingTokenResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Fenced {
+		return fmt.Errorf("%w: %s", ErrStaleFencingToken, resp.Error)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// PurgeEvents drops the events and checkpoint markers of a table that were not delivered yet
+func (w *ChangeDataFetcher) PurgeEvents(ctx context.Context, tableName string) error {
+	if err := w.events.Purge(ctx, jetstream.WithPurgeSubject(tableEventFilter(w.database, tableName))); err != nil {
+		return err
+	}
+	log.Printf("[%s] Purged pending events of table '%s'", w.name, tableName)
+	return nil
+}
+
+// SaveLastPosition saves the last delivered position for a given table via the checkpoint worker and waits
+// for it to be stored. eventCount is the number of events delivered since the previous save. The error
+// wraps ErrStaleFencingToken when the save was refused for carrying an outdated fencing token.
+func (w *ChangeDataFetcher) SaveLastPosition(tableName string, position Position, eventCount int, token int64) error {
+	reqData, _ := json.Marshal(w.saveRequest(tableName, position, eventCount, token))
+
+	msg, err := w.conn.Request(topics.Checkpoints.Save, reqData, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to save last position for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[SaveLastLSNResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Fenced {
+		return fmt.Errorf("%w: %s", ErrStaleFencingToken, resp.Error)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	log.Printf("[%s] Saved last position for table '%s': %s", w.name, tableName, position)
+	return nil
+}
+
+// saveRequest builds the checkpoint save request for a table's position
+func (w *ChangeDataFetcher) saveRequest(tableName string, position Position, eventCount int, token int64) SaveLastLSNRequest {
+	return SaveLastLSNRequest{
+		TableName:     tableName,
+		LastLSN:       position.LSN,
+		LastSeqVal:    position.SeqVal,
+		LastOperation: position.Operation,
+		InstanceID:    w.instanceID,
+		EventCount:    int64(eventCount),
+		FencingToken:  token,
+	}
+}
+
+// FlushCheckpoint asks the checkpoint worker to write the buffered checkpoint of a table to the store
+func (w *ChangeDataFetcher) FlushCheckpoint(tableName string) error {
+	reqData, _ := json.Marshal(FlushCheckpointRequest{TableName: tableName})
+
+	msg, err := w.conn.Request(topics.Checkpoints.Flush, reqData, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to flush checkpoint for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[FlushCheckpointResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// FenceCheckpoint claims the checkpoint of a table for the given fencing token via the checkpoint worker
+func (w *ChangeDataFetcher) FenceCheckpoint(tableName string, token int64) error {
+	reqData, _ := json.Marshal(FenceCheckpointRequest{TableName: tableName, FencingToken: token, InstanceID: w.instanceID})
+
+	msg, err := w.conn.Request(topics.Checkpoints.Fence, reqData, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to fence checkpoint for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[FenceCheckpointResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Fenced {
+		return fmt.Errorf("%w: %s", ErrStaleFencingToken, resp.Error)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	log.Printf("[%s] Fenced checkpoint for table '%s' with token %d", w.name, tableName, token)
+	return nil
+}
+
+// RewindCheckpoint moves the checkpoint of a table back to an earlier LSN via the checkpoint worker
+func (w *ChangeDataFetcher) RewindCheckpoint(tableName string, lastLSN []byte) error {
+	reqData, _ := json.Marshal(RewindCheckpointRequest{TableName: tableName, LastLSN: lastLSN, InstanceID: w.instanceID})
+
+	msg, err := w.conn.Request(topics.Checkpoints.Rewind, reqData, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to rewind checkpoint for table '%s': %w", tableName, err)
+	}
+
+	resp, err := utils.UnmarshalJSON[RewindCheckpointResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
 	}
-	log.Printf("[%s] Saved last LSN for table '%s': %s", w.name, tableName, lastLSN)
+	log.Printf("[%s] Rewound checkpoint for table '%s' to LSN %s (generation %d)", w.name, tableName, hex.EncodeToString(lastLSN), resp.Generation)
+	return nil
 }
 
 // Publish publishes hardcoded CDC data to a topic
-func (w *ChangeDataFetcher) Publish(topic string) {
+func (w *ChangeDataFetcher) Publish(topic string) error {
 	data := `{
 		"operation": "INSERT",
 		"table": "users",
 		"data": { "id": 1, "name": "Alice" }
 	}`
 	if err := w.conn.Publish(topic, []byte(data)); err != nil {
-		log.Fatalf("[%s] Error publishing CDC data to topic '%s': %v", w.name, topic, err)
+		return fmt.Errorf("error publishing CDC data to topic '%s': %w", topic, err)
 	}
 	log.Printf("[%s] Published CDC data to topic '%s': %s", w.name, topic, data)
+	return nil
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/katasec/dstream/utils"
+	"github.com/nats-io/nats.go"
+)
+
+// FlushPolicy decides when the checkpoint worker writes buffered saves to the store. A table's
+// pending save is written once Events events were delivered since its last flush or Interval
+// has passed, whichever comes first. Events of 1 or less writes every save through, and an
+// Interval of 0 disables the timer.
+type FlushPolicy struct {
+	Events   int
+	Interval time.Duration
+}
+
+// pendingSave is the latest buffered save of a table
+type pendingSave struct {
+	request SaveLastLSNRequest // EventCount accumulates over all coalesced saves
+	since   time.Time          // When the oldest coalesced save arrived
+}
+
+// CheckpointMetrics reports checkpoint commits of a table and how far the committed position
+// lags behind the delivered one
+type CheckpointMetrics struct {
+	TableName              string  `json:"table_name"`
+	Commits                int64   `json:"commits"`
+	FailedCommits          int64   `json:"failed_commits"`
+	LastCommitLatencyMs    float64 `json:"last_commit_latency_ms"`
+	MaxCommitLatencyMs     float64 `json:"max_commit_latency_ms"`
+	AverageCommitLatencyMs float64 `json:"average_commit_latency_ms"`
+	DeliveredPosition      string  `json:"delivered_position"`
+	CommittedPosition      string  `json:"committed_position"`
+	LagEvents              int64   `json:"lag_events"`
+	LagSeconds             float64 `json:"lag_seconds"`
+	LastError              string  `json:"last_error,omitempty"`
+
+	totalLatency time.Duration
+	lastErr      error
+	committed    *Position // Position of the last save written by this worker
+	fencingToken int64     // Highest fencing token stored or buffered for the table
+	tokenLoaded  bool      // Whether fencingToken includes the stored checkpoint's token
+}
+
+// CheckpointMetricsResponse defines the response payload for checkpoint metrics, ordered by table.
+type CheckpointMetricsResponse struct {
+	Tables []CheckpointMetrics `json:"tables"`
+}
+
+// bufferSave coalesces a save with the table's pending one and flushes it when the policy says so.
+// A save under an older fencing token than the table's is refused at once. Otherwise it returns the
+// error of the last failed flush of the table until a flush succeeds.
+func (cw *CheckpointWorker) bufferSave(ctx context.Context, req SaveLastLSNRequest) error {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	// A save under an older lock is refused at once, before it can replace the new owner's pending save
+	token, err := cw.fencingTokenLocked(ctx, req.TableName)
+	if err != nil {
+		return err
+	}
+	if req.FencingToken < token {
+		return fmt.Errorf("%w: table %s is fenced with token %d, refusing token %d", ErrStaleFencingToken,
+			req.TableName, token, req.FencingToken)
+	}
+	metrics := cw.tableMetrics(req.TableName)
+	metrics.fencingToken = req.FencingToken
+	if errors.Is(metrics.lastErr, ErrStaleFencingToken) {
+		// The refused flush belonged to the instance this save's lock replaced
+		metrics.LastError = ""
+		metrics.lastErr = nil
+	}
+
+	pending, ok := cw.pending[req.TableName]
+	latest := metrics.committed
+	if ok {
+		pendingPosition := requestPosition(pending.request)
+		latest = &pendingPosition
+	}
+	if latest != nil && comparePositions(requestPosition(req), *latest) <= 0 {
+		// A retried save, e.g. after a request timeout or a redelivery, was counted already
+		return cw.lastFlushError(req.TableName)
+	}
+	if !ok {
+		pending = &pendingSave{since: time.Now()}
+		cw.pending[req.TableName] = pending
+	}
+	req.EventCount += pending.request.EventCount
+	pending.request = req
+	metrics.DeliveredPosition = requestPosition(req).String()
+
+	if cw.policy.Events <= 1 || req.EventCount >= int64(cw.policy.Events) {
+		return cw.flushLocked(ctx, req.TableName)
+	}
+	return cw.lastFlushError(req.TableName)
+}
+
+// fencingTokenLocked returns the highest fencing token known for a table, reading the stored checkpoint
+// the first time. The caller holds cw.mutex.
+func (cw *CheckpointWorker) fencingTokenLocked(ctx context.Context, tableName string) (int64, error) {
+	metrics := cw.tableMetrics(tableName)
+	if !metrics.tokenLoaded {
+		checkpoint, err := cw.store.Load(ctx, tableName)
+		if err != nil {
+			return 0, err
+		}
+		if checkpoint != nil {
+			metrics.fencingToken = max(metrics.fencingToken, checkpoint.FencingToken)
+		}
+		metrics.tokenLoaded = true
+	}
+	return metrics.fencingToken, nil
+}
+
+// lastFlushError returns the error of the last failed flush of a table, or nil once a flush succeeded.
+// The caller holds cw.mutex.
+func (cw *CheckpointWorker) lastFlushError(tableName string) error {
+	if lastErr := cw.tableMetrics(tableName).lastErr; lastErr != nil {
+		return &flushError{lastErr}
+	}
+	return nil
+}
+
+// flushLocked writes the pending save of a table to the store. The caller holds cw.mutex.
+func (cw *CheckpointWorker) flushLocked(ctx context.Context, tableName string) error {
+	pending, ok := cw.pending[tableName]
+	if !ok {
+		return nil
+	}
+	req := pending.request
+	metrics := cw.tableMetrics(tableName)
+
+	start := time.Now()
+	err := cw.updateLocked(ctx, tableName, func(checkpoint *Checkpoint) {
+		checkpoint.LastLSN = req.LastLSN
+		checkpoint.LastSeqVal = req.LastSeqVal
+		checkpoint.LastOperation = req.LastOperation
+		checkpoint.InstanceID = req.InstanceID
+		checkpoint.EventCount = req.EventCount
+		checkpoint.FencingToken = req.FencingToken
+		cw.record(checkpoint, false)
+	})
+	latency := time.Since(start)
+
+	if err != nil {
+		// Keep the save pending so the next flush retries it, unless it can never be written
+		if errors.Is(err, ErrStaleFencingToken) {
+			delete(cw.pending, tableName)
+		}
+		metrics.FailedCommits++
+		metrics.LastError = err.Error()
+		metrics.lastErr = err
+		log.Printf("[CheckpointWorker] Failed to flush checkpoint for table '%s': %v", tableName, err)
+		return err
+	}
+
+	delete(cw.pending, tableName)
+	metrics.Commits++
+	metrics.totalLatency += latency
+	metrics.LastCommitLatencyMs = milliseconds(latency)
+	metrics.AverageCommitLatencyMs = milliseconds(metrics.totalLatency / time.Duration(metrics.Commits))
+	if metrics.LastCommitLatencyMs > metrics.MaxCommitLatencyMs {
+		metrics.MaxCommitLatencyMs = metrics.LastCommitLatencyMs
+	}
+	committed := requestPosition(req)
+	metrics.committed = &committed
+	metrics.CommittedPosition = committed.String()
+	metrics.LastError = ""
+	metrics.lastErr = nil
+	return nil
+}
+
+// Flush writes all pending saves to the store
+func (cw *CheckpointWorker) Flush(ctx context.Context) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	for tableName := range cw.pending {
+		_ = cw.flushLocked(ctx, tableName)
+	}
+}
+
+// FlushTable writes the pending save of one table to the store, e.g. before another instance takes
+// the table over
+func (cw *CheckpointWorker) FlushTable(ctx context.Context, tableName string) error {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	return cw.flushLocked(ctx, tableName)
+}
+
+// runFlushTimer flushes pending saves every policy interval until the worker is stopped
+func (cw *CheckpointWorker) runFlushTimer() {
+	if cw.policy.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cw.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+			cw.Flush(ctx)
+			cancel()
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+// Stop stops taking requests and the flush timer, and writes all pending saves to the store, giving up
+// when ctx is done. An elected worker releases its lock once they are written.
+func (cw *CheckpointWorker) Stop(ctx context.Context) {
+	cw.subsMutex.Lock()
+	utils.Unsubscribe(cw.subs)
+	cw.subs = nil
+	cw.stopOnce.Do(func() { close(cw.stop) })
+	cw.subsMutex.Unlock()
+
+	cw.Flush(ctx)
+	log.Println("[CheckpointWorker] Flushed pending checkpoints")
+	if cw.elected != nil {
+		<-cw.elected
+	}
+}
+
+// metricsHandler A handler for topics.Checkpoints.Metrics event
+func (cw *CheckpointWorker) metricsHandler(msg *nats.Msg) {
+	respData, _ := json.Marshal(cw.Metrics())
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send CheckpointMetrics response: %v", err)
+	}
+}
+
+// Metrics returns a snapshot of the checkpoint metrics of all tables
+func (cw *CheckpointWorker) Metrics() CheckpointMetricsResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	var resp CheckpointMetricsResponse
+	for tableName, metrics := range cw.metrics {
+		m := *metrics
+		if pending, ok := cw.pending[tableName]; ok {
+			m.LagEvents = pending.request.EventCount
+			m.LagSeconds = time.Since(pending.since).Seconds()
+		}
+		resp.Tables = append(resp.Tables, m)
+	}
+	sort.Slice(resp.Tables, func(i, j int) bool { return resp.Tables[i].TableName < resp.Tables[j].TableName })
+	return resp
+}
+
+// tableMetrics returns the metrics of a table, creating them on first use. The caller holds cw.mutex.
+func (cw *CheckpointWorker) tableMetrics(tableName string) *CheckpointMetrics {
+	metrics, ok := cw.metrics[tableName]
+	if !ok {
+		metrics = &CheckpointMetrics{TableName: tableName}
+		cw.metrics[tableName] = metrics
+	}
+	return metrics
+}
+
+// flushError reports a failed flush to later saves of the table
+type flushError struct {
+	err error
+}
+
+func (e *flushError) Error() string {
+	return "last checkpoint flush failed: " + e.err.Error()
+}
+
+func (e *flushError) Unwrap() error {
+	return e.err
+}
+
+// requestPosition returns the position carried by a save request
+func requestPosition(req SaveLastLSNRequest) Position {
+	return Position{LSN: req.LastLSN, SeqVal: req.LastSeqVal, Operation: req.LastOperation}
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
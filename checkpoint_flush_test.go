@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// storedLSN returns the LSN written to the store for a table, or nil
+func storedLSN(t *testing.T, store CheckpointStore, tableName string) []byte {
+	t.Helper()
+	checkpoint, err := store.Load(context.TODO(), tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil {
+		return nil
+	}
+	return checkpoint.LastLSN
+}
+
+func TestCheckpointWorkerCoalescesSaves(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nil, 10, FlushPolicy{Events: 10})
+
+	for i := byte(1); i <= 3; i++ {
+		if resp := cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{i}, EventCount: 3}); resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+	}
+	if lsn := storedLSN(t, store, "Cars"); lsn != nil {
+		t.Fatalf("expected saves below the event threshold to stay buffered, store has %x", lsn)
+	}
+	if resp := cw.loadLastLSN(context.TODO(), LoadLastLSNRequest{TableName: "Cars"}); !bytes.Equal(resp.LastLSN, []byte{3}) {
+		t.Fatalf("expected load to return the buffered LSN 03, got %x", resp.LastLSN)
+	}
+
+	metrics := cw.Metrics().Tables
+	if len(metrics) != 1 || metrics[0].LagEvents != 9 || metrics[0].Commits != 0 {
+		t.Fatalf("unexpected metrics before flush: %+v", metrics)
+	}
+
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{4}, EventCount: 3})
+	checkpoint, _ := store.Load(context.TODO(), "Cars")
+	if checkpoint == nil || !bytes.Equal(checkpoint.LastLSN, []byte{4}) || checkpoint.EventCount != 12 || len(checkpoint.History) != 1 {
+		t.Fatalf("expected one coalesced write of LSN 04 with 12 events, got %+v", checkpoint)
+	}
+
+	metrics = cw.Metrics().Tables
+	if metrics[0].Commits != 1 || metrics[0].LagEvents != 0 || metrics[0].CommittedPosition != "04" {
+		t.Fatalf("unexpected metrics after flush: %+v", metrics)
+	}
+}
+
+func TestCheckpointWorkerFlushInterval(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nil, 10, FlushPolicy{Events: 1000, Interval: 20 * time.Millisecond})
+	go cw.runFlushTimer()
+	defer cw.Stop(context.TODO())
+
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{1}, EventCount: 1})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for storedLSN(t, store, "Cars") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the flush timer to write the pending checkpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckpointWorkerStopFlushes(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nil, 10, FlushPolicy{Events: 1000})
+
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{1}, EventCount: 1})
+	cw.Stop(context.TODO())
+
+	if lsn := storedLSN(t, store, "Cars"); !bytes.Equal(lsn, []byte{1}) {
+		t.Fatalf("expected Stop to flush LSN 01, store has %x", lsn)
+	}
+}
+
+func TestCheckpointWorkerSnapshotFlushesFirst(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nil, 10, FlushPolicy{Events: 1000})
+
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{7}})
+	cw.saveSnapshot(context.TODO(), SaveSnapshotRequest{TableName: "Cars", Progress: SnapshotProgress{Status: SnapshotStatusCompleted}})
+
+	checkpoint, _ := store.Load(context.TODO(), "Cars")
+	if checkpoint == nil || !bytes.Equal(checkpoint.LastLSN, []byte{7}) || checkpoint.Snapshot == nil {
+		t.Fatalf("expected the handoff LSN to be written with the snapshot, got %+v", checkpoint)
+	}
+}
+
+func TestCheckpointWorkerIgnoresRetriedSaves(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nil, 10, FlushPolicy{Events: 10})
+
+	// A save retried after a timeout arrives again with the same position and is not counted twice
+	for i := 0; i < 3; i++ {
+		cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{2}, EventCount: 4})
+	}
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{1}, EventCount: 4})
+	if lsn := storedLSN(t, store, "Cars"); lsn != nil {
+		t.Fatalf("expected retried saves not to reach the event threshold, store has %x", lsn)
+	}
+	if metrics := cw.Metrics().Tables; len(metrics) != 1 || metrics[0].LagEvents != 4 || metrics[0].DeliveredPosition != "02" {
+		t.Fatalf("expected 4 pending events at 02, got %+v", metrics)
+	}
+
+	// Nor is a retry arriving after the save was written
+	cw.Flush(context.TODO())
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{2}, EventCount: 4})
+	if metrics := cw.Metrics().Tables; metrics[0].LagEvents != 0 || metrics[0].Commits != 1 {
+		t.Fatalf("expected the written save not to be buffered again, got %+v", metrics)
+	}
+}
+
+func TestCheckpointWorkerRefusesStaleSavesAtOnce(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nil, 10, FlushPolicy{Events: 1000})
+
+	// The new owner's save is buffered; a save of the instance it replaced is refused without waiting for a flush
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{5}, EventCount: 1, FencingToken: 2})
+	if resp := cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{9}, EventCount: 1, FencingToken: 1}); !resp.Fenced {
+		t.Fatalf("expected the stale save to be refused at once, got %+v", resp)
+	}
+	cw.Flush(context.TODO())
+	checkpoint, _ := store.Load(context.TODO(), "Cars")
+	if checkpoint == nil || !bytes.Equal(checkpoint.LastLSN, []byte{5}) || checkpoint.FencingToken != 2 {
+		t.Fatalf("expected the new owner's save to be written, got %+v", checkpoint)
+	}
+
+	// A flush refused for a token fenced off in the store is not reported to the owner of a newer lock
+	store.checkpoints["Cars"] = Checkpoint{TableName: "Cars", LastLSN: []byte{5}, FencingToken: 3}
+	cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{6}, EventCount: 1, FencingToken: 2})
+	cw.Flush(context.TODO())
+	if resp := cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{7}, EventCount: 1, FencingToken: 2}); !resp.Fenced {
+		t.Fatalf("expected saves under the fenced token to be refused, got %+v", resp)
+	}
+	if resp := cw.saveLastLSN(context.TODO(), SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{7}, EventCount: 1, FencingToken: 3}); resp.Error != "" {
+		t.Fatalf("expected the newer owner's save to be accepted, got %+v", resp)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+// LoadLastLSNRequest defines the request payload for loading the last LSN.
+type LoadLastLSNRequest struct {
+	TableName string `json:"table_name"`
+}
+
+// LoadLastLSNResponse defines the response payload for loading the last LSN.
+// Found is false when no checkpoint exists and LastLSN holds the default start LSN.
+// LastSeqVal is set when the transaction at LastLSN was only partly delivered.
+type LoadLastLSNResponse struct {
+	LastLSN       []byte `json:"last_lsn"`
+	LastSeqVal    []byte `json:"last_seqval,omitempty"`
+	LastOperation int    `json:"last_operation,omitempty"`
+	Found         bool   `json:"found"`
+	Error         string `json:"error,omitempty"`
+}
+
+// SaveLastLSNRequest defines the request payload for saving the last LSN.
+// LastSeqVal and LastOperation locate the last delivered row of a partly delivered transaction.
+// EventCount is the number of events delivered since the previous save. FencingToken is the token of
+// the lock under which the table is streamed.
+type SaveLastLSNRequest struct {
+	TableName     string `json:"table_name"`
+	LastLSN       []byte `json:"last_lsn"`
+	LastSeqVal    []byte `json:"last_seqval,omitempty"`
+	LastOperation int    `json:"last_operation,omitempty"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	EventCount    int64  `json:"event_count,omitempty"`
+	FencingToken  int64  `json:"fencing_token,omitempty"`
+}
+
+// SaveLastLSNResponse defines the response payload for saving the last LSN.
+// Fenced is true when the save was refused because another instance took the table over.
+type SaveLastLSNResponse struct {
+	Fenced bool   `json:"fenced,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FlushCheckpointRequest defines the request payload for writing a table's buffered checkpoint to the store.
+type FlushCheckpointRequest struct {
+	TableName string `json:"table_name"`
+}
+
+// FlushCheckpointResponse defines the response payload for writing a table's buffered checkpoint.
+type FlushCheckpointResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// FenceCheckpointRequest defines the request payload for claiming a table's checkpoint with a
+// new fencing token, refusing later saves carrying older tokens.
+type FenceCheckpointRequest struct {
+	TableName    string `json:"table_name"`
+	FencingToken int64  `json:"fencing_token"`
+	InstanceID   string `json:"instance_id,omitempty"`
+}
+
+// FenceCheckpointResponse defines the response payload for claiming a table's checkpoint.
+type FenceCheckpointResponse struct {
+	Fenced bool   `json:"fenced,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidateFencingTokenRequest defines the request payload for checking that a fencing token still
+// owns a table's checkpoint.
+type ValidateFencingTokenRequest struct {
+	TableName    string `json:"table_name"`
+	FencingToken int64  `json:"fencing_token"`
+}
+
+// ValidateFencingTokenResponse defines the response payload for checking a fencing token. Fenced is
+// true when another instance claimed the table with a newer token.
+type ValidateFencingTokenResponse struct {
+	Fenced bool   `json:"fenced,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LoadSnapshotRequest defines the request payload for loading snapshot progress.
+type LoadSnapshotRequest struct {
+	TableName string `json:"table_name"`
+}
+
+// LoadSnapshotResponse defines the response payload for loading snapshot progress.
+// Progress is nil when no snapshot has been started for the table.
+type LoadSnapshotResponse struct {
+	Progress *SnapshotProgress `json:"progress,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// SaveSnapshotRequest defines the request payload for saving snapshot progress.
+type SaveSnapshotRequest struct {
+	TableName string           `json:"table_name"`
+	Progress  SnapshotProgress `json:"progress"`
+}
+
+// SaveSnapshotResponse defines the response payload for saving snapshot progress.
+type SaveSnapshotResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// ListCheckpointsRequest defines the request payload for listing all checkpoints.
+type ListCheckpointsRequest struct{}
+
+// ListCheckpointsResponse defines the response payload for listing all checkpoints.
+type ListCheckpointsResponse struct {
+	Checkpoints []Checkpoint `json:"checkpoints"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// DeleteCheckpointRequest defines the request payload for deleting a table's checkpoint.
+type DeleteCheckpointRequest struct {
+	TableName string `json:"table_name"`
+}
+
+// DeleteCheckpointResponse defines the response payload for deleting a table's checkpoint.
+type DeleteCheckpointResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// CheckpointHistoryRequest defines the request payload for reading a table's checkpoint history.
+type CheckpointHistoryRequest struct {
+	TableName string `json:"table_name"`
+}
+
+// CheckpointHistoryResponse defines the response payload for reading a table's checkpoint history, oldest first.
+type CheckpointHistoryResponse struct {
+	History []CheckpointRecord `json:"history"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// RewindCheckpointRequest defines the request payload for moving a table's checkpoint to an earlier LSN.
+type RewindCheckpointRequest struct {
+	TableName  string `json:"table_name"`
+	LastLSN    []byte `json:"last_lsn"`
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// RewindCheckpointResponse defines the response payload for rewinding a table's checkpoint.
+type RewindCheckpointResponse struct {
+	Generation int64  `json:"generation"`
+	Error      string `json:"error,omitempty"`
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/katasec/dstream/utils"
+	"github.com/nats-io/nats.go"
+)
+
+// rewindTimeout is how long a rewind request waits for the monitor to apply it
+const rewindTimeout = time.Minute
+
+// RewindRequest asks a table monitor to move its checkpoint back, either to an LSN taken from the
+// checkpoint history or to the last change committed at or before Time. Streaming resumes with
+// the changes after that position, so they are delivered again.
+type RewindRequest struct {
+	LastLSN []byte     `json:"last_lsn,omitempty"`
+	Time    *time.Time `json:"time,omitempty"` // Compared with the UTC CommitTime in event metadata
+}
+
+// RewindResponse is the reply to an admin rewind request
+type RewindResponse struct {
+	TableName string `json:"table_name"`
+	LastLSN   []byte `json:"last_lsn,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// pendingRewind is a rewind request waiting for the monitor loop
+type pendingRewind struct {
+	request RewindRequest
+	result  chan RewindResponse
+}
+
+// rewindHandler A handler for topics.Admin.Rewind requests. The rewind is applied by the monitor
+// loop between batches, so a batch in flight cannot overwrite the rewound checkpoint.
+func (m *SQLServerTableMonitor) rewindHandler(msg *nats.Msg) {
+	resp := RewindResponse{TableName: m.tableName}
+
+	req, err := utils.UnmarshalJSON[RewindRequest](msg.Data)
+	if err != nil {
+		resp.Error = fmt.Sprintf("failed to parse rewind request: %v", err)
+	} else if (req.LastLSN == nil) == (req.Time == nil) {
+		resp.Error = "a rewind request needs exactly one of last_lsn or time"
+	} else {
+		pending := pendingRewind{request: req, result: make(chan RewindResponse, 1)}
+		select {
+		case m.rewinds <- pending:
+			select {
+			case resp = <-pending.result:
+			case <-time.After(rewindTimeout):
+				resp.Error = fmt.Sprintf("rewind of table %s is queued but was not applied within %s", m.tableName, rewindTimeout)
+			}
+		default:
+			resp.Error = fmt.Sprintf("a rewind of table %s is already pending", m.tableName)
+		}
+	}
+
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("Failed to respond to rewind request for table %s: %v", m.tableName, err)
+	}
+}
+
+// applyPendingRewind applies a queued rewind request, if any
+func (m *SQLServerTableMonitor) applyPendingRewind(ctx context.Context) {
+	select {
+	case pending := <-m.rewinds:
+		resp := RewindResponse{TableName: m.tableName}
+		lsn, err := m.rewind(ctx, pending.request)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.LastLSN = lsn
+		}
+		pending.result <- resp
+	default:
+	}
+}
+
+// rewind resolves the requested position, stores it as the table's checkpoint and continues streaming from it.
+// Events still waiting in the event stream are dropped first.
+func (m *SQLServerTableMonitor) rewind(ctx context.Context, req RewindRequest) ([]byte, error) {
+	target := req.LastLSN
+	if req.Time != nil {
+		lsn, err := mapTimeToLSN(ctx, m.dbConn, *req.Time)
+		if err != nil {
+			return nil, err
+		}
+		target = lsn
+	}
+
+	if !isZeroLSN(target) {
+		minLSN, err := fetchMinLSN(ctx, m.dbConn, m.captureInstance.Name)
+		if err != nil {
+			return nil, err
+		}
+		if hasRetentionGap(target, minLSN) {
+			return nil, fmt.Errorf("cannot rewind table %s to LSN %s: changes after it were removed by CDC cleanup (min LSN %s)",
+				m.tableName, hex.EncodeToString(target), hex.EncodeToString(minLSN))
+		}
+	}
+
+	// Events not delivered yet would move the checkpoint forward again; they are published anew after the rewind
+	if err := m.purgeEvents(ctx); err != nil {
+		return nil, fmt.Errorf("failed to purge pending events of table %s: %w", m.tableName, err)
+	}
+	if err := m.rewindCheckpoint(target); err != nil {
+		return nil, err
+	}
+	m.setPosition(Position{LSN: target})
+	m.polledLSN = nil
+
+	log.Printf("Rewound table %s to LSN %s", m.tableName, hex.EncodeToString(target))
+	return target, nil
+}
+
+// mapTimeToLSN returns the LSN of the last transaction committed at or before a point in time. CDC maps
+// LSNs to the server's local time, so t is converted with the server's current UTC offset, like CommitTime.
+func mapTimeToLSN(ctx context.Context, db *sql.DB, t time.Time) ([]byte, error) {
+	query := `SELECT sys.fn_cdc_map_time_to_lsn('largest less than or equal', CONVERT(datetime, SWITCHOFFSET(@time, DATEPART(TZOFFSET, SYSDATETIMEOFFSET()))))`
+	var lsn []byte
+	err := db.QueryRowContext(ctx, query, sql.Named("time", t)).Scan(&lsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %s to an LSN: %w", t.Format(time.RFC3339), err)
+	}
+	if lsn == nil || isZeroLSN(lsn) {
+		return nil, fmt.Errorf("no change was committed at or before %s", t.Format(time.RFC3339))
+	}
+	return lsn, nil
+}
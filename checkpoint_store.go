@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/nats-io/nats.go"
+)
+
+// defaultStartLSN is the position used for tables without a checkpoint, i.e. the beginning of the capture instance
+var defaultStartLSN = make([]byte, 10)
+
+// Checkpoint is the persisted streaming position of a table. LastSeqVal and LastOperation locate the
+// last delivered row when a transaction was only partly delivered. Generation is raised by every
+// rewind, which is the only way a checkpoint may move backwards. FencingToken is the lock token of
+// the instance that last streamed the table; saves carrying an older token are refused.
+type Checkpoint struct {
+	TableName     string             `json:"table_name"`
+	LastLSN       []byte             `json:"last_lsn,omitempty"`
+	LastSeqVal    []byte             `json:"last_seqval,omitempty"`
+	LastOperation int                `json:"last_operation,omitempty"`
+	Generation    int64              `json:"generation,omitempty"`
+	InstanceID    string             `json:"instance_id,omitempty"`
+	EventCount    int64              `json:"event_count,omitempty"`
+	FencingToken  int64              `json:"fencing_token,omitempty"`
+	Snapshot      *SnapshotProgress  `json:"snapshot,omitempty"`
+	History       []CheckpointRecord `json:"history,omitempty"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+}
+
+// CheckpointRecord is one entry of a checkpoint's audit trail, oldest first
+type CheckpointRecord struct {
+	LastLSN       []byte    `json:"last_lsn"`
+	LastSeqVal    []byte    `json:"last_seqval,omitempty"`
+	LastOperation int       `json:"last_operation,omitempty"`
+	Generation    int64     `json:"generation,omitempty"`
+	InstanceID    string    `json:"instance_id,omitempty"`
+	EventCount    int64     `json:"event_count"` // Events delivered since the previous record
+	FencingToken  int64     `json:"fencing_token,omitempty"`
+	Rewind        bool      `json:"rewind,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ErrStaleFencingToken is returned when a save carries an older fencing token than the stored
+// checkpoint, i.e. another instance has taken the table over since the saving instance acquired it
+var ErrStaleFencingToken = errors.New("fencing token is older than the stored checkpoint's")
+
+// isFenced reports whether next was written under an older lock than current and must be refused
+func isFenced(current, next Checkpoint) bool {
+	return next.FencingToken < current.FencingToken
+}
+
+// isRegression reports whether saving next over current would move a table's checkpoint backwards
+// without a rewind
+func isRegression(current, next Checkpoint) bool {
+	if next.Generation != current.Generation {
+		return next.Generation < current.Generation
+	}
+	return comparePositions(next.Position(), current.Position()) < 0
+}
+
+// Position returns the stored streaming position
+func (c Checkpoint) Position() Position {
+	return Position{LSN: c.LastLSN, SeqVal: c.LastSeqVal, Operation: c.LastOperation}
+}
+
+// CheckpointStore persists checkpoints. Load returns nil without an error when a table has no checkpoint.
+type CheckpointStore interface {
+	Load(ctx context.Context, tableName string) (*Checkpoint, error)
+	Save(ctx context.Context, checkpoint Checkpoint) error
+	List(ctx context.Context) ([]Checkpoint, error)
+	Delete(ctx context.Context, tableName string) error
+}
+
+// NewCheckpointStore creates the checkpoint store selected in the checkpoint block
+func NewCheckpointStore(ctx context.Context, c *config.Config, dbConn *sql.DB, natsConn *nats.Conn) (CheckpointStore, error) {
+	cfg := c.GetCheckpointConfig()
+	switch strings.ToLower(cfg.Type) {
+	case "sqlserver", "":
+		return NewSQLServerCheckpointStore(ctx, dbConn, cfg.Schema, cfg.TableName)
+	case "file":
+		return NewFileCheckpointStore(cfg.Path)
+	case "bolt":
+		return NewBoltCheckpointStore(cfg.Path)
+	case "jetstream":
+		return NewJetStreamCheckpointStore(ctx, natsConn, cfg.Bucket, cfg.History)
+	case "azure_blob":
+		// Checkpoints share the container configured for locks
+		return NewAzureBlobCheckpointStore(ctx, c.Locks.ConnectionString, c.Locks.ContainerName, cfg.Prefix)
+	}
+	return nil, fmt.Errorf("unknown checkpoint store type: %s", cfg.Type)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/katasec/dstream/utils"
+)
+
+// defaultCheckpointBlobPrefix is the virtual directory holding checkpoint blobs
+const defaultCheckpointBlobPrefix = "checkpoints/"
+
+// AzureBlobCheckpointStore stores each table's checkpoint as a JSON blob. Writes are conditional
+// on the blob's ETag, so a concurrent writer can never silently overwrite or regress a checkpoint.
+type AzureBlobCheckpointStore struct {
+	containerClient *container.Client
+	prefix          string
+}
+
+// NewAzureBlobCheckpointStore creates a store in the given container, creating the container if needed
+func NewAzureBlobCheckpointStore(ctx context.Context, connectionString string, containerName string, prefix string) (*AzureBlobCheckpointStore, error) {
+	if prefix == "" {
+		prefix = defaultCheckpointBlobPrefix
+	}
+
+	containerClient, err := container.NewClientFromConnectionString(connectionString, containerName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+	}
+
+	_, err = containerClient.Create(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil, fmt.Errorf("failed to ensure Azure Blob container %s: %w", containerName, err)
+	}
+
+	return &AzureBlobCheckpointStore{
+		containerClient: containerClient,
+		prefix:          prefix,
+	}, nil
+}
+
+// Load downloads the checkpoint blob for the specified table
+func (s *AzureBlobCheckpointStore) Load(ctx context.Context, tableName string) (*Checkpoint, error) {
+	checkpoint, _, err := s.load(ctx, s.blobName(tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint for %s: %w", tableName, err)
+	}
+	return checkpoint, nil
+}
+
+// load returns the checkpoint stored in a blob and its ETag; the checkpoint is nil when the blob does not exist
+func (s *AzureBlobCheckpointStore) load(ctx context.Context, blobName string) (*Checkpoint, *azcore.ETag, error) {
+	resp, err := s.containerClient.NewBlobClient(blobName).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	checkpoint, err := utils.UnmarshalJSON[Checkpoint](data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &checkpoint, resp.ETag, nil
+}
+
+// Save uploads the checkpoint, conditional on the ETag read just before. It returns
+// ErrCheckpointRegression when the stored checkpoint is already ahead of the one being saved.
+// A rewind saves with a higher generation and is allowed to move the LSN back.
+func (s *AzureBlobCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	data, err := utils.MarshalJSON(checkpoint)
+	if err != nil {
+		return err
+	}
+	blobName := s.blobName(checkpoint.TableName)
+
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		current, etag, err := s.load(ctx, blobName)
+		if err != nil {
+			return fmt.Errorf("failed to load checkpoint for %s: %w", checkpoint.TableName, err)
+		}
+
+		conditions := &blob.ModifiedAccessConditions{}
+		if current == nil {
+			conditions.IfNoneMatch = to.Ptr(azcore.ETagAny)
+		} else if isFenced(*current, checkpoint) {
+			return fmt.Errorf("%w: table %s is fenced with token %d, refusing token %d", ErrStaleFencingToken,
+				checkpoint.TableName, current.FencingToken, checkpoint.FencingToken)
+		} else if isRegression(*current, checkpoint) {
+			return fmt.Errorf("%w: table %s is at %s, refusing %s", ErrCheckpointRegression,
+				checkpoint.TableName, current.Position(), checkpoint.Position())
+		} else {
+			conditions.IfMatch = etag
+		}
+
+		_, err = s.containerClient.NewBlockBlobClient(blobName).Upload(ctx, streaming.NopCloser(bytes.NewReader(data)), &blockblob.UploadOptions{
+			AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: conditions},
+		})
+		if err == nil {
+			return nil
+		}
+		if !bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists) {
+			return fmt.Errorf("failed to save checkpoint for %s: %w", checkpoint.TableName, err)
+		}
+		// Another writer got in first; re-read and try again
+	}
+	return fmt.Errorf("failed to save checkpoint for %s: too many concurrent updates", checkpoint.TableName)
+}
+
+// List downloads all checkpoint blobs under the prefix
+func (s *AzureBlobCheckpointStore) List(ctx context.Context) ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	pager := s.containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &s.prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			checkpoint, _, err := s.load(ctx, *item.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load checkpoint %s: %w", *item.Name, err)
+			}
+			if checkpoint != nil {
+				checkpoints = append(checkpoints, *checkpoint)
+			}
+		}
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].TableName < checkpoints[j].TableName })
+	return checkpoints, nil
+}
+
+// Delete removes the checkpoint blob for the specified table
+func (s *AzureBlobCheckpointStore) Delete(ctx context.Context, tableName string) error {
+	_, err := s.containerClient.NewBlobClient(s.blobName(tableName)).Delete(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("failed to delete checkpoint for %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// blobName returns the blob name for a table's checkpoint
+func (s *AzureBlobCheckpointStore) blobName(tableName string) string {
+	return strings.TrimSuffix(s.prefix, "/") + "/" + url.PathEscape(tableName) + ".json"
+}
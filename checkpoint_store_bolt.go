@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/katasec/dstream/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// checkpointBucket is the bbolt bucket holding checkpoints keyed by table name
+var checkpointBucket = []byte("checkpoints")
+
+// BoltCheckpointStore stores checkpoints in an embedded bbolt key-value database
+type BoltCheckpointStore struct {
+	db *bolt.DB
+}
+
+// NewBoltCheckpointStore opens (or creates) the bbolt database at path
+func NewBoltCheckpointStore(path string) (*BoltCheckpointStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("a path is required for the bolt checkpoint store")
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(checkpointBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create checkpoint bucket: %w", err)
+	}
+
+	return &BoltCheckpointStore{db: db}, nil
+}
+
+// Load retrieves the checkpoint for the specified table
+func (s *BoltCheckpointStore) Load(ctx context.Context, tableName string) (*Checkpoint, error) {
+	var checkpoint *Checkpoint
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(checkpointBucket).Get([]byte(tableName))
+		if data == nil {
+			return nil
+		}
+		c, err := utils.UnmarshalJSON[Checkpoint](data)
+		if err != nil {
+			return err
+		}
+		checkpoint = &c
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint for %s: %w", tableName, err)
+	}
+	return checkpoint, nil
+}
+
+// Save stores the checkpoint for its table
+func (s *BoltCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	data, err := utils.MarshalJSON(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointBucket).Put([]byte(checkpoint.TableName), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint for %s: %w", checkpoint.TableName, err)
+	}
+	return nil
+}
+
+// List returns the checkpoints of all tables in key order
+func (s *BoltCheckpointStore) List(ctx context.Context) ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointBucket).ForEach(func(_, data []byte) error {
+			checkpoint, err := utils.UnmarshalJSON[Checkpoint](data)
+			if err != nil {
+				return err
+			}
+			checkpoints = append(checkpoints, checkpoint)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	return checkpoints, nil
+}
+
+// Delete removes the checkpoint for the specified table
+func (s *BoltCheckpointStore) Delete(ctx context.Context, tableName string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointBucket).Delete([]byte(tableName))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete checkpoint for %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// Close closes the underlying database
+func (s *BoltCheckpointStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/katasec/dstream/utils"
+)
+
+// checkpointFileExt is the extension of checkpoint files written by FileCheckpointStore
+const checkpointFileExt = ".checkpoint.json"
+
+// FileCheckpointStore stores each table's checkpoint as a JSON file in a local directory.
+// Files are replaced atomically: the new content is written to a temporary file, synced and renamed.
+type FileCheckpointStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// NewFileCheckpointStore initializes a new FileCheckpointStore and creates the directory if it does not exist
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("a path is required for the file checkpoint store")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory %s: %w", dir, err)
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+// Load reads the checkpoint file for the specified table
+func (s *FileCheckpointStore) Load(ctx context.Context, tableName string) (*Checkpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(s.path(tableName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint for %s: %w", tableName, err)
+	}
+
+	checkpoint, err := utils.UnmarshalJSON[Checkpoint](data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint for %s: %w", tableName, err)
+	}
+	return &checkpoint, nil
+}
+
+// Save atomically replaces the checkpoint file for its table
+func (s *FileCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := utils.MarshalJSON(checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(checkpoint.TableName), data); err != nil {
+		return fmt.Errorf("failed to save checkpoint for %s: %w", checkpoint.TableName, err)
+	}
+	return nil
+}
+
+// List reads all checkpoint files in the directory
+func (s *FileCheckpointStore) List(ctx context.Context) ([]Checkpoint, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	var checkpoints []Checkpoint
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), checkpointFileExt) {
+			continue
+		}
+		tableName, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), checkpointFileExt))
+		if err != nil {
+			continue
+		}
+		checkpoint, err := s.Load(ctx, tableName)
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint != nil {
+			checkpoints = append(checkpoints, *checkpoint)
+		}
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].TableName < checkpoints[j].TableName })
+	return checkpoints, nil
+}
+
+// Delete removes the checkpoint file for the specified table
+func (s *FileCheckpointStore) Delete(ctx context.Context, tableName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(s.path(tableName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete checkpoint for %s: %w", tableName, err)
+	}
+	return syncDir(s.dir)
+}
+
+// path returns the checkpoint file path for a table
+func (s *FileCheckpointStore) path(tableName string) string {
+	return filepath.Join(s.dir, url.PathEscape(tableName)+checkpointFileExt)
+}
+
+// writeFileAtomic writes data to a temporary file, fsyncs it and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that renames and removals in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/katasec/dstream/utils"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Defaults for the JetStream checkpoint bucket
+const (
+	defaultCheckpointBucket  = "dstream_checkpoints"
+	defaultCheckpointHistory = 10
+	maxCASAttempts           = 10
+)
+
+// validKVKey matches keys that can be used as-is in a JetStream KV bucket
+var validKVKey = regexp.MustCompile(`^[-/_=.a-zA-Z0-9]+$`)
+
+// ErrCheckpointRegression is returned when a save would move a table's checkpoint backwards
+var ErrCheckpointRegression = errors.New("checkpoint is behind the stored checkpoint")
+
+// JetStreamCheckpointStore stores checkpoints in a JetStream key-value bucket. Writes use the
+// entry revision for compare-and-set, so concurrent instances cannot regress each other's offsets.
+type JetStreamCheckpointStore struct {
+	kv jetstream.KeyValue
+}
+
+// NewJetStreamCheckpointStore creates or opens the checkpoint bucket
+func NewJetStreamCheckpointStore(ctx context.Context, nc *nats.Conn, bucket string, history int) (*JetStreamCheckpointStore, error) {
+	if bucket == "" {
+		bucket = defaultCheckpointBucket
+	}
+	if history <= 0 {
+		history = defaultCheckpointHistory
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "dstream checkpoints",
+		History:     uint8(min(history, jetstream.KeyValueMaxHistory)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint bucket %s: %w", bucket, err)
+	}
+
+	return &JetStreamCheckpointStore{kv: kv}, nil
+}
+
+// Load retrieves the latest checkpoint for the specified table
+func (s *JetStreamCheckpointStore) Load(ctx context.Context, tableName string) (*Checkpoint, error) {
+	checkpoint, _, err := s.load(ctx, tableName)
+	return checkpoint, err
+}
+
+// load returns the checkpoint and the revision it was read at; revision is 0 when there is none
+func (s *JetStreamCheckpointStore) load(ctx context.Context, tableName string) (*Checkpoint, uint64, error) {
+	entry, err := s.kv.Get(ctx, checkpointKey(tableName))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("failed to load checkpoint for %s: %w", tableName, err)
+	}
+
+	checkpoint, err := utils.UnmarshalJSON[Checkpoint](entry.Value())
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse checkpoint for %s: %w", tableName, err)
+	}
+	return &checkpoint, entry.Revision(), nil
+}
+
+// Save stores the checkpoint with compare-and-set. It returns ErrCheckpointRegression when the
+// stored checkpoint is already ahead of the one being saved.
+// A rewind saves with a higher generation and is allowed to move the LSN back.
+func (s *JetStreamCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	data, err := utils.MarshalJSON(checkpoint)
+	if err != nil {
+		return err
+	}
+	key := checkpointKey(checkpoint.TableName)
+
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		current, revision, err := s.load(ctx, checkpoint.TableName)
+		if err != nil {
+			return err
+		}
+
+		if current == nil {
+			_, err = s.kv.Create(ctx, key, data)
+		} else if isFenced(*current, checkpoint) {
+			return fmt.Errorf("%w: table %s is fenced with token %d, refusing token %d", ErrStaleFencingToken,
+				checkpoint.TableName, current.FencingToken, checkpoint.FencingToken)
+		} else if isRegression(*current, checkpoint) {
+			return fmt.Errorf("%w: table %s is at %s, refusing %s", ErrCheckpointRegression,
+				checkpoint.TableName, current.Position(), checkpoint.Position())
+		} else {
+			_, err = s.kv.Update(ctx, key, data, revision)
+		}
+
+		if err == nil {
+			return nil
+		}
+		if !isRevisionConflict(err) {
+			return fmt.Errorf("failed to save checkpoint for %s: %w", checkpoint.TableName, err)
+		}
+		// Another writer got in first; re-read and try again
+	}
+	return fmt.Errorf("failed to save checkpoint for %s: too many concurrent updates", checkpoint.TableName)
+}
+
+// List returns the latest checkpoints of all tables
+func (s *JetStreamCheckpointStore) List(ctx context.Context) ([]Checkpoint, error) {
+	keys, err := s.kv.Keys(ctx)
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	var checkpoints []Checkpoint
+	for _, key := range keys {
+		entry, err := s.kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to load checkpoint %s: %w", key, err)
+		}
+		checkpoint, err := utils.UnmarshalJSON[Checkpoint](entry.Value())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint %s: %w", key, err)
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].TableName < checkpoints[j].TableName })
+	return checkpoints, nil
+}
+
+// Delete places a delete marker for the table; earlier revisions remain in the bucket history
+func (s *JetStreamCheckpointStore) Delete(ctx context.Context, tableName string) error {
+	if err := s.kv.Delete(ctx, checkpointKey(tableName)); err != nil {
+		return fmt.Errorf("failed to delete checkpoint for %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// checkpointKey maps a table name to a valid KV key, hex encoding names with unsupported characters
+func checkpointKey(tableName string) string {
+	if validKVKey.MatchString(tableName) && !strings.HasPrefix(tableName, ".") && !strings.HasSuffix(tableName, ".") {
+		return tableName
+	}
+	return "hex_" + hex.EncodeToString([]byte(tableName))
+}
+
+// isRevisionConflict reports whether a KV write failed because the key changed since it was read
+func isRevisionConflict(err error) bool {
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return true
+	}
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/katasec/dstream/utils"
+)
+
+// checkpointSelectColumns is the column list read by scanCheckpoint
+const checkpointSelectColumns = "table_name, last_lsn, last_seqval, last_operation, generation, instance_id, event_count, fencing_token, snapshot_state, history, updated_at"
+
+// Default checkpoint table name and schema
+const (
+	defaultCheckpointTableName = "cdc_offsets"
+	defaultCheckpointSchema    = "dbo"
+)
+
+// SQLServerCheckpointStore stores checkpoints in a SQL Server table, one row per source table
+type SQLServerCheckpointStore struct {
+	dbConn          *sql.DB
+	checkpointTable string // Quoted [schema].[table] name
+}
+
+// NewSQLServerCheckpointStore initializes a new SQLServerCheckpointStore and creates the checkpoint table if it does not exist
+func NewSQLServerCheckpointStore(ctx context.Context, dbConn *sql.DB, schema string, tableName string) (*SQLServerCheckpointStore, error) {
+	// Use provided checkpoint table name and schema if supplied; otherwise, use defaults
+	if schema == "" {
+		schema = defaultCheckpointSchema
+	}
+	if tableName == "" {
+		tableName = defaultCheckpointTableName
+	}
+
+	store := &SQLServerCheckpointStore{
+		dbConn:          dbConn,
+		checkpointTable: quoteIdentifier(schema) + "." + quoteIdentifier(tableName),
+	}
+	if err := store.initializeCheckpointTable(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// checkpointColumns are the columns added to the checkpoint table after its first version
+var checkpointColumns = []struct{ name, definition string }{
+	{"snapshot_state", "NVARCHAR(MAX)"},
+	{"last_seqval", "VARBINARY(10)"},
+	{"last_operation", "INT NOT NULL DEFAULT 0"},
+	{"generation", "BIGINT NOT NULL DEFAULT 0"},
+	{"instance_id", "NVARCHAR(255)"},
+	{"event_count", "BIGINT NOT NULL DEFAULT 0"},
+	{"history", "NVARCHAR(MAX)"},
+	{"fencing_token", "BIGINT NOT NULL DEFAULT 0"},
+}
+
+// initializeCheckpointTable creates the checkpoint table if needed and adds columns missing from older versions
+func (s *SQLServerCheckpointStore) initializeCheckpointTable(ctx context.Context) error {
+	query := fmt.Sprintf(`
+    IF OBJECT_ID(N'%[1]s', N'U') IS NULL
+    BEGIN
+        CREATE TABLE %[1]s (
+            table_name NVARCHAR(255) PRIMARY KEY,
+            last_lsn VARBINARY(10),
+            updated_at DATETIME DEFAULT GETDATE()
+        );
+    END`, s.checkpointTable)
+	for _, column := range checkpointColumns {
+		query += fmt.Sprintf(`
+    IF COL_LENGTH(N'%[1]s', '%[2]s') IS NULL
+    BEGIN
+        ALTER TABLE %[1]s ADD %[2]s %[3]s;
+    END`, s.checkpointTable, column.name, column.definition)
+	}
+
+	if _, err := s.dbConn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to initialize %s table: %w", s.checkpointTable, err)
+	}
+
+	log.Printf("Initialized checkpoint table %s.", s.checkpointTable)
+	return nil
+}
+
+// Load retrieves the checkpoint for the specified table
+func (s *SQLServerCheckpointStore) Load(ctx context.Context, tableName string) (*Checkpoint, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE table_name = @tableName", checkpointSelectColumns, s.checkpointTable)
+	checkpoint, err := scanCheckpoint(s.dbConn.QueryRowContext(ctx, query, sql.Named("tableName", tableName)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint for %s: %w", tableName, err)
+	}
+	return checkpoint, nil
+}
+
+// Save inserts or updates the checkpoint for its table. The update only applies when the stored
+// fencing token is not newer than the checkpoint's, so a fenced instance cannot overwrite it.
+func (s *SQLServerCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	var snapshotState, history sql.NullString
+	if checkpoint.Snapshot != nil {
+		state, err := utils.MarshalJSON(checkpoint.Snapshot)
+		if err != nil {
+			return err
+		}
+		snapshotState = sql.NullString{String: string(state), Valid: true}
+	}
+	if len(checkpoint.History) > 0 {
+		records, err := utils.MarshalJSON(checkpoint.History)
+		if err != nil {
+			return err
+		}
+		history = sql.NullString{String: string(records), Valid: true}
+	}
+
+	upsertQuery := fmt.Sprintf(`
+    MERGE INTO %s AS target
+    USING (VALUES (@tableName, @lastLSN, @lastSeqVal, @lastOperation, @generation, @instanceID, @eventCount, @fencingToken, @snapshotState, @history, GETDATE()))
+        AS source (table_name, last_lsn, last_seqval, last_operation, generation, instance_id, event_count, fencing_token, snapshot_state, history, updated_at)
+    ON target.table_name = source.table_name
+    WHEN MATCHED AND target.fencing_token <= source.fencing_token THEN
+        UPDATE SET last_lsn = source.last_lsn, last_seqval = source.last_seqval, last_operation = source.last_operation,
+            generation = source.generation, instance_id = source.instance_id, event_count = source.event_count,
+            fencing_token = source.fencing_token, snapshot_state = source.snapshot_state, history = source.history, updated_at = source.updated_at
+    WHEN NOT MATCHED THEN
+        INSERT (table_name, last_lsn, last_seqval, last_operation, generation, instance_id, event_count, fencing_token, snapshot_state, history, updated_at)
+        VALUES (source.table_name, source.last_lsn, source.last_seqval, source.last_operation, source.generation,
+            source.instance_id, source.event_count, source.fencing_token, source.snapshot_state, source.history, source.updated_at);`, s.checkpointTable)
+
+	result, err := s.dbConn.ExecContext(ctx, upsertQuery,
+		sql.Named("tableName", checkpoint.TableName),
+		sql.Named("lastLSN", checkpoint.LastLSN),
+		sql.Named("lastSeqVal", checkpoint.LastSeqVal),
+		sql.Named("lastOperation", checkpoint.LastOperation),
+		sql.Named("generation", checkpoint.Generation),
+		sql.Named("instanceID", checkpoint.InstanceID),
+		sql.Named("eventCount", checkpoint.EventCount),
+		sql.Named("fencingToken", checkpoint.FencingToken),
+		sql.Named("snapshotState", snapshotState),
+		sql.Named("history", history))
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint for %s: %w", checkpoint.TableName, err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: table %s, token %d", ErrStaleFencingToken, checkpoint.TableName, checkpoint.FencingToken)
+	}
+	return nil
+}
+
+// List returns the checkpoints of all tables
+func (s *SQLServerCheckpointStore) List(ctx context.Context) ([]Checkpoint, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY table_name", checkpointSelectColumns, s.checkpointTable)
+	rows, err := s.dbConn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		checkpoint, err := scanCheckpoint(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan checkpoint: %w", err)
+		}
+		checkpoints = append(checkpoints, *checkpoint)
+	}
+	return checkpoints, rows.Err()
+}
+
+// Delete removes the checkpoint for the specified table
+func (s *SQLServerCheckpointStore) Delete(ctx context.Context, tableName string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE table_name = @tableName", s.checkpointTable)
+	if _, err := s.dbConn.ExecContext(ctx, query, sql.Named("tableName", tableName)); err != nil {
+		return fmt.Errorf("failed to delete checkpoint for %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanCheckpoint reads a checkpoint row selected with checkpointSelectColumns
+func scanCheckpoint(row rowScanner) (*Checkpoint, error) {
+	var checkpoint Checkpoint
+	var instanceID, snapshotState, history sql.NullString
+	var updatedAt sql.NullTime
+	if err := row.Scan(&checkpoint.TableName, &checkpoint.LastLSN, &checkpoint.LastSeqVal, &checkpoint.LastOperation, &checkpoint.Generation, &instanceID,
+		&checkpoint.EventCount, &checkpoint.FencingToken, &snapshotState, &history, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	checkpoint.InstanceID = instanceID.String
+	checkpoint.UpdatedAt = updatedAt.Time.UTC()
+	if snapshotState.Valid {
+		progress, err := utils.UnmarshalJSON[SnapshotProgress]([]byte(snapshotState.String))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot state for %s: %w", checkpoint.TableName, err)
+		}
+		checkpoint.Snapshot = &progress
+	}
+	if history.Valid {
+		records, err := utils.UnmarshalJSON[[]CheckpointRecord]([]byte(history.String))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint history for %s: %w", checkpoint.TableName, err)
+		}
+		checkpoint.History = records
+	}
+	return &checkpoint, nil
+}
+
+// quoteIdentifier bracket quotes a SQL Server identifier
+func quoteIdentifier(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// quoteTableName bracket quotes a table name given as "schema.table" or "table", defaulting the schema to dbo
+func quoteTableName(tableName string) string {
+	schema, table := splitTableName(tableName)
+	return quoteIdentifier(schema) + "." + quoteIdentifier(table)
+}
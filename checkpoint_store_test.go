@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// testCheckpointStore exercises the CheckpointStore contract against a store implementation
+func testCheckpointStore(t *testing.T, store CheckpointStore) {
+	t.Helper()
+
+	checkpoint, err := store.Load(context.TODO(), "Cars")
+	if err != nil || checkpoint != nil {
+		t.Fatalf("expected no checkpoint for a new table, got %+v (err=%v)", checkpoint, err)
+	}
+
+	lsn := []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 3}
+	progress := &SnapshotProgress{Status: SnapshotStatusRunning, LastKey: []SnapshotKey{{Type: "int", Value: "42"}}}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: lsn, LastSeqVal: []byte{0, 7}, LastOperation: 3, Snapshot: progress}); err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "dbo.Persons", LastLSN: []byte{1}}); err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+
+	checkpoint, err = store.Load(context.TODO(), "Cars")
+	if err != nil || checkpoint == nil {
+		t.Fatalf("expected a checkpoint, got %+v (err=%v)", checkpoint, err)
+	}
+	if !bytes.Equal(checkpoint.LastLSN, lsn) || !bytes.Equal(checkpoint.LastSeqVal, []byte{0, 7}) || checkpoint.LastOperation != 3 ||
+		checkpoint.Snapshot == nil || checkpoint.Snapshot.LastKey[0] != (SnapshotKey{Type: "int", Value: "42"}) {
+		t.Fatalf("unexpected checkpoint: %+v", checkpoint)
+	}
+
+	checkpoints, err := store.List(context.TODO())
+	if err != nil || len(checkpoints) != 2 {
+		t.Fatalf("expected 2 checkpoints, got %d (err=%v)", len(checkpoints), err)
+	}
+
+	if err := store.Delete(context.TODO(), "Cars"); err != nil {
+		t.Fatalf("failed to delete checkpoint: %v", err)
+	}
+	if checkpoint, _ := store.Load(context.TODO(), "Cars"); checkpoint != nil {
+		t.Fatalf("expected checkpoint to be deleted, got %+v", checkpoint)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	store, err := NewFileCheckpointStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCheckpointStore(t, store)
+}
+
+func TestBoltCheckpointStore(t *testing.T) {
+	store, err := NewBoltCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testCheckpointStore(t, store)
+}
+
+// newTestJetStreamCheckpointStore starts a JetStream enabled NATS server and opens a checkpoint bucket on it
+func newTestJetStreamCheckpointStore(t *testing.T) *JetStreamCheckpointStore {
+	t.Helper()
+
+	opts := test.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	natsServer := test.RunServer(&opts)
+	t.Cleanup(natsServer.Shutdown)
+
+	nc, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	store, err := NewJetStreamCheckpointStore(context.TODO(), nc, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestJetStreamCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, newTestJetStreamCheckpointStore(t))
+}
+
+func TestJetStreamCheckpointStoreRejectsRegression(t *testing.T) {
+	store := newTestJetStreamCheckpointStore(t)
+
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 1}}); !errors.Is(err, ErrCheckpointRegression) {
+		t.Fatalf("expected ErrCheckpointRegression, got %v", err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 3}, LastSeqVal: []byte{5}}); err != nil {
+		t.Fatalf("expected forward save to succeed, got %v", err)
+	}
+	// A completed transaction is ahead of any of its rows
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 3}}); err != nil {
+		t.Fatalf("expected completing the transaction to succeed, got %v", err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 3}, LastSeqVal: []byte{6}}); !errors.Is(err, ErrCheckpointRegression) {
+		t.Fatalf("expected ErrCheckpointRegression for a row of a completed transaction, got %v", err)
+	}
+}
+
+func TestJetStreamCheckpointStoreAcceptsRewind(t *testing.T) {
+	store := newTestJetStreamCheckpointStore(t)
+
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 1}, Generation: 1}); err != nil {
+		t.Fatalf("expected rewind with a higher generation to succeed, got %v", err)
+	}
+	// A writer still on the old generation must not undo the rewind
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 3}}); !errors.Is(err, ErrCheckpointRegression) {
+		t.Fatalf("expected ErrCheckpointRegression for a stale generation, got %v", err)
+	}
+}
+
+func TestJetStreamCheckpointStoreRejectsStaleToken(t *testing.T) {
+	store := newTestJetStreamCheckpointStore(t)
+
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 2}, FencingToken: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 3}, FencingToken: 1}); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected ErrStaleFencingToken, got %v", err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 3}, FencingToken: 2}); err != nil {
+		t.Fatalf("expected a save with the current token to succeed, got %v", err)
+	}
+}
+
+func TestCheckpointKey(t *testing.T) {
+	if key := checkpointKey("dbo.Cars"); key != "dbo.Cars" {
+		t.Errorf("expected dbo.Cars to be used as-is, got %s", key)
+	}
+	if key := checkpointKey("Order Lines"); key != "hex_4f72646572204c696e6573" {
+		t.Errorf("expected hex encoded key, got %s", key)
+	}
+}
+
+// newTestAzureBlobCheckpointStore creates a store in a fresh container on the emulator configured by
+// DSTREAM_AZURITE_CONNECTION_STRING, skipping the test when it is not set
+func newTestAzureBlobCheckpointStore(t *testing.T) *AzureBlobCheckpointStore {
+	t.Helper()
+
+	connString := os.Getenv("DSTREAM_AZURITE_CONNECTION_STRING")
+	if connString == "" {
+		t.Skip("DSTREAM_AZURITE_CONNECTION_STRING is not set")
+	}
+
+	store, err := NewAzureBlobCheckpointStore(context.TODO(), connString, fmt.Sprintf("dstream-test-%d", time.Now().UnixNano()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.containerClient.Delete(context.TODO(), nil) })
+	return store
+}
+
+func TestAzureBlobCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, newTestAzureBlobCheckpointStore(t))
+}
+
+func TestAzureBlobCheckpointStoreRejectsRegression(t *testing.T) {
+	store := newTestAzureBlobCheckpointStore(t)
+
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(context.TODO(), Checkpoint{TableName: "Cars", LastLSN: []byte{0, 1}}); !errors.Is(err, ErrCheckpointRegression) {
+		t.Fatalf("expected ErrCheckpointRegression, got %v", err)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/katasec/dstream/topics"
@@ -12,31 +14,170 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+// checkpointQueue is the queue group all checkpoint workers subscribe in
+const checkpointQueue = "checkpoint-workers"
+
+// checkpointRequestTimeout bounds the store calls made for a checkpoint request
+const checkpointRequestTimeout = 10 * time.Second
+
+// checkpointWorkerLock is held by the checkpoint worker serving requests on a bus shared by several processes
+const checkpointWorkerLock = "checkpoint-worker"
+
+// CheckpointWorker serves the checkpoint request/reply topics from a CheckpointStore
 type CheckpointWorker struct {
-	dbConn *sql.DB
-	nc     *nats.Conn
+	store       CheckpointStore
+	nc          *nats.Conn
+	historySize int         // Checkpoint updates kept per table
+	policy      FlushPolicy // When buffered LSN saves are written to the store
+
+	mutex     sync.Mutex                    // Serializes checkpoint updates and guards pending and metrics
+	pending   map[string]*pendingSave       // LSN saves not yet written to the store
+	metrics   map[string]*CheckpointMetrics // Commit metrics per table
+	subsMutex sync.Mutex                    // Guards subs against a concurrent Stop
+	subs      []*nats.Subscription          // Subscriptions to the checkpoint topics, while serving requests
+	stop      chan struct{}
+	stopOnce  sync.Once
+	elected   chan struct{} // Closed once an elected worker released its lock; nil unless started elected
 }
 
-// NewCheckpointWorker initializes a new CheckpointWorker with a database and NATS connection.
-func NewCheckpointWorker(dbConn *sql.DB, nc *nats.Conn) *CheckpointWorker {
+// NewCheckpointWorker initializes a new CheckpointWorker with a checkpoint store and NATS connection.
+// Each table keeps the last historySize checkpoint updates as an audit trail, and LSN saves are
+// coalesced per table according to the flush policy.
+func NewCheckpointWorker(store CheckpointStore, nc *nats.Conn, historySize int, policy FlushPolicy) *CheckpointWorker {
 	return &CheckpointWorker{
-		dbConn: dbConn,
-		nc:     nc,
+		store:       store,
+		nc:          nc,
+		historySize: historySize,
+		policy:      policy,
+		pending:     make(map[string]*pendingSave),
+		metrics:     make(map[string]*CheckpointMetrics),
+		stop:        make(chan struct{}),
 	}
 }
 
-// Start Statrs the CheckpointWorker servers that subscribe to events and registers handlers for its events
-func (cw *CheckpointWorker) Start() {
-	go func() {
-		// Subscribe to topics
-		utils.Subscribe("CheckpointWorker", cw.nc, topics.Checkpoints.Load, cw.loadLastLsnHandler)
-		utils.Subscribe("CheckpointWorker", cw.nc, topics.Checkpoints.Save, cw.saveLastLsnHandler)
+// Start subscribes the CheckpointWorker to the checkpoint topics and starts its flush timer. The worker
+// must be the only one on its bus; use StartElected when several processes share it.
+func (cw *CheckpointWorker) Start() error {
+	if err := cw.subscribe(); err != nil {
+		return err
+	}
+	log.Println("CheckpointWorker is now listening for requests...")
 
-		log.Println("CheckpointWorker is now listening for requests...")
-		select {} // Keep the worker running
+	go cw.runFlushTimer()
+	return nil
+}
+
+// StartElected starts the flush timer and serves the checkpoint topics only while this worker holds the
+// checkpoint worker lock. Each table's requests then reach a single worker, and so a single buffer, even
+// when several checkpoint processes share a bus; the others stand by to take over.
+func (cw *CheckpointWorker) StartElected(provider LockProvider) {
+	cw.elected = make(chan struct{})
+	go cw.runFlushTimer()
+	go cw.runElected(provider)
+}
+
+// runElected serves requests whenever this worker holds the checkpoint worker lock, until it is stopped
+func (cw *CheckpointWorker) runElected(provider LockProvider) {
+	defer close(cw.elected)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cw.stop:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 
-	time.Sleep(time.Second)
+	for {
+		keeper := NewLockKeeper(provider, checkpointWorkerLock)
+		if keeper.Acquire(ctx) != nil {
+			return
+		}
+		if err := cw.subscribe(); err != nil {
+			log.Printf("[CheckpointWorker] Failed to subscribe as the active checkpoint worker: %v", err)
+			keeper.Release()
+			if sleep(ctx, provider.LeaseDuration()/3) != nil {
+				return
+			}
+			continue
+		}
+		log.Println("CheckpointWorker is now listening for requests as the active worker...")
+
+		select {
+		case <-cw.stop:
+			// Stop unsubscribed; the buffered saves are written before a standby worker takes over
+			flushCtx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+			cw.Flush(flushCtx)
+			cancel()
+			keeper.Release()
+			return
+		case <-keeper.Lost():
+			log.Println("[CheckpointWorker] Lost the checkpoint worker lock; standing by")
+			cw.standDown()
+		}
+	}
+}
+
+// subscribe subscribes to the checkpoint topics, unless the worker was stopped
+func (cw *CheckpointWorker) subscribe() error {
+	cw.subsMutex.Lock()
+	defer cw.subsMutex.Unlock()
+
+	select {
+	case <-cw.stop:
+		return errors.New("checkpoint worker is stopped")
+	default:
+	}
+	subs, err := utils.SubscribeAll("CheckpointWorker", cw.nc, checkpointQueue, map[string]nats.MsgHandler{
+		topics.Checkpoints.Load:         cw.loadLastLsnHandler,
+		topics.Checkpoints.Save:         cw.saveLastLsnHandler,
+		topics.Checkpoints.LoadSnapshot: cw.loadSnapshotHandler,
+		topics.Checkpoints.SaveSnapshot: cw.saveSnapshotHandler,
+		topics.Checkpoints.List:         cw.listHandler,
+		topics.Checkpoints.Delete:       cw.deleteHandler,
+		topics.Checkpoints.History:      cw.historyHandler,
+		topics.Checkpoints.Rewind:       cw.rewindHandler,
+		topics.Checkpoints.Metrics:      cw.metricsHandler,
+		topics.Checkpoints.Fence:        cw.fenceHandler,
+		topics.Checkpoints.Flush:        cw.flushHandler,
+		topics.Checkpoints.Validate:     cw.validateHandler,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Make sure the server registered the subscriptions before requests are sent
+	if err := cw.nc.Flush(); err != nil {
+		utils.Unsubscribe(subs)
+		return err
+	}
+	cw.subs = subs
+	return nil
+}
+
+// unsubscribe stops taking requests
+func (cw *CheckpointWorker) unsubscribe() {
+	cw.subsMutex.Lock()
+	defer cw.subsMutex.Unlock()
+	utils.Unsubscribe(cw.subs)
+	cw.subs = nil
+}
+
+// standDown stops taking requests after the checkpoint worker lock was lost. Buffered saves are dropped
+// rather than written, since the worker that took over may have moved the checkpoints on already; the
+// tables resume from their last written checkpoint. What the worker knew about the stored checkpoints
+// is forgotten for the same reason.
+func (cw *CheckpointWorker) standDown() {
+	cw.unsubscribe()
+
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.pending = make(map[string]*pendingSave)
+	for _, metrics := range cw.metrics {
+		metrics.committed = nil
+		metrics.tokenLoaded = false
+	}
 }
 
 // loadLastLsnHandler A handler for topics.Checkpoints.Load event
@@ -45,12 +186,16 @@ func (cw *CheckpointWorker) loadLastLsnHandler(msg *nats.Msg) {
 
 	// Use UnmarshalJSON
 	req, err := utils.UnmarshalJSON[LoadLastLSNRequest](msg.Data)
+	var resp LoadLastLSNResponse
 	if err != nil {
-		log.Fatalf("[CheckpointWorker] Failed to parse LoadLastLSN request: %v", err)
+		log.Printf("[CheckpointWorker] Failed to parse LoadLastLSN request: %v", err)
+		resp.Error = err.Error()
+	} else {
+		// Process the load request
+		ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+		defer cancel()
+		resp = cw.loadLastLSN(ctx, req)
 	}
-
-	// Process the load request
-	resp := cw.getLastLSNFromDb(req)
 	respData, _ := json.Marshal(resp)
 
 	// Respond back to the requester
@@ -74,7 +219,9 @@ func (cw *CheckpointWorker) saveLastLsnHandler(msg *nats.Msg) {
 	}
 
 	// Process the save request
-	resp := cw.saveLastLSNToDb(req)
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+	resp := cw.saveLastLSN(ctx, req)
 	respData, _ := json.Marshal(resp)
 
 	// Respond back to the requester
@@ -87,44 +234,393 @@ func (cw *CheckpointWorker) saveLastLsnHandler(msg *nats.Msg) {
 	log.Printf("[CheckpointWorker] Processed SaveLastLSN request for table '%s'. Response: %s", req.TableName, string(respData))
 }
 
-// getLastLSNFromDb retrieves the last LSN for a given table from the cdc_offsets table.
-func (cw *CheckpointWorker) getLastLSNFromDb(req LoadLastLSNRequest) LoadLastLSNResponse {
-	query := `SELECT last_lsn FROM cdc_offsets WHERE table_name = @tableName`
-	var lastLSN []byte
-	err := cw.dbConn.QueryRow(query, sql.Named("tableName", req.TableName)).Scan(&lastLSN)
-	if err == sql.ErrNoRows {
-		// Return default LSN if no entry exists
+// loadSnapshotHandler A handler for topics.Checkpoints.LoadSnapshot event
+func (cw *CheckpointWorker) loadSnapshotHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[LoadSnapshotRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse LoadSnapshot request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+	resp := cw.loadSnapshot(ctx, req)
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send LoadSnapshot response: %v", err)
+	}
+}
+
+// saveSnapshotHandler A handler for topics.Checkpoints.SaveSnapshot event
+func (cw *CheckpointWorker) saveSnapshotHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[SaveSnapshotRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse SaveSnapshot request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+	resp := cw.saveSnapshot(ctx, req)
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send SaveSnapshot response: %v", err)
+	}
+}
+
+// listHandler A handler for topics.Checkpoints.List event
+func (cw *CheckpointWorker) listHandler(msg *nats.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+
+	var resp ListCheckpointsResponse
+	checkpoints, err := cw.store.List(ctx)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Checkpoints = checkpoints
+
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send ListCheckpoints response: %v", err)
+	}
+}
+
+// deleteHandler A handler for topics.Checkpoints.Delete event
+func (cw *CheckpointWorker) deleteHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[DeleteCheckpointRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse DeleteCheckpoint request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+
+	var resp DeleteCheckpointResponse
+	cw.mutex.Lock()
+	delete(cw.pending, req.TableName)
+	cw.tableMetrics(req.TableName).committed = nil
+	if err := cw.store.Delete(ctx, req.TableName); err != nil {
+		resp.Error = err.Error()
+	}
+	cw.mutex.Unlock()
+
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send DeleteCheckpoint response: %v", err)
+	}
+	log.Printf("[CheckpointWorker] Processed DeleteCheckpoint request for table '%s'. Response: %s", req.TableName, string(respData))
+}
+
+// historyHandler A handler for topics.Checkpoints.History event
+func (cw *CheckpointWorker) historyHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[CheckpointHistoryRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse CheckpointHistory request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+
+	var resp CheckpointHistoryResponse
+	checkpoint, err := cw.store.Load(ctx, req.TableName)
+	if err != nil {
+		resp.Error = fmt.Sprintf("failed to load checkpoint history for table %s: %v", req.TableName, err)
+	} else if checkpoint != nil {
+		resp.History = checkpoint.History
+	}
+
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send CheckpointHistory response: %v", err)
+	}
+}
+
+// rewindHandler A handler for topics.Checkpoints.Rewind event
+func (cw *CheckpointWorker) rewindHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[RewindCheckpointRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse RewindCheckpoint request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+	resp := cw.rewind(ctx, req)
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send RewindCheckpoint response: %v", err)
+		return
+	}
+	log.Printf("[CheckpointWorker] Processed RewindCheckpoint request for table '%s'. Response: %s", req.TableName, string(respData))
+}
+
+// flushHandler A handler for topics.Checkpoints.Flush event
+func (cw *CheckpointWorker) flushHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[FlushCheckpointRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse FlushCheckpoint request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+
+	var resp FlushCheckpointResponse
+	if err := cw.FlushTable(ctx, req.TableName); err != nil {
+		resp.Error = fmt.Sprintf("failed to flush checkpoint for table %s: %v", req.TableName, err)
+	}
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send FlushCheckpoint response: %v", err)
+	}
+}
+
+// fenceHandler A handler for topics.Checkpoints.Fence event
+func (cw *CheckpointWorker) fenceHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[FenceCheckpointRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse FenceCheckpoint request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+	resp := cw.fence(ctx, req)
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send FenceCheckpoint response: %v", err)
+		return
+	}
+	log.Printf("[CheckpointWorker] Processed FenceCheckpoint request for table '%s'. Response: %s", req.TableName, string(respData))
+}
+
+// validateHandler A handler for topics.Checkpoints.Validate event
+func (cw *CheckpointWorker) validateHandler(msg *nats.Msg) {
+	req, err := utils.UnmarshalJSON[ValidateFencingTokenRequest](msg.Data)
+	if err != nil {
+		log.Printf("[CheckpointWorker] Failed to parse ValidateFencingToken request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointRequestTimeout)
+	defer cancel()
+	respData, _ := json.Marshal(cw.validate(ctx, req))
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[CheckpointWorker] Failed to send ValidateFencingToken response: %v", err)
+	}
+}
+
+// loadLastLSN retrieves the last LSN for a given table, falling back to the default start LSN.
+// A save that is still buffered takes precedence over the stored checkpoint.
+func (cw *CheckpointWorker) loadLastLSN(ctx context.Context, req LoadLastLSNRequest) LoadLastLSNResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	if pending, ok := cw.pending[req.TableName]; ok {
 		return LoadLastLSNResponse{
-			LastLSN: []byte("0x00000000000000000000"),
+			LastLSN:       pending.request.LastLSN,
+			LastSeqVal:    pending.request.LastSeqVal,
+			LastOperation: pending.request.LastOperation,
+			Found:         true,
 		}
 	}
+
+	checkpoint, err := cw.store.Load(ctx, req.TableName)
 	if err != nil {
 		return LoadLastLSNResponse{
 			Error: fmt.Sprintf("failed to load last LSN for table %s: %v", req.TableName, err),
 		}
 	}
+	if checkpoint == nil || checkpoint.LastLSN == nil {
+		// Return default LSN if no entry exists
+		return LoadLastLSNResponse{
+			LastLSN: defaultStartLSN,
+		}
+	}
 	return LoadLastLSNResponse{
-		LastLSN: lastLSN,
+		LastLSN:       checkpoint.LastLSN,
+		LastSeqVal:    checkpoint.LastSeqVal,
+		LastOperation: checkpoint.LastOperation,
+		Found:         true,
 	}
 }
 
-// saveLastLSNToDb updates the last LSN and timestamp for a given table in the cdc_offsets table.
-func (cw *CheckpointWorker) saveLastLSNToDb(req SaveLastLSNRequest) SaveLastLSNResponse {
-	query := `
-        MERGE cdc_offsets AS target
-        USING (SELECT @tableName AS table_name, @lastLSN AS last_lsn) AS source
-        ON target.table_name = source.table_name
-        WHEN MATCHED THEN
-            UPDATE SET target.last_lsn = source.last_lsn, target.updated_at = CURRENT_TIMESTAMP
-        WHEN NOT MATCHED THEN
-            INSERT (table_name, last_lsn, updated_at)
-            VALUES (source.table_name, source.last_lsn, CURRENT_TIMESTAMP);
-    `
-	_, err := cw.dbConn.Exec(query, sql.Named("tableName", req.TableName), sql.Named("lastLSN", req.LastLSN))
-	if err != nil {
+// saveLastLSN buffers the last LSN for a given table; it is written with the table's snapshot
+// progress kept once the flush policy triggers
+func (cw *CheckpointWorker) saveLastLSN(ctx context.Context, req SaveLastLSNRequest) SaveLastLSNResponse {
+	if err := cw.bufferSave(ctx, req); err != nil {
 		return SaveLastLSNResponse{
-			Error: fmt.Sprintf("failed to save last LSN for table %s: %v", req.TableName, err),
+			Fenced: errors.Is(err, ErrStaleFencingToken),
+			Error:  fmt.Sprintf("failed to save last LSN for table %s: %v", req.TableName, err),
 		}
 	}
 	return SaveLastLSNResponse{}
 }
+
+// validate reports whether a fencing token was replaced by a newer one. It only reads what the worker
+// knows about the table, so a monitor can check its token before every checkpoint it streams.
+func (cw *CheckpointWorker) validate(ctx context.Context, req ValidateFencingTokenRequest) ValidateFencingTokenResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	token, err := cw.fencingTokenLocked(ctx, req.TableName)
+	if err != nil {
+		return ValidateFencingTokenResponse{Error: fmt.Sprintf("failed to validate fencing token for table %s: %v", req.TableName, err)}
+	}
+	if req.FencingToken < token {
+		return ValidateFencingTokenResponse{
+			Fenced: true,
+			Error:  fmt.Sprintf("table %s is fenced with token %d, refusing token %d", req.TableName, token, req.FencingToken),
+		}
+	}
+	return ValidateFencingTokenResponse{}
+}
+
+// fence claims a table's checkpoint for a new fencing token, so that saves of an instance that
+// streamed the table under an older lock are refused from now on. Tables without a checkpoint
+// are left alone, since their first save stores the token.
+func (cw *CheckpointWorker) fence(ctx context.Context, req FenceCheckpointRequest) FenceCheckpointResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	// Saves buffered by this instance under an older lock are written first
+	if err := cw.flushLocked(ctx, req.TableName); err != nil && !errors.Is(err, ErrStaleFencingToken) {
+		return FenceCheckpointResponse{Error: fmt.Sprintf("failed to fence checkpoint for table %s: %v", req.TableName, err)}
+	}
+
+	checkpoint, err := cw.store.Load(ctx, req.TableName)
+	if err != nil {
+		return FenceCheckpointResponse{Error: fmt.Sprintf("failed to fence checkpoint for table %s: %v", req.TableName, err)}
+	}
+	if checkpoint == nil {
+		return FenceCheckpointResponse{}
+	}
+
+	err = cw.updateLocked(ctx, req.TableName, func(checkpoint *Checkpoint) {
+		checkpoint.FencingToken = req.FencingToken
+		checkpoint.InstanceID = req.InstanceID
+	})
+	if err != nil {
+		return FenceCheckpointResponse{
+			Fenced: errors.Is(err, ErrStaleFencingToken),
+			Error:  fmt.Sprintf("failed to fence checkpoint for table %s: %v", req.TableName, err),
+		}
+	}
+	return FenceCheckpointResponse{}
+}
+
+// rewind moves the last LSN of a table to the requested position. Raising the generation lets
+// stores that refuse to move a checkpoint backwards accept the rewind.
+func (cw *CheckpointWorker) rewind(ctx context.Context, req RewindCheckpointRequest) RewindCheckpointResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	// Buffered saves belong to the position being rewound from
+	delete(cw.pending, req.TableName)
+	cw.tableMetrics(req.TableName).committed = nil
+
+	var generation int64
+	err := cw.updateLocked(ctx, req.TableName, func(checkpoint *Checkpoint) {
+		checkpoint.LastLSN = req.LastLSN
+		checkpoint.LastSeqVal = nil
+		checkpoint.LastOperation = 0
+		checkpoint.Generation++
+		checkpoint.InstanceID = req.InstanceID
+		checkpoint.EventCount = 0
+		cw.record(checkpoint, true)
+		generation = checkpoint.Generation
+	})
+	if err != nil {
+		return RewindCheckpointResponse{
+			Error: fmt.Sprintf("failed to rewind checkpoint for table %s: %v", req.TableName, err),
+		}
+	}
+	return RewindCheckpointResponse{Generation: generation}
+}
+
+// loadSnapshot retrieves the snapshot progress for a given table
+func (cw *CheckpointWorker) loadSnapshot(ctx context.Context, req LoadSnapshotRequest) LoadSnapshotResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	checkpoint, err := cw.store.Load(ctx, req.TableName)
+	if err != nil {
+		return LoadSnapshotResponse{
+			Error: fmt.Sprintf("failed to load snapshot state for table %s: %v", req.TableName, err),
+		}
+	}
+	if checkpoint == nil {
+		return LoadSnapshotResponse{}
+	}
+	return LoadSnapshotResponse{Progress: checkpoint.Snapshot}
+}
+
+// saveSnapshot updates the snapshot progress for a given table, keeping its last LSN. Buffered LSN
+// saves are flushed first so that a snapshot is never recorded ahead of the LSN it hands off to.
+func (cw *CheckpointWorker) saveSnapshot(ctx context.Context, req SaveSnapshotRequest) SaveSnapshotResponse {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	err := cw.flushLocked(ctx, req.TableName)
+	if err == nil {
+		err = cw.updateLocked(ctx, req.TableName, func(checkpoint *Checkpoint) {
+			checkpoint.Snapshot = &req.Progress
+		})
+	}
+	if err != nil {
+		return SaveSnapshotResponse{
+			Error: fmt.Sprintf("failed to save snapshot state for table %s: %v", req.TableName, err),
+		}
+	}
+	return SaveSnapshotResponse{}
+}
+
+// updateLocked loads a table's checkpoint, applies a change and saves it back. The caller holds cw.mutex.
+func (cw *CheckpointWorker) updateLocked(ctx context.Context, tableName string, apply func(*Checkpoint)) error {
+	checkpoint, err := cw.store.Load(ctx, tableName)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		checkpoint = &Checkpoint{TableName: tableName}
+	}
+
+	current := *checkpoint
+	metrics := cw.tableMetrics(tableName)
+	metrics.fencingToken = max(metrics.fencingToken, current.FencingToken)
+	metrics.tokenLoaded = true
+
+	checkpoint.UpdatedAt = time.Now().UTC()
+	apply(checkpoint)
+	if isFenced(current, *checkpoint) {
+		return fmt.Errorf("%w: table %s is fenced with token %d, refusing token %d", ErrStaleFencingToken,
+			tableName, current.FencingToken, checkpoint.FencingToken)
+	}
+	if err := cw.store.Save(ctx, *checkpoint); err != nil {
+		return err
+	}
+	metrics.fencingToken = max(metrics.fencingToken, checkpoint.FencingToken)
+	return nil
+}
+
+// record appends the checkpoint's current position to its history, dropping the oldest
+// records beyond the configured history size
+func (cw *CheckpointWorker) record(checkpoint *Checkpoint, rewind bool) {
+	checkpoint.History = append(checkpoint.History, CheckpointRecord{
+		LastLSN:       checkpoint.LastLSN,
+		LastSeqVal:    checkpoint.LastSeqVal,
+		LastOperation: checkpoint.LastOperation,
+		Generation:    checkpoint.Generation,
+		InstanceID:    checkpoint.InstanceID,
+		EventCount:    checkpoint.EventCount,
+		FencingToken:  checkpoint.FencingToken,
+		Rewind:        rewind,
+		UpdatedAt:     checkpoint.UpdatedAt,
+	})
+	if excess := len(checkpoint.History) - cw.historySize; cw.historySize > 0 && excess > 0 {
+		checkpoint.History = append([]CheckpointRecord(nil), checkpoint.History[excess:]...)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katasec/dstream/topics"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// memoryCheckpointStore is an in-memory CheckpointStore for tests
+type memoryCheckpointStore struct {
+	checkpoints map[string]Checkpoint
+	mutex       sync.Mutex
+}
+
+func newMemoryCheckpointStore() *memoryCheckpointStore {
+	return &memoryCheckpointStore{checkpoints: map[string]Checkpoint{}}
+}
+
+func (s *memoryCheckpointStore) Load(ctx context.Context, tableName string) (*Checkpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	checkpoint, ok := s.checkpoints[tableName]
+	if !ok {
+		return nil, nil
+	}
+	return &checkpoint, nil
+}
+
+func (s *memoryCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkpoints[checkpoint.TableName] = checkpoint
+	return nil
+}
+
+func (s *memoryCheckpointStore) List(ctx context.Context) ([]Checkpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var checkpoints []Checkpoint
+	for _, checkpoint := range s.checkpoints {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].TableName < checkpoints[j].TableName })
+	return checkpoints, nil
+}
+
+func (s *memoryCheckpointStore) Delete(ctx context.Context, tableName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.checkpoints, tableName)
+	return nil
+}
+
+// startTestCheckpointWorker starts a NATS server and a checkpoint worker serving the given store
+func startTestCheckpointWorker(t *testing.T, store CheckpointStore) *nats.Conn {
+	t.Helper()
+
+	natsServer := test.RunRandClientPortServer()
+	t.Cleanup(natsServer.Shutdown)
+
+	nc, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	if err := NewCheckpointWorker(store, nc, 3, FlushPolicy{}).Start(); err != nil {
+		t.Fatal(err)
+	}
+	return nc
+}
+
+// request sends a request to the checkpoint worker and decodes the response
+func request[T any](t *testing.T, nc *nats.Conn, subject string, req interface{}) T {
+	t.Helper()
+
+	data, _ := json.Marshal(req)
+	msg, err := nc.Request(subject, data, 2*time.Second)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", subject, err)
+	}
+
+	var resp T
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("failed to decode response from %s: %v", subject, err)
+	}
+	return resp
+}
+
+func TestCheckpointWorkerLoadSave(t *testing.T) {
+	nc := startTestCheckpointWorker(t, newMemoryCheckpointStore())
+
+	resp := request[LoadLastLSNResponse](t, nc, topics.Checkpoints.Load, LoadLastLSNRequest{TableName: "Cars"})
+	if resp.Found || !bytes.Equal(resp.LastLSN, defaultStartLSN) {
+		t.Fatalf("expected default LSN for a new table, got %x (found=%v)", resp.LastLSN, resp.Found)
+	}
+
+	lsn := []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 3}
+	saveResp := request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: lsn})
+	if saveResp.Error != "" {
+		t.Fatalf("unexpected save error: %s", saveResp.Error)
+	}
+
+	// Saving snapshot progress must not clobber the LSN
+	progress := SnapshotProgress{Status: SnapshotStatusCompleted}
+	request[SaveSnapshotResponse](t, nc, topics.Checkpoints.SaveSnapshot, SaveSnapshotRequest{TableName: "Cars", Progress: progress})
+
+	resp = request[LoadLastLSNResponse](t, nc, topics.Checkpoints.Load, LoadLastLSNRequest{TableName: "Cars"})
+	if !resp.Found || !bytes.Equal(resp.LastLSN, lsn) {
+		t.Fatalf("expected saved LSN %x, got %x (found=%v)", lsn, resp.LastLSN, resp.Found)
+	}
+
+	snapshotResp := request[LoadSnapshotResponse](t, nc, topics.Checkpoints.LoadSnapshot, LoadSnapshotRequest{TableName: "Cars"})
+	if snapshotResp.Progress == nil || snapshotResp.Progress.Status != SnapshotStatusCompleted {
+		t.Fatalf("expected completed snapshot progress, got %+v", snapshotResp.Progress)
+	}
+}
+
+func TestCheckpointWorkerListDelete(t *testing.T) {
+	nc := startTestCheckpointWorker(t, newMemoryCheckpointStore())
+
+	for _, table := range []string{"Cars", "Persons"} {
+		request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: table, LastLSN: []byte{1}})
+	}
+
+	list := request[ListCheckpointsResponse](t, nc, topics.Checkpoints.List, ListCheckpointsRequest{})
+	if len(list.Checkpoints) != 2 {
+		t.Fatalf("expected 2 checkpoints, got %d", len(list.Checkpoints))
+	}
+
+	request[DeleteCheckpointResponse](t, nc, topics.Checkpoints.Delete, DeleteCheckpointRequest{TableName: "Cars"})
+
+	list = request[ListCheckpointsResponse](t, nc, topics.Checkpoints.List, ListCheckpointsRequest{})
+	if len(list.Checkpoints) != 1 || list.Checkpoints[0].TableName != "Persons" {
+		t.Fatalf("expected only Persons to remain, got %+v", list.Checkpoints)
+	}
+}
+
+func TestCheckpointWorkerHistory(t *testing.T) {
+	nc := startTestCheckpointWorker(t, newMemoryCheckpointStore())
+
+	for i := byte(1); i <= 5; i++ {
+		request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save,
+			SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{i}, InstanceID: "node-1", EventCount: int64(i)})
+	}
+
+	// The test worker keeps the last three updates
+	resp := request[CheckpointHistoryResponse](t, nc, topics.Checkpoints.History, CheckpointHistoryRequest{TableName: "Cars"})
+	if len(resp.History) != 3 {
+		t.Fatalf("expected 3 history records, got %d", len(resp.History))
+	}
+	for i, record := range resp.History {
+		want := byte(i + 3)
+		if !bytes.Equal(record.LastLSN, []byte{want}) || record.EventCount != int64(want) || record.InstanceID != "node-1" {
+			t.Errorf("unexpected history record %d: %+v", i, record)
+		}
+		if record.UpdatedAt.IsZero() {
+			t.Errorf("history record %d has no timestamp", i)
+		}
+	}
+}
+
+func TestCheckpointWorkerRewind(t *testing.T) {
+	nc := startTestCheckpointWorker(t, newMemoryCheckpointStore())
+
+	request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{5}})
+
+	rewindResp := request[RewindCheckpointResponse](t, nc, topics.Checkpoints.Rewind,
+		RewindCheckpointRequest{TableName: "Cars", LastLSN: []byte{2}, InstanceID: "node-1"})
+	if rewindResp.Error != "" || rewindResp.Generation != 1 {
+		t.Fatalf("expected rewind to generation 1, got %+v", rewindResp)
+	}
+
+	resp := request[LoadLastLSNResponse](t, nc, topics.Checkpoints.Load, LoadLastLSNRequest{TableName: "Cars"})
+	if !bytes.Equal(resp.LastLSN, []byte{2}) {
+		t.Fatalf("expected rewound LSN 02, got %x", resp.LastLSN)
+	}
+
+	// Later saves stay on the rewound generation
+	request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{3}})
+	history := request[CheckpointHistoryResponse](t, nc, topics.Checkpoints.History, CheckpointHistoryRequest{TableName: "Cars"}).History
+	if len(history) != 3 || !history[1].Rewind || history[2].Rewind || history[2].Generation != 1 {
+		t.Fatalf("unexpected history after rewind: %+v", history)
+	}
+}
+
+func TestCheckpointWorkerFencing(t *testing.T) {
+	nc := startTestCheckpointWorker(t, newMemoryCheckpointStore())
+
+	request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{1}, FencingToken: 1})
+
+	// A new holder claims the table; the previous holder's saves are refused from then on
+	fenceResp := request[FenceCheckpointResponse](t, nc, topics.Checkpoints.Fence, FenceCheckpointRequest{TableName: "Cars", FencingToken: 2, InstanceID: "node-2"})
+	if fenceResp.Error != "" {
+		t.Fatalf("unexpected fence error: %s", fenceResp.Error)
+	}
+	saveResp := request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{9}, FencingToken: 1})
+	if !saveResp.Fenced {
+		t.Fatalf("expected a save with an older token to be fenced, got %+v", saveResp)
+	}
+	resp := request[LoadLastLSNResponse](t, nc, topics.Checkpoints.Load, LoadLastLSNRequest{TableName: "Cars"})
+	if !bytes.Equal(resp.LastLSN, []byte{1}) {
+		t.Fatalf("expected the fenced save to be discarded, got LSN %x", resp.LastLSN)
+	}
+
+	// A monitor validating its token before streaming a checkpoint learns it was fenced off
+	if validateResp := request[ValidateFencingTokenResponse](t, nc, topics.Checkpoints.Validate, ValidateFencingTokenRequest{TableName: "Cars", FencingToken: 1}); !validateResp.Fenced {
+		t.Fatalf("expected the older token to be reported fenced, got %+v", validateResp)
+	}
+	if validateResp := request[ValidateFencingTokenResponse](t, nc, topics.Checkpoints.Validate, ValidateFencingTokenRequest{TableName: "Cars", FencingToken: 2}); validateResp.Fenced || validateResp.Error != "" {
+		t.Fatalf("expected the new holder's token to be valid, got %+v", validateResp)
+	}
+
+	saveResp = request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{2}, FencingToken: 2})
+	if saveResp.Error != "" {
+		t.Fatalf("expected the new holder's save to succeed, got %s", saveResp.Error)
+	}
+
+	// Fencing with an older token than the stored one fails as well
+	fenceResp = request[FenceCheckpointResponse](t, nc, topics.Checkpoints.Fence, FenceCheckpointRequest{TableName: "Cars", FencingToken: 1})
+	if !fenceResp.Fenced {
+		t.Fatalf("expected fencing with an older token to be refused, got %+v", fenceResp)
+	}
+}
+
+func TestCheckpointWorkerStopsTakingRequests(t *testing.T) {
+	natsServer := test.RunRandClientPortServer()
+	t.Cleanup(natsServer.Shutdown)
+	nc, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	store := newMemoryCheckpointStore()
+	cw := NewCheckpointWorker(store, nc, 3, FlushPolicy{Events: 1000})
+	if err := cw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	saved := request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{1}, EventCount: 1})
+	if saved.Error != "" {
+		t.Fatal(saved.Error)
+	}
+
+	// Stopping writes the buffered save, and no save can arrive after that final flush
+	cw.Stop(context.TODO())
+	if lsn := storedLSN(t, store, "Cars"); !bytes.Equal(lsn, []byte{1}) {
+		t.Fatalf("expected Stop to flush LSN 01, store has %x", lsn)
+	}
+	data, _ := json.Marshal(SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{2}})
+	if _, err := nc.Request(topics.Checkpoints.Save, data, 200*time.Millisecond); err == nil {
+		t.Fatal("expected no checkpoint worker to answer after Stop")
+	}
+}
+
+func TestCheckpointWorkerElection(t *testing.T) {
+	natsServer := test.RunRandClientPortServer()
+	t.Cleanup(natsServer.Shutdown)
+	nc, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	// Two checkpoint processes share the bus; only the one holding the lock buffers saves
+	store := newMemoryCheckpointStore()
+	locks := newMemoryLockProvider(300 * time.Millisecond)
+	first := NewCheckpointWorker(store, nc, 3, FlushPolicy{Events: 1000})
+	first.StartElected(locks)
+	waitForCheckpointWorker(t, nc)
+	second := NewCheckpointWorker(store, nc, 3, FlushPolicy{Events: 1000})
+	second.StartElected(locks)
+	defer second.Stop(context.TODO())
+
+	for i := byte(1); i <= 3; i++ {
+		if resp := request[SaveLastLSNResponse](t, nc, topics.Checkpoints.Save, SaveLastLSNRequest{TableName: "Cars", LastLSN: []byte{i}, EventCount: 1}); resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+	}
+	if first.Metrics().Tables[0].LagEvents != 3 || len(second.Metrics().Tables) != 0 {
+		t.Fatalf("expected every save in the active worker's buffer, got %+v and %+v", first.Metrics(), second.Metrics())
+	}
+
+	// Stopping the active worker writes its buffer before the standby takes over
+	first.Stop(context.TODO())
+	if lsn := storedLSN(t, store, "Cars"); !bytes.Equal(lsn, []byte{3}) {
+		t.Fatalf("expected Stop to flush LSN 03, store has %x", lsn)
+	}
+	waitForCheckpointWorker(t, nc)
+	if resp := request[LoadLastLSNResponse](t, nc, topics.Checkpoints.Load, LoadLastLSNRequest{TableName: "Cars"}); !bytes.Equal(resp.LastLSN, []byte{3}) {
+		t.Fatalf("expected the standby to load LSN 03, got %+v", resp)
+	}
+}
+
+// waitForCheckpointWorker waits until a checkpoint worker answers requests
+func waitForCheckpointWorker(t *testing.T, nc *nats.Conn) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := nc.Request(topics.Checkpoints.Metrics, nil, 100*time.Millisecond); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no checkpoint worker answers requests")
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -21,11 +24,20 @@ import (
 
 // Config holds the entire configuration as represented in the HCL file
 type Config struct {
-	DBType             string        `hcl:"db_type"`
-	DBConnectionString string        `hcl:"db_connection_string"`
-	Output             OutputConfig  `hcl:"output,block"`
-	Locks              LockConfig    `hcl:"locks,block"`
-	Tables             []TableConfig `hcl:"tables,block"`
+	DBType             string             `hcl:"db_type"`
+	DBConnectionString string             `hcl:"db_connection_string"`
+	SignalTable        string             `hcl:"signal_table,optional"`     // Table polled for incremental snapshot signals
+	InstanceID         string             `hcl:"instance_id,optional"`      // Identifies this process in checkpoint history, defaults to hostname-pid
+	ShutdownTimeout    string             `hcl:"shutdown_timeout,optional"` // Deadline for a graceful shutdown, defaults to "30s"
+	Output             OutputConfig       `hcl:"output,block"`
+	Locks              LockConfig         `hcl:"locks,block"`
+	Checkpoint         *CheckpointConfig  `hcl:"checkpoint,block"`
+	EmbeddedBus        *EmbeddedBusConfig `hcl:"embedded_bus,block"`
+	ExternalBus        *ExternalBusConfig `hcl:"external_bus,block"` // Connects to a NATS cluster instead of embedding a server
+	EventStream        *EventStreamConfig `hcl:"event_stream,block"`
+	DeadLetter         *DeadLetterConfig  `hcl:"dead_letter,block"`
+	Supervisor         *SupervisorConfig  `hcl:"supervisor,block"`
+	Tables             []TableConfig      `hcl:"tables,block"`
 }
 
 func NewConfig() *Config {
@@ -44,9 +56,13 @@ func NewConfig() *Config {
 
 // TableConfig represents individual table configurations in the HCL file
 type TableConfig struct {
-	Name            string `hcl:"name"`
-	PollInterval    string `hcl:"poll_interval"`
-	MaxPollInterval string `hcl:"max_poll_interval"`
+	Name               string `hcl:"name"`
+	PollInterval       string `hcl:"poll_interval"`
+	MaxPollInterval    string `hcl:"max_poll_interval"`
+	TransactionMarkers bool   `hcl:"transaction_markers,optional"`  // Emit Begin/Commit marker events around each transaction
+	Snapshot           string `hcl:"snapshot,optional"`             // "initial", "never" (default) or "when_needed"
+	SnapshotChunkSize  int    `hcl:"snapshot_chunk_size,optional"`  // Rows read per snapshot chunk
+	RetentionGapPolicy string `hcl:"retention_gap_policy,optional"` // "fail" (default), "skip" or "snapshot"
 }
 
 // OutputConfig represents the configuration for output type and connection string
@@ -57,9 +73,346 @@ type OutputConfig struct {
 
 // LockConfig represents the configuration for distributed locking
 type LockConfig struct {
-	Type             string `hcl:"type"`                   // Specifies the lock provider type (e.g., "azure_blob")
-	ConnectionString string `hcl:"connection_string,attr"` // Connection string for the lock provider
-	ContainerName    string `hcl:"container_name"`         // Name of the container used for lock files
+	Type             string `hcl:"type"`                       // Specifies the lock provider type ("azure_blob" or "sqlserver")
+	ConnectionString string `hcl:"connection_string,optional"` // Connection string for azure_blob
+	ContainerName    string `hcl:"container_name,optional"`    // Name of the container used for lock files (azure_blob)
+	TableName        string `hcl:"table_name,optional"`        // Table recording lock holders for sqlserver, defaults to "instances"
+	Schema           string `hcl:"schema,optional"`            // Schema of the instances table for sqlserver, defaults to "dbo"
+	LeaseDuration    string `hcl:"lease_duration,optional"`    // How long a lock is held without renewal, defaults to "30s"
+	Capacity         int    `hcl:"capacity,optional"`          // Maximum number of tables streamed by this instance, 0 for no limit
+}
+
+// GetLeaseDuration returns how long a lock is held without renewal, defaulting to 30 seconds
+func (l LockConfig) GetLeaseDuration() (time.Duration, error) {
+	if l.LeaseDuration == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(l.LeaseDuration)
+}
+
+// CheckpointConfig represents the configuration for checkpoint storage
+type CheckpointConfig struct {
+	Type        string `hcl:"type,optional"`         // "sqlserver" (default), "file", "bolt", "jetstream" or "azure_blob"
+	TableName   string `hcl:"table_name,optional"`   // Checkpoint table name for sqlserver, defaults to "cdc_offsets"
+	Schema      string `hcl:"schema,optional"`       // Schema of the checkpoint table for sqlserver, defaults to "dbo"
+	Path        string `hcl:"path,optional"`         // Directory for file, database file for bolt
+	Bucket      string `hcl:"bucket,optional"`       // KV bucket for jetstream, defaults to "dstream_checkpoints"
+	History     int    `hcl:"history,optional"`      // Revisions kept per table for jetstream, defaults to 10
+	Prefix      string `hcl:"prefix,optional"`       // Blob name prefix in the locks container for azure_blob, defaults to "checkpoints/"
+	HistorySize int    `hcl:"history_size,optional"` // Checkpoint updates kept per table for audit and rewind, defaults to 100
+
+	FlushEvents   int    `hcl:"flush_events,optional"`   // Write a table's checkpoint after this many delivered events, defaults to 1000
+	FlushInterval string `hcl:"flush_interval,optional"` // Write pending checkpoints at least this often, defaults to "5s"
+}
+
+// GetCheckpointConfig returns the checkpoint configuration, or an empty one when the block is omitted
+func (c *Config) GetCheckpointConfig() CheckpointConfig {
+	if c.Checkpoint == nil {
+		return CheckpointConfig{}
+	}
+	return *c.Checkpoint
+}
+
+// EmbeddedBusConfig represents the configuration of the embedded NATS server the components talk over
+type EmbeddedBusConfig struct {
+	Listen       string `hcl:"listen,optional"`        // host:port clients connect to, defaults to "127.0.0.1:4222"; port -1 picks a free port
+	InProcess    bool   `hcl:"in_process,optional"`    // Connect in-process only, without a TCP listener
+	MaxPayload   int    `hcl:"max_payload,optional"`   // Largest message in bytes, defaults to the NATS default of 1MB
+	StoreDir     string `hcl:"store_dir,optional"`     // JetStream storage directory, defaults to data/jetstream/<instance>; one per instance
+	Logging      string `hcl:"logging,optional"`       // "off" (default), "info", "debug" or "trace"
+	LogFile      string `hcl:"log_file,optional"`      // Writes the server log to a file instead of stderr
+	ReadyTimeout string `hcl:"ready_timeout,optional"` // How long to wait for the server to accept connections, defaults to "10s"
+}
+
+// GetEmbeddedBusConfig returns the embedded bus configuration, or an empty one when the block is omitted.
+// An unset store_dir defaults to data/jetstream/<instance_id>, or data/jetstream/<hostname> without an instance_id.
+func (c *Config) GetEmbeddedBusConfig() EmbeddedBusConfig {
+	bus := EmbeddedBusConfig{}
+	if c.EmbeddedBus != nil {
+		bus = *c.EmbeddedBus
+	}
+	if bus.StoreDir == "" {
+		bus.StoreDir = defaultStoreDir(c.InstanceID)
+	}
+	return bus
+}
+
+// GetListen returns the host and port the embedded server listens on, defaulting to 127.0.0.1:4222
+func (b EmbeddedBusConfig) GetListen() (string, int, error) {
+	if b.Listen == "" {
+		return "127.0.0.1", 4222, nil
+	}
+	host, portText, err := net.SplitHostPort(b.Listen)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %s: %w", b.Listen, err)
+	}
+	return host, port, nil
+}
+
+// GetStoreDir returns the JetStream storage directory, defaulting to data/jetstream/<hostname> below the
+// working directory. The directory holds the event stream, the dead letters and the JetStream checkpoints,
+// so it persists across restarts and is not shared with other instances.
+func (b EmbeddedBusConfig) GetStoreDir() string {
+	if b.StoreDir == "" {
+		return defaultStoreDir("")
+	}
+	return b.StoreDir
+}
+
+// defaultStoreDir returns the JetStream storage directory of an instance, data/jetstream/<instanceID>.
+// Without an instance id the hostname is used, which unlike the default instance id survives restarts.
+func defaultStoreDir(instanceID string) string {
+	if instanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "dstream"
+		}
+		instanceID = hostname
+	}
+	return filepath.Join("data", "jetstream", instanceID)
+}
+
+// GetReadyTimeout returns how long to wait for the embedded server to start, defaulting to 10 seconds
+func (b EmbeddedBusConfig) GetReadyTimeout() (time.Duration, error) {
+	if b.ReadyTimeout == "" {
+		return 10 * time.Second, nil
+	}
+	return time.ParseDuration(b.ReadyTimeout)
+}
+
+// ExternalBusConfig represents the connection to an external NATS cluster shared by all dstream processes
+type ExternalBusConfig struct {
+	URLs             []string `hcl:"urls"`                        // Cluster URLs, e.g. ["nats://nats-1:4222", "nats://nats-2:4222"]
+	CredsFile        string   `hcl:"creds_file,optional"`         // User credentials file (JWT and NKey seed)
+	NKeySeedFile     string   `hcl:"nkey_seed_file,optional"`     // NKey seed file for NKey authentication
+	TLSCAFile        string   `hcl:"tls_ca_file,optional"`        // CA certificate used to verify the servers
+	TLSCertFile      string   `hcl:"tls_cert_file,optional"`      // Client certificate for mutual TLS
+	TLSKeyFile       string   `hcl:"tls_key_file,optional"`       // Client key for mutual TLS
+	ReconnectWait    string   `hcl:"reconnect_wait,optional"`     // First reconnect delay, doubled on every attempt, defaults to "1s"
+	MaxReconnectWait string   `hcl:"max_reconnect_wait,optional"` // Longest reconnect delay, defaults to "30s"
+	MaxReconnects    int      `hcl:"max_reconnects,optional"`     // Reconnect attempts before giving up, 0 for no limit
+}
+
+// GetReconnectWait returns the first reconnect delay, defaulting to 1 second
+func (b ExternalBusConfig) GetReconnectWait() (time.Duration, error) {
+	if b.ReconnectWait == "" {
+		return time.Second, nil
+	}
+	return time.ParseDuration(b.ReconnectWait)
+}
+
+// GetMaxReconnectWait returns the longest reconnect delay, defaulting to 30 seconds
+func (b ExternalBusConfig) GetMaxReconnectWait() (time.Duration, error) {
+	if b.MaxReconnectWait == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(b.MaxReconnectWait)
+}
+
+// EventStreamConfig represents the JetStream stream buffering change events between the fetcher and the publisher
+type EventStreamConfig struct {
+	Name            string `hcl:"name,optional"`             // Stream name, defaults to "DSTREAM_EVENTS"
+	Storage         string `hcl:"storage,optional"`          // "file" (default) or "memory"
+	Replicas        int    `hcl:"replicas,optional"`         // Stream replicas on a clustered bus, defaults to 1
+	MaxAge          string `hcl:"max_age,optional"`          // Oldest event kept, defaults to "168h"
+	MaxBytes        int64  `hcl:"max_bytes,optional"`        // Largest stream size in bytes, 0 for no limit
+	MaxMsgs         int64  `hcl:"max_msgs,optional"`         // Most events kept, 0 for no limit
+	DuplicateWindow string `hcl:"duplicate_window,optional"` // How long republished events are recognised as duplicates, defaults to "2m"
+	AckWait         string `hcl:"ack_wait,optional"`         // How long the publisher may take to deliver an event before it is redelivered, defaults to "30s"
+	Partitions      int    `hcl:"partitions,optional"`       // Partitions per table events are spread over by primary key, defaults to 1
+	Workers         int    `hcl:"workers,optional"`          // Table partitions delivered in parallel by each publisher process, defaults to all of them
+	BatchSize       int    `hcl:"batch_size,optional"`       // Events a publisher takes from a table partition at once, defaults to 100
+}
+
+// GetEventStreamConfig returns the event stream configuration, or an empty one when the block is omitted
+func (c *Config) GetEventStreamConfig() EventStreamConfig {
+	if c.EventStream == nil {
+		return EventStreamConfig{}
+	}
+	return *c.EventStream
+}
+
+// GetName returns the stream name, defaulting to DSTREAM_EVENTS
+func (e EventStreamConfig) GetName() string {
+	if e.Name == "" {
+		return "DSTREAM_EVENTS"
+	}
+	return e.Name
+}
+
+// GetMaxAge returns how long events are kept, defaulting to 7 days
+func (e EventStreamConfig) GetMaxAge() (time.Duration, error) {
+	if e.MaxAge == "" {
+		return 7 * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(e.MaxAge)
+}
+
+// GetDuplicateWindow returns the window in which republished events are dropped, defaulting to 2 minutes
+func (e EventStreamConfig) GetDuplicateWindow() (time.Duration, error) {
+	if e.DuplicateWindow == "" {
+		return 2 * time.Minute, nil
+	}
+	return time.ParseDuration(e.DuplicateWindow)
+}
+
+// GetAckWait returns how long an event may stay unacknowledged, defaulting to 30 seconds
+func (e EventStreamConfig) GetAckWait() (time.Duration, error) {
+	if e.AckWait == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(e.AckWait)
+}
+
+// GetPartitions returns the number of partitions per table, defaulting to 1
+func (e EventStreamConfig) GetPartitions() int {
+	if e.Partitions <= 0 {
+		return 1
+	}
+	return e.Partitions
+}
+
+// GetWorkers returns the number of publisher workers per process for the given number of table partitions,
+// defaulting to one per table partition
+func (e EventStreamConfig) GetWorkers(tablePartitions int) int {
+	if e.Workers <= 0 || e.Workers > tablePartitions {
+		return tablePartitions
+	}
+	return e.Workers
+}
+
+// GetBatchSize returns how many events a publisher takes from a table partition at once, defaulting to 100
+func (e EventStreamConfig) GetBatchSize() int {
+	if e.BatchSize <= 0 {
+		return 100
+	}
+	return e.BatchSize
+}
+
+// DeadLetterConfig represents the JetStream stream keeping events that could not be delivered or serialized
+type DeadLetterConfig struct {
+	Stream      string `hcl:"stream,optional"`       // Stream name, defaults to "DSTREAM_DLQ"
+	MaxAttempts int    `hcl:"max_attempts,optional"` // Delivery attempts before an event the sink refused is dead-lettered, defaults to 10
+	MaxAge      string `hcl:"max_age,optional"`      // Oldest dead letter kept, defaults to "720h"
+}
+
+// GetDeadLetterConfig returns the dead letter configuration, or an empty one when the block is omitted
+func (c *Config) GetDeadLetterConfig() DeadLetterConfig {
+	if c.DeadLetter == nil {
+		return DeadLetterConfig{}
+	}
+	return *c.DeadLetter
+}
+
+// GetStream returns the dead letter stream name, defaulting to DSTREAM_DLQ
+func (d DeadLetterConfig) GetStream() string {
+	if d.Stream == "" {
+		return "DSTREAM_DLQ"
+	}
+	return d.Stream
+}
+
+// GetMaxAttempts returns the delivery attempts before an event the sink refused is dead-lettered, defaulting to 10
+func (d DeadLetterConfig) GetMaxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return 10
+	}
+	return d.MaxAttempts
+}
+
+// GetMaxAge returns how long dead letters are kept, defaulting to 30 days
+func (d DeadLetterConfig) GetMaxAge() (time.Duration, error) {
+	if d.MaxAge == "" {
+		return 30 * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(d.MaxAge)
+}
+
+// SupervisorConfig controls how tables whose streaming failed are restarted
+type SupervisorConfig struct {
+	RestartInterval    string `hcl:"restart_interval,optional"`     // First delay before a failed table is restarted, defaults to "1s"
+	MaxRestartInterval string `hcl:"max_restart_interval,optional"` // Longest delay between restarts, defaults to "5m"
+	UnhealthyAfter     int    `hcl:"unhealthy_after,optional"`      // Consecutive failures before a table is reported unhealthy, defaults to 5
+}
+
+// GetSupervisorConfig returns the supervisor configuration, or an empty one when the block is omitted
+func (c *Config) GetSupervisorConfig() SupervisorConfig {
+	if c.Supervisor == nil {
+		return SupervisorConfig{}
+	}
+	return *c.Supervisor
+}
+
+// GetRestartInterval returns the first restart delay, defaulting to 1 second
+func (s SupervisorConfig) GetRestartInterval() (time.Duration, error) {
+	if s.RestartInterval == "" {
+		return time.Second, nil
+	}
+	return time.ParseDuration(s.RestartInterval)
+}
+
+// GetMaxRestartInterval returns the longest restart delay, defaulting to 5 minutes
+func (s SupervisorConfig) GetMaxRestartInterval() (time.Duration, error) {
+	if s.MaxRestartInterval == "" {
+		return 5 * time.Minute, nil
+	}
+	return time.ParseDuration(s.MaxRestartInterval)
+}
+
+// GetUnhealthyAfter returns the consecutive failures after which a table is unhealthy, defaulting to 5
+func (s SupervisorConfig) GetUnhealthyAfter() int {
+	if s.UnhealthyAfter <= 0 {
+		return 5
+	}
+	return s.UnhealthyAfter
+}
+
+// GetInstanceID returns the configured instance id, defaulting to the hostname and process id
+func (c *Config) GetInstanceID() string {
+	if c.InstanceID != "" {
+		return c.InstanceID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "dstream"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// GetShutdownTimeout returns how long a graceful shutdown may take, defaulting to 30 seconds
+func (c *Config) GetShutdownTimeout() (time.Duration, error) {
+	if c.ShutdownTimeout == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(c.ShutdownTimeout)
+}
+
+// GetHistorySize returns the number of checkpoint updates kept per table, defaulting to 100
+func (c CheckpointConfig) GetHistorySize() int {
+	if c.HistorySize <= 0 {
+		return 100
+	}
+	return c.HistorySize
+}
+
+// GetFlushEvents returns the number of delivered events after which a checkpoint is written, defaulting to 1000
+func (c CheckpointConfig) GetFlushEvents() int {
+	if c.FlushEvents <= 0 {
+		return 1000
+	}
+	return c.FlushEvents
+}
+
+// GetFlushInterval returns how often pending checkpoints are written, defaulting to 5 seconds
+func (c CheckpointConfig) GetFlushInterval() (time.Duration, error) {
+	if c.FlushInterval == "" {
+		return 5 * time.Second, nil
+	}
+	return time.ParseDuration(c.FlushInterval)
 }
 
 // CheckConfig validates the configuration based on the output type and lock type requirements
@@ -90,6 +443,9 @@ func (c *Config) CheckConfig() {
 		c.validateBlobLockConfig()
 	case "azure_blob":
 		c.validateBlobLockConfig()
+	case "sqlserver":
+		// SQL Server locks are taken in the source database; the instances table is created on first use
+		log.Println("Locks set to sqlserver; using the database connection string.")
 	default:
 		log.Fatalf("Error, unknown lock type: %s", c.Locks.Type)
 	}
@@ -184,6 +540,38 @@ func (t *TableConfig) GetMaxPollInterval() (time.Duration, error) {
 	return time.ParseDuration(t.MaxPollInterval)
 }
 
+// GetSnapshotMode returns the snapshot mode, defaulting to "never"
+func (t *TableConfig) GetSnapshotMode() (string, error) {
+	mode := strings.ToLower(t.Snapshot)
+	switch mode {
+	case "":
+		return "never", nil
+	case "initial", "never", "when_needed":
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown snapshot mode %q for table %s", t.Snapshot, t.Name)
+}
+
+// GetSnapshotChunkSize returns the number of rows read per snapshot chunk, defaulting to 1000
+func (t *TableConfig) GetSnapshotChunkSize() int {
+	if t.SnapshotChunkSize <= 0 {
+		return 1000
+	}
+	return t.SnapshotChunkSize
+}
+
+// GetRetentionGapPolicy returns the policy applied when the checkpoint falls behind CDC retention, defaulting to "fail"
+func (t *TableConfig) GetRetentionGapPolicy() (string, error) {
+	policy := strings.ToLower(t.RetentionGapPolicy)
+	switch policy {
+	case "":
+		return "fail", nil
+	case "fail", "skip", "snapshot":
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown retention gap policy %q for table %s", t.RetentionGapPolicy, t.Name)
+}
+
 // generateHCL Generates the HCL config after processing the text templating
 func generateHCL(filePath string) (hcl string, err error) {
 	// Get the Sprig function map
@@ -223,8 +611,13 @@ func processHCL(configHCL string, filePath string) (config Config) {
 }
 
 func GenTopicName(connectionString string, tableName string) string {
+	return fmt.Sprintf("%s-%s-events", DatabaseName(connectionString), strings.ToLower(tableName))
+}
+
+// DatabaseName returns the lower-cased database name of a connection string, or an empty string when it has none
+func DatabaseName(connectionString string) string {
 	dbName, _ := extractDatabaseName(connectionString)
-	return fmt.Sprintf("%s-%s-events", dbName, strings.ToLower(tableName))
+	return dbName
 }
 
 // ExtractDatabaseName extracts the database name from a connection string
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/katasec/dstream/utils"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// deadLetterQueue is the queue group all dead letter admins subscribe in
+const deadLetterQueue = "dead-letter-admins"
+
+// defaultDeadLetterListLimit is the number of dead letters listed when a request sets no limit
+const defaultDeadLetterListLimit = 100
+
+// deadLetterScanBatch is the number of dead letters fetched at once when reading them
+const deadLetterScanBatch = 256
+
+// Components dead-lettering an event
+const (
+	DeadLetterSourceFetcher   = "fetcher"   // The change could not be serialized
+	DeadLetterSourcePublisher = "publisher" // The sink kept refusing the event
+)
+
+// DeadLetter is an event that could not be delivered or serialized, kept on topics.DeadLetterSubject.
+// Events refused by the sink keep their subject and headers so that they can be replayed.
+type DeadLetter struct {
+	Sequence      uint64            `json:"sequence,omitempty"` // Position in the dead letter stream, set when read back
+	TableName     string            `json:"table_name"`
+	Source        string            `json:"source"`
+	Subject       string            `json:"subject,omitempty"` // Event subject the event is replayed to; empty for changes that were never serialized
+	Headers       map[string]string `json:"headers,omitempty"`
+	Data          []byte            `json:"data,omitempty"`
+	Error         string            `json:"error"`
+	Attempts      int               `json:"attempts"`
+	FirstFailedAt time.Time         `json:"first_failed_at"`
+	LastFailedAt  time.Time         `json:"last_failed_at"`
+}
+
+// DeadLetterListRequest lists the dead letters of a table, or of all tables when TableName is empty.
+// Data and headers are left out; inspect a dead letter to see them.
+type DeadLetterListRequest struct {
+	TableName string `json:"table_name,omitempty"`
+	Limit     int    `json:"limit,omitempty"` // Defaults to 100
+}
+
+// DeadLetterListResponse is the reply to a list request, oldest dead letter first
+type DeadLetterListResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// DeadLetterInspectRequest asks for a single dead letter
+type DeadLetterInspectRequest struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+// DeadLetterInspectResponse is the reply to an inspect request
+type DeadLetterInspectResponse struct {
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// DeadLetterRequest selects the dead letters to replay or purge: a single one by sequence, all of a
+// table, or all dead letters when both are empty
+type DeadLetterRequest struct {
+	Sequence  uint64 `json:"sequence,omitempty"`
+	TableName string `json:"table_name,omitempty"`
+}
+
+// DeadLetterResponse is the reply to a replay or purge request
+type DeadLetterResponse struct {
+	Count   int    `json:"count"`             // Dead letters replayed or purged
+	Skipped int    `json:"skipped,omitempty"` // Dead letters left in place because they cannot be replayed
+	Error   string `json:"error,omitempty"`
+}
+
+// EnsureDeadLetterStream creates the stream keeping dead letters, or updates its limits to the
+// configured ones. The oldest dead letters are dropped once they are older than max_age.
+func EnsureDeadLetterStream(ctx context.Context, js jetstream.JetStream, c config.DeadLetterConfig) (jetstream.Stream, error) {
+	maxAge, err := c.GetMaxAge()
+	if err != nil {
+		return nil, fmt.Errorf("invalid dead_letter max_age: %w", err)
+	}
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      c.GetStream(),
+		Subjects:  []string{topics.CDC.DeadLetter + ".>"},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    maxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dead letter stream %s: %w", c.GetStream(), err)
+	}
+	return stream, nil
+}
+
+// publishDeadLetter stores a dead letter on its table's dead letter subject
+func publishDeadLetter(ctx context.Context, js jetstream.JetStream, letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	if _, err := js.Publish(ctx, topics.DeadLetterSubject(letter.TableName), data); err != nil {
+		return fmt.Errorf("failed to dead-letter event of table '%s': %w", letter.TableName, err)
+	}
+	log.Printf("[DeadLetters] Dead-lettered event of table '%s' after %d attempts: %s", letter.TableName, letter.Attempts, letter.Error)
+	return nil
+}
+
+// DeadLetterAdmin serves the admin requests listing, inspecting, replaying and purging dead letters
+type DeadLetterAdmin struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	stream jetstream.Stream
+	subs   []*nats.Subscription // Subscriptions to the admin subjects, while started
+}
+
+// NewDeadLetterAdmin creates the admin of a dead letter stream. Replayed events are published to the event stream through js.
+func NewDeadLetterAdmin(nc *nats.Conn, js jetstream.JetStream, stream jetstream.Stream) *DeadLetterAdmin {
+	return &DeadLetterAdmin{nc: nc, js: js, stream: stream}
+}
+
+// Start subscribes to the dead letter admin subjects; admins of several processes share them as a queue group
+func (a *DeadLetterAdmin) Start() error {
+	subs, err := utils.SubscribeAll("DeadLetterAdmin", a.nc, deadLetterQueue, map[string]nats.MsgHandler{
+		topics.DeadLetters.List:    a.listHandler,
+		topics.DeadLetters.Inspect: a.inspectHandler,
+		topics.DeadLetters.Replay:  a.replayHandler,
+		topics.DeadLetters.Purge:   a.purgeHandler,
+	})
+	a.subs = subs
+	return err
+}
+
+// Stop unsubscribes from the dead letter admin subjects
+func (a *DeadLetterAdmin) Stop() {
+	utils.Unsubscribe(a.subs)
+	a.subs = nil
+}
+
+// listHandler A handler for topics.DeadLetters.List requests
+func (a *DeadLetterAdmin) listHandler(msg *nats.Msg) {
+	var resp DeadLetterListResponse
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+	req, err := utils.UnmarshalJSON[DeadLetterListRequest](msg.Data)
+	if err == nil {
+		resp.DeadLetters, err = a.List(ctx, req.TableName, req.Limit)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	a.respond(msg, resp)
+}
+
+// inspectHandler A handler for topics.DeadLetters.Inspect requests
+func (a *DeadLetterAdmin) inspectHandler(msg *nats.Msg) {
+	var resp DeadLetterInspectResponse
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+	req, err := utils.UnmarshalJSON[DeadLetterInspectRequest](msg.Data)
+	if err == nil {
+		resp.DeadLetter, err = a.Inspect(ctx, req.Sequence)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	a.respond(msg, resp)
+}
+
+// replayHandler A handler for topics.DeadLetters.Replay requests
+func (a *DeadLetterAdmin) replayHandler(msg *nats.Msg) {
+	var resp DeadLetterResponse
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+	req, err := utils.UnmarshalJSON[DeadLetterRequest](msg.Data)
+	if err == nil {
+		resp.Count, resp.Skipped, err = a.Replay(ctx, req)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	a.respond(msg, resp)
+}
+
+// purgeHandler A handler for topics.DeadLetters.Purge requests
+func (a *DeadLetterAdmin) purgeHandler(msg *nats.Msg) {
+	var resp DeadLetterResponse
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+	req, err := utils.UnmarshalJSON[DeadLetterRequest](msg.Data)
+	if err == nil {
+		resp.Count, err = a.Purge(ctx, req)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	a.respond(msg, resp)
+}
+
+func (a *DeadLetterAdmin) respond(msg *nats.Msg, resp interface{}) {
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("[DeadLetterAdmin] Failed to respond on %s: %v", msg.Subject, err)
+	}
+}
+
+// List returns up to limit dead letters of a table, or of all tables when tableName is empty, without their data
+func (a *DeadLetterAdmin) List(ctx context.Context, tableName string, limit int) ([]DeadLetter, error) {
+	if limit <= 0 {
+		limit = defaultDeadLetterListLimit
+	}
+	letters, err := a.scan(ctx, DeadLetterRequest{TableName: tableName}, limit)
+	for i := range letters {
+		letters[i].Data = nil
+		letters[i].Headers = nil
+	}
+	return letters, err
+}
+
+// Inspect returns a dead letter with its data
+func (a *DeadLetterAdmin) Inspect(ctx context.Context, sequence uint64) (*DeadLetter, error) {
+	letters, err := a.scan(ctx, DeadLetterRequest{Sequence: sequence}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, fmt.Errorf("dead letter %d not found", sequence)
+	}
+	return &letters[0], nil
+}
+
+// Replay publishes the selected dead letters to the event stream again and removes them from the dead
+// letter stream. Changes that were never serialized cannot be replayed; they are skipped and left in
+// place, unless a single one was requested. It returns the number of replayed and skipped dead letters.
+func (a *DeadLetterAdmin) Replay(ctx context.Context, req DeadLetterRequest) (int, int, error) {
+	letters, err := a.scan(ctx, req, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if req.Sequence != 0 && len(letters) == 0 {
+		return 0, 0, fmt.Errorf("dead letter %d not found", req.Sequence)
+	}
+
+	replayed, skipped := 0, 0
+	for _, letter := range letters {
+		if letter.Subject == "" {
+			if req.Sequence != 0 {
+				return 0, 0, fmt.Errorf("dead letter %d of table '%s' was never serialized and cannot be replayed", letter.Sequence, letter.TableName)
+			}
+			skipped++
+			continue
+		}
+
+		// Without its message id the event is not mistaken for a duplicate of the original
+		msg := nats.NewMsg(letter.Subject)
+		msg.Data = letter.Data
+		for key, value := range letter.Headers {
+			if key != jetstream.MsgIDHeader {
+				msg.Header.Set(key, value)
+			}
+		}
+		if _, err := a.js.PublishMsg(ctx, msg); err != nil {
+			return replayed, skipped, fmt.Errorf("failed to replay dead letter %d: %w", letter.Sequence, err)
+		}
+		if err := a.stream.DeleteMsg(ctx, letter.Sequence); err != nil {
+			return replayed, skipped, fmt.Errorf("replayed dead letter %d but failed to remove it: %w", letter.Sequence, err)
+		}
+		replayed++
+	}
+	log.Printf("[DeadLetterAdmin] Replayed %d dead letters, skipped %d that cannot be replayed", replayed, skipped)
+	return replayed, skipped, nil
+}
+
+// Purge removes the selected dead letters and returns their number
+func (a *DeadLetterAdmin) Purge(ctx context.Context, req DeadLetterRequest) (int, error) {
+	letters, err := a.scan(ctx, req, 0)
+	if err != nil {
+		return 0, err
+	}
+	if req.Sequence != 0 && len(letters) == 0 {
+		return 0, fmt.Errorf("dead letter %d not found", req.Sequence)
+	}
+
+	if req.Sequence != 0 {
+		err = a.stream.DeleteMsg(ctx, req.Sequence)
+	} else if req.TableName != "" {
+		err = a.stream.Purge(ctx, jetstream.WithPurgeSubject(topics.DeadLetterSubject(req.TableName)))
+	} else {
+		err = a.stream.Purge(ctx)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead letters: %w", err)
+	}
+	log.Printf("[DeadLetterAdmin] Purged %d dead letters", len(letters))
+	return len(letters), nil
+}
+
+// scan reads the dead letters selected by req in stream order, at most limit of them unless limit is 0.
+// A single dead letter is read by its sequence; otherwise a temporary consumer filtered on the table's
+// subject reads the dead letters, so the server skips those of other tables.
+func (a *DeadLetterAdmin) scan(ctx context.Context, req DeadLetterRequest, limit int) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	if req.Sequence != 0 {
+		msg, err := a.stream.GetMsg(ctx, req.Sequence)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return letters, nil // Removed by a replay or purge
+		}
+		if err != nil {
+			return letters, err
+		}
+		if req.TableName != "" && msg.Subject != topics.DeadLetterSubject(req.TableName) {
+			return letters, nil
+		}
+		letter, err := readDeadLetter(msg.Data, req.Sequence)
+		if err != nil {
+			return letters, err
+		}
+		return append(letters, letter), nil
+	}
+
+	filter := topics.CDC.DeadLetter + ".>"
+	if req.TableName != "" {
+		filter = topics.DeadLetterSubject(req.TableName)
+	}
+	consumer, err := a.stream.CreateConsumer(ctx, jetstream.ConsumerConfig{
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		AckPolicy:         jetstream.AckNonePolicy,
+		FilterSubject:     filter,
+		InactiveThreshold: time.Minute,
+		MemoryStorage:     true,
+	})
+	if err != nil {
+		return letters, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	defer func() {
+		if err := a.stream.DeleteConsumer(context.WithoutCancel(ctx), consumer.CachedInfo().Name); err != nil {
+			log.Printf("[DeadLetterAdmin] Failed to remove dead letter consumer: %v", err)
+		}
+	}()
+
+	pending := int(consumer.CachedInfo().NumPending)
+	for pending > 0 && (limit == 0 || len(letters) < limit) {
+		size := min(pending, deadLetterScanBatch)
+		if limit > 0 {
+			size = min(size, limit-len(letters))
+		}
+		batch, err := consumer.Fetch(size, jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			return letters, err
+		}
+		fetched := 0
+		for msg := range batch.Messages() {
+			fetched++
+			metadata, err := msg.Metadata()
+			if err != nil {
+				return letters, err
+			}
+			letter, err := readDeadLetter(msg.Data(), metadata.Sequence.Stream)
+			if err != nil {
+				return letters, err
+			}
+			letters = append(letters, letter)
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return letters, err
+		}
+		if fetched == 0 {
+			break // The remaining dead letters were removed meanwhile
+		}
+		pending -= fetched
+	}
+	return letters, nil
+}
+
+// readDeadLetter decodes the dead letter stored at a sequence
+func readDeadLetter(data []byte, sequence uint64) (DeadLetter, error) {
+	letter, err := utils.UnmarshalJSON[DeadLetter](data)
+	if err != nil {
+		return letter, fmt.Errorf("failed to read dead letter %d: %w", sequence, err)
+	}
+	letter.Sequence = sequence
+	return letter, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// rejectingSink refuses events containing "poison" until accepting is set
+type rejectingSink struct {
+	mutex     sync.Mutex
+	accepting bool
+	delivered []string
+}
+
+func (s *rejectingSink) Deliver(ctx context.Context, tableName string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if strings.Contains(string(data), "poison") && !s.accepting {
+		return fmt.Errorf("%w: payload rejected", ErrEventRefused)
+	}
+	s.delivered = append(s.delivered, string(data))
+	return nil
+}
+
+func (s *rejectingSink) events() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.delivered...)
+}
+
+// waitForEvents waits until the sink received n events
+func (s *rejectingSink) waitForEvents(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) && len(s.events()) < n {
+		time.Sleep(50 * time.Millisecond)
+	}
+	events := s.events()
+	if len(events) != n {
+		t.Fatalf("expected %d delivered events, got %v", n, events)
+	}
+	return events
+}
+
+func TestDeadLetters(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	fetcher := newTestEventFetcher(t, store, 1)
+	deadLetters, err := EnsureDeadLetterStream(context.TODO(), fetcher.js, config.DeadLetterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := NewDeadLetterAdmin(fetcher.conn, fetcher.js, deadLetters)
+	if err := admin.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, data := range []string{"poison", "healthy"} {
+		position := Position{LSN: []byte{byte(i + 1)}, SeqVal: []byte{1}, Operation: 2}
+		if err := fetcher.publishEvent(newEventMessage("inventory", "Cars", []byte(data), newTestChange(position, "1"), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := Position{LSN: []byte{2}}
+	if err := fetcher.StreamCheckpoint("Cars", last, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change that cannot be serialized is dead-lettered by the fetcher
+	if err := fetcher.publishDeadLetter(DeadLetter{TableName: "Persons", Source: DeadLetterSourceFetcher, Data: []byte("map[]"), Error: "unsupported value", Attempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refused event is dead-lettered after two attempts and no longer holds up the table
+	sink := &rejectingSink{}
+	publisher := NewPublisherWorker("TestPublisher", fetcher.conn, sink, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- publisher.Consume(ctx, fetcher.events, config.EventStreamConfig{}, "inventory", []string{"Cars", "Persons"})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	sink.waitForEvents(t, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if checkpoint, _ := store.Load(context.TODO(), "Cars"); checkpoint != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if checkpoint, _ := store.Load(context.TODO(), "Cars"); checkpoint == nil || comparePositions(checkpoint.Position(), last) != 0 {
+		t.Fatalf("expected checkpoint at %s past the dead letter, got %+v", last, checkpoint)
+	}
+
+	list := request[DeadLetterListResponse](t, fetcher.conn, topics.DeadLetters.List, DeadLetterListRequest{TableName: "Cars"})
+	if list.Error != "" || len(list.DeadLetters) != 1 {
+		t.Fatalf("expected one dead letter of table Cars, got %+v", list)
+	}
+	listed := list.DeadLetters[0]
+	if listed.Attempts != 2 || listed.Error != "event refused by the sink: payload rejected" || listed.Source != DeadLetterSourcePublisher || listed.Data != nil {
+		t.Fatalf("unexpected dead letter summary: %+v", listed)
+	}
+
+	inspected := request[DeadLetterInspectResponse](t, fetcher.conn, topics.DeadLetters.Inspect, DeadLetterInspectRequest{Sequence: listed.Sequence})
+	if inspected.DeadLetter == nil || string(inspected.DeadLetter.Data) != "poison" || inspected.DeadLetter.Headers[jetstream.MsgIDHeader] == "" {
+		t.Fatalf("expected the dead letter with its data and headers, got %+v", inspected)
+	}
+
+	// Once the sink accepts it, the replayed event is delivered and leaves the dead letter stream
+	sink.mutex.Lock()
+	sink.accepting = true
+	sink.mutex.Unlock()
+	replay := request[DeadLetterResponse](t, fetcher.conn, topics.DeadLetters.Replay, DeadLetterRequest{TableName: "Cars"})
+	if replay.Error != "" || replay.Count != 1 {
+		t.Fatalf("expected one replayed dead letter, got %+v", replay)
+	}
+	if events := sink.waitForEvents(t, 2); events[1] != "poison" {
+		t.Fatalf("expected the replayed event to be delivered, got %v", events)
+	}
+
+	// A change that was never serialized cannot be replayed, only purged
+	all := request[DeadLetterListResponse](t, fetcher.conn, topics.DeadLetters.List, DeadLetterListRequest{})
+	if len(all.DeadLetters) != 1 || all.DeadLetters[0].TableName != "Persons" {
+		t.Fatalf("expected only the dead letter of table Persons to remain, got %+v", all)
+	}
+	if resp := request[DeadLetterResponse](t, fetcher.conn, topics.DeadLetters.Replay, DeadLetterRequest{}); resp.Error != "" || resp.Count != 0 || resp.Skipped != 1 {
+		t.Fatalf("expected the unserialized change to be skipped, got %+v", resp)
+	}
+	if resp := request[DeadLetterResponse](t, fetcher.conn, topics.DeadLetters.Replay, DeadLetterRequest{Sequence: all.DeadLetters[0].Sequence}); resp.Error == "" {
+		t.Fatal("expected replaying an unserialized change to fail")
+	}
+	if resp := request[DeadLetterResponse](t, fetcher.conn, topics.DeadLetters.Purge, DeadLetterRequest{}); resp.Error != "" || resp.Count != 1 {
+		t.Fatalf("expected one purged dead letter, got %+v", resp)
+	}
+	if all := request[DeadLetterListResponse](t, fetcher.conn, topics.DeadLetters.List, DeadLetterListRequest{}); len(all.DeadLetters) != 0 {
+		t.Fatalf("expected no dead letters after the purge, got %+v", all)
+	}
+}
+
+func TestPublisherRetriesUnavailableSink(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	fetcher := newTestEventFetcher(t, store, 1)
+	deadLetters, err := EnsureDeadLetterStream(context.TODO(), fetcher.js, config.DeadLetterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewDeadLetterAdmin(fetcher.conn, fetcher.js, deadLetters).Start(); err != nil {
+		t.Fatal(err)
+	}
+	position := Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}
+	if err := fetcher.publishEvent(newEventMessage("inventory", "Cars", []byte("event"), newTestChange(position, "1"), 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sink is unavailable once; the event is retried rather than dead-lettered after one attempt
+	sink := &recordingSink{}
+	publisher := NewPublisherWorker("TestPublisher", fetcher.conn, sink, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- publisher.Consume(ctx, fetcher.events, config.EventStreamConfig{}, "inventory", []string{"Cars"})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) && len(sink.events()) == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := sink.events(); len(got) != 1 || got[0] != "Cars:event" {
+		t.Fatalf("expected the event delivered once the sink recovered, got %v", got)
+	}
+	if list := request[DeadLetterListResponse](t, fetcher.conn, topics.DeadLetters.List, DeadLetterListRequest{}); len(list.DeadLetters) != 0 {
+		t.Fatalf("expected no dead letters, got %+v", list)
+	}
+}
+
+func TestDeadLetterListFiltersTables(t *testing.T) {
+	fetcher := newTestEventFetcher(t, newMemoryCheckpointStore(), 1)
+	deadLetters, err := EnsureDeadLetterStream(context.TODO(), fetcher.js, config.DeadLetterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := NewDeadLetterAdmin(fetcher.conn, fetcher.js, deadLetters)
+	for _, table := range []string{"Cars", "Persons", "Cars", "Persons", "Cars"} {
+		if err := fetcher.publishDeadLetter(DeadLetter{TableName: table, Source: DeadLetterSourceFetcher, Error: "unsupported value", Attempts: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	persons, err := admin.List(context.TODO(), "Persons", 0)
+	if err != nil || len(persons) != 2 || persons[0].Sequence != 2 || persons[1].Sequence != 4 {
+		t.Fatalf("expected the dead letters of table Persons in order, got %+v %v", persons, err)
+	}
+	cars, err := admin.List(context.TODO(), "Cars", 2)
+	if err != nil || len(cars) != 2 || cars[0].Sequence != 1 || cars[1].Sequence != 3 {
+		t.Fatalf("expected the first two dead letters of table Cars, got %+v %v", cars, err)
+	}
+	if all, err := admin.List(context.TODO(), "", 0); err != nil || len(all) != 5 {
+		t.Fatalf("expected all dead letters, got %+v %v", all, err)
+	}
+}
@@ -4,6 +4,15 @@ db_type = "sqlserver"
 # Connection string for the database
 db_connection_string = "{{ env "DSTREAM_DB_CONNECTION_STRING" }}"
 
+# Table polled for incremental snapshot signals (optional)
+signal_table = "dstream_signals"
+
+# Identifies this instance in the checkpoint history (optional, defaults to hostname-pid)
+# instance_id = "dstream-1"
+
+# Deadline for stopping gracefully on SIGINT or SIGTERM (optional, defaults to 30s)
+shutdown_timeout = "30s"
+
 # Output configuration
 output {
     type = "servicebus"  # Possible values: "console", "eventhub", "servicebus"
@@ -12,9 +21,85 @@ output {
 
 # Lock configuration
 locks {
-    type = "azure_blob"  # Specifies the lock provider type
-    connection_string = "{{ env "DSTREAM_BLOB_CONNECTION_STRING" }}"  # Connection string to Azure Blob Storage
-    container_name = "locks"  # The name of the container used for lock files
+    type = "azure_blob"  # Possible values: "azure_blob", "sqlserver"
+    connection_string = "{{ env "DSTREAM_BLOB_CONNECTION_STRING" }}"  # Connection string to Azure Blob Storage (azure_blob)
+    container_name = "locks"  # The name of the container used for lock files (azure_blob)
+    # table_name = "instances"  # Table showing which instance holds each lock (sqlserver)
+    # schema = "dbo"  # Schema of the instances table (sqlserver)
+    lease_duration = "30s"  # How long a lock is held without renewal (15s to 60s for azure_blob)
+    capacity = 0  # Maximum number of tables this instance streams; 0 takes an even share of all tables
+}
+
+# Checkpoint configuration
+checkpoint {
+    type = "sqlserver"  # Possible values: "sqlserver", "file", "bolt", "jetstream", "azure_blob"
+    table_name = "cdc_offsets"  # Table that stores the last processed LSN per table (sqlserver)
+    schema = "dbo"  # Schema of the checkpoint table (sqlserver)
+    # path = "./checkpoints"  # Directory (file) or database file (bolt)
+    # bucket = "dstream_checkpoints"  # Key-value bucket (jetstream)
+    # history = 10  # Revisions kept per table (jetstream)
+    # prefix = "checkpoints/"  # Blob name prefix in the locks container (azure_blob)
+    history_size = 100  # Checkpoint updates kept per table for audit and rewind
+    flush_events = 1000  # Write a table's checkpoint after this many delivered events
+    flush_interval = "5s"  # Write pending checkpoints at least this often
+}
+
+# Embedded NATS server the components communicate over
+embedded_bus {
+    listen = "127.0.0.1:4222"  # Client address; use port -1 to pick a free port
+    in_process = false  # Connect in-process only, without a TCP listener
+    # max_payload = 1048576  # Largest message in bytes
+    # store_dir = "./data/jetstream/dstream-1"  # JetStream storage directory, defaults to data/jetstream/<instance_id or hostname>; must persist and not be shared between instances
+    logging = "off"  # Possible values: "off", "info", "debug", "trace"
+    # log_file = "nats.log"  # Write the server log to a file instead of stderr
+    ready_timeout = "10s"  # How long to wait for the server to accept connections
+}
+
+# External NATS cluster shared by dstream processes; replaces embedded_bus when present.
+# Run components separately with -role fetcher, -role checkpoint or -role publisher.
+# Checkpoint processes elect one active worker through the locks block, and every table partition is delivered
+# by one publisher process at a time; the others stand by.
+# external_bus {
+#     urls = ["nats://nats-1:4222", "nats://nats-2:4222"]
+#     creds_file = "/etc/dstream/dstream.creds"  # User credentials (JWT and NKey seed)
+#     nkey_seed_file = "/etc/dstream/dstream.nk"  # NKey seed for NKey authentication
+#     tls_ca_file = "/etc/dstream/ca.pem"  # CA used to verify the servers
+#     tls_cert_file = "/etc/dstream/client.pem"  # Client certificate for mutual TLS
+#     tls_key_file = "/etc/dstream/client-key.pem"  # Client key for mutual TLS
+#     reconnect_wait = "1s"  # First reconnect delay, doubled on every attempt
+#     max_reconnect_wait = "30s"  # Longest reconnect delay
+#     max_reconnects = 0  # Reconnect attempts before giving up, 0 for no limit
+# }
+
+# JetStream stream buffering change events until the publisher has delivered them. Events are stored per table
+# partition and republished to subscribers on subjects cdc.event.<db>.<schema>.<table>.<op>.
+event_stream {
+    name = "DSTREAM_EVENTS"
+    storage = "file"  # Possible values: "file", "memory"
+    max_age = "168h"  # Oldest event kept
+    max_bytes = 0  # Largest stream size in bytes; the fetcher waits when it is full. 0 for no limit
+    max_msgs = 0  # Most events kept, 0 for no limit
+    duplicate_window = "2m"  # Republished events within this window are dropped
+    ack_wait = "30s"  # Redeliver events not acknowledged by the publisher within this time
+    partitions = 1  # Partitions per table; events of a row stay in order within their partition. Drain the stream before changing
+    # workers = 4  # Table partitions each publisher process delivers in parallel; defaults to all of them
+    batch_size = 100  # Events taken from a table partition at once and delivered in order before they are acknowledged
+}
+
+# JetStream stream keeping events that failed delivery or serialization, on subjects cdc.dlq.<table>.
+# List, inspect, replay or purge them with requests on admin.dlq.list, admin.dlq.inspect, admin.dlq.replay
+# and admin.dlq.purge.
+dead_letter {
+    stream = "DSTREAM_DLQ"
+    max_attempts = 10  # Delivery attempts before an event the sink refuses is dead-lettered; other failures are retried until they succeed
+    max_age = "720h"  # Oldest dead letter kept
+}
+
+# Restarting tables whose streaming failed
+supervisor {
+    restart_interval = "1s"  # First delay before a failed table is restarted; doubles after every failure
+    max_restart_interval = "5m"
+    unhealthy_after = 5  # Consecutive failures before a table is reported unhealthy
 }
 
 # Table configurations with polling intervals
@@ -23,6 +108,10 @@ tables {
     name = "Cars"
     poll_interval = "5s"
     max_poll_interval = "2m"
+    transaction_markers = false  # Emit Begin/Commit events around each source transaction
+    snapshot = "initial"  # Possible values: "initial", "never", "when_needed"
+    snapshot_chunk_size = 1000  # Rows read per snapshot chunk
+    retention_gap_policy = "fail"  # Possible values: "fail", "skip", "snapshot"
 }
 
 tables {
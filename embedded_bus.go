@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/katasec/dstream/config"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// StartEmbeddedBus starts the embedded NATS server with JetStream enabled, waits until it accepts
+// connections and connects to it. In in-process mode the server has no TCP listener and the client
+// connects to it directly.
+func StartEmbeddedBus(c config.EmbeddedBusConfig) (*server.Server, *nats.Conn, error) {
+	opts, err := embeddedBusOptions(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	readyTimeout, err := c.GetReadyTimeout()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ready_timeout: %w", err)
+	}
+
+	natsServer, err := server.NewServer(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create embedded NATS server: %w", err)
+	}
+	if !opts.NoLog {
+		natsServer.ConfigureLogger()
+	}
+
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(readyTimeout) {
+		natsServer.Shutdown()
+		return nil, nil, fmt.Errorf("embedded NATS server not ready after %s", readyTimeout)
+	}
+
+	connectOpts := []nats.Option{nats.Name("dstream")}
+	if c.InProcess {
+		connectOpts = append(connectOpts, nats.InProcessServer(natsServer))
+	}
+	natsConn, err := nats.Connect(natsServer.ClientURL(), connectOpts...)
+	if err != nil {
+		natsServer.Shutdown()
+		return nil, nil, fmt.Errorf("failed to connect to embedded NATS server: %w", err)
+	}
+
+	if c.InProcess {
+		log.Printf("[EmbeddedBus] NATS server running in-process, JetStream store %s", opts.StoreDir)
+	} else {
+		log.Printf("[EmbeddedBus] NATS server listening on %s, JetStream store %s", natsServer.ClientURL(), opts.StoreDir)
+	}
+	return natsServer, natsConn, nil
+}
+
+// embeddedBusOptions builds the NATS server options from the embedded_bus block
+func embeddedBusOptions(c config.EmbeddedBusConfig) (*server.Options, error) {
+	host, port, err := c.GetListen()
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	opts := &server.Options{
+		ServerName: "dstream",
+		Host:       host,
+		Port:       port,
+		DontListen: c.InProcess,
+		MaxPayload: int32(c.MaxPayload),
+		JetStream:  true,
+		StoreDir:   c.GetStoreDir(),
+		LogFile:    c.LogFile,
+	}
+
+	switch strings.ToLower(c.Logging) {
+	case "", "off":
+		opts.NoLog = true
+	case "info":
+	case "debug":
+		opts.Debug = true
+	case "trace":
+		opts.Debug = true
+		opts.Trace = true
+	default:
+		return nil, fmt.Errorf("unknown embedded bus logging level: %s", c.Logging)
+	}
+	return opts, nil
+}
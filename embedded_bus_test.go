@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/katasec/dstream/config"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// startTestEmbeddedBus starts an embedded bus with the given configuration and a temporary JetStream store
+func startTestEmbeddedBus(t *testing.T, c config.EmbeddedBusConfig) *nats.Conn {
+	t.Helper()
+
+	c.StoreDir = t.TempDir()
+	natsServer, natsConn, err := StartEmbeddedBus(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		natsConn.Close()
+		natsServer.Shutdown()
+		natsServer.WaitForShutdown()
+	})
+	return natsConn
+}
+
+func TestEmbeddedBusInProcess(t *testing.T) {
+	nc := startTestEmbeddedBus(t, config.EmbeddedBusConfig{InProcess: true, MaxPayload: 64 * 1024})
+
+	if nc.MaxPayload() != 64*1024 {
+		t.Fatalf("expected max payload of 64KB, got %d", nc.MaxPayload())
+	}
+
+	// JetStream is available for the checkpoint store
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateKeyValue(context.TODO(), jetstream.KeyValueConfig{Bucket: "test"}); err != nil {
+		t.Fatalf("expected JetStream to be enabled: %v", err)
+	}
+}
+
+func TestEmbeddedBusRandomPorts(t *testing.T) {
+	// Two instances on one host do not collide when asking for free ports
+	first := startTestEmbeddedBus(t, config.EmbeddedBusConfig{Listen: "127.0.0.1:-1"})
+	second := startTestEmbeddedBus(t, config.EmbeddedBusConfig{Listen: "127.0.0.1:-1"})
+	if first.ConnectedUrl() == second.ConnectedUrl() {
+		t.Fatalf("expected different addresses, both connected to %s", first.ConnectedUrl())
+	}
+}
+
+func TestEmbeddedBusRejectsUnknownLogging(t *testing.T) {
+	if _, err := embeddedBusOptions(config.EmbeddedBusConfig{StoreDir: t.TempDir(), Logging: "verbose"}); err == nil {
+		t.Fatal("expected an error for an unknown logging level")
+	}
+}
+
+func TestEmbeddedBusStoreDir(t *testing.T) {
+	// Without store_dir every instance keeps its own store below the working directory
+	cfg := &config.Config{InstanceID: "dstream-1"}
+	if got, want := cfg.GetEmbeddedBusConfig().GetStoreDir(), filepath.Join("data", "jetstream", "dstream-1"); got != want {
+		t.Fatalf("GetStoreDir = %q, want %q", got, want)
+	}
+	cfg.EmbeddedBus = &config.EmbeddedBusConfig{StoreDir: "/var/lib/dstream"}
+	if got := cfg.GetEmbeddedBusConfig().GetStoreDir(); got != "/var/lib/dstream" {
+		t.Fatalf("expected the configured store directory, got %q", got)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// publisherConsumer prefixes the durable consumers publishers share to read the table partitions of the
+// event stream, see partitionConsumer
+const publisherConsumer = "dstream-publisher"
+
+// checkpointMarkerBucket is the key-value bucket recording which partitions reached a checkpoint marker
+const checkpointMarkerBucket = "dstream_checkpoint_markers"
+
+// Headers set on messages in the event stream
+const (
+	headerMessageType  = "Dstream-Type" // messageTypeCheckpoint on checkpoint markers, absent on change events
+	headerTableName    = "Dstream-Table"
+	headerPartition    = "Dstream-Partition"     // Partition of the message
+	headerPartitions   = "Dstream-Partitions"    // Partitions a checkpoint marker was copied to
+	headerCheckpointID = "Dstream-Checkpoint-Id" // Shared by the copies of a checkpoint marker, see checkpointMarkerID
+)
+
+// messageTypeCheckpoint marks a message whose body is a SaveLastLSNRequest. A copy is published to every
+// partition of the table, and the publisher saves it once every partition delivered the events before it.
+const messageTypeCheckpoint = "checkpoint"
+
+// EnsureEventStream creates the stream buffering change events between the fetcher and the publisher,
+// or updates its limits to the configured ones. Events are stored on subjects per table partition and
+// republished to subscribers on subjects per table and operation.
+// A full stream refuses new events, so the fetcher waits for the publisher instead of losing events.
+func EnsureEventStream(ctx context.Context, js jetstream.JetStream, c config.EventStreamConfig) (jetstream.Stream, error) {
+	streamConfig, err := eventStreamConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := js.CreateOrUpdateStream(ctx, streamConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event stream %s: %w", streamConfig.Name, err)
+	}
+	log.Printf("[EventStream] Using stream %s on subjects %s", streamConfig.Name, strings.Join(streamConfig.Subjects, ", "))
+	return stream, nil
+}
+
+// eventStreamConfig builds the stream configuration from the event_stream block
+func eventStreamConfig(c config.EventStreamConfig) (jetstream.StreamConfig, error) {
+	maxAge, err := c.GetMaxAge()
+	if err != nil {
+		return jetstream.StreamConfig{}, fmt.Errorf("invalid event_stream max_age: %w", err)
+	}
+	duplicateWindow, err := c.GetDuplicateWindow()
+	if err != nil {
+		return jetstream.StreamConfig{}, fmt.Errorf("invalid event_stream duplicate_window: %w", err)
+	}
+
+	storage := jetstream.FileStorage
+	switch strings.ToLower(c.Storage) {
+	case "", "file":
+	case "memory":
+		storage = jetstream.MemoryStorage
+	default:
+		return jetstream.StreamConfig{}, fmt.Errorf("unknown event_stream storage: %s", c.Storage)
+	}
+
+	source, destination := topics.PartitionRepublish()
+	streamConfig := jetstream.StreamConfig{
+		Name:       c.GetName(),
+		Subjects:   []string{topics.CDC.Partition + ".>"},
+		RePublish:  &jetstream.RePublish{Source: source, Destination: destination},
+		Retention:  jetstream.LimitsPolicy,
+		Storage:    storage,
+		Replicas:   c.Replicas,
+		MaxAge:     maxAge,
+		MaxBytes:   -1,
+		MaxMsgs:    -1,
+		Discard:    jetstream.DiscardNew,
+		Duplicates: duplicateWindow,
+	}
+	if c.MaxBytes > 0 {
+		streamConfig.MaxBytes = c.MaxBytes
+	}
+	if c.MaxMsgs > 0 {
+		streamConfig.MaxMsgs = c.MaxMsgs
+	}
+	return streamConfig, nil
+}
+
+// partitionSubject returns the subject an event of a table is stored on, e.g. cdc.partition.inventory.dbo.cars.0.insert
+func partitionSubject(database, tableName, op string, partition int) string {
+	schema, table := splitTableName(tableName)
+	return topics.PartitionSubject(database, schema, table, partition, op)
+}
+
+// tableEventFilter returns the subject matching every event and checkpoint marker of a table
+func tableEventFilter(database, tableName string) string {
+	schema, table := splitTableName(tableName)
+	return topics.PartitionFilter(database, schema, table, topics.AnyPartition)
+}
+
+// partitionFilter returns the subject matching the events and checkpoint markers of a table partition
+func partitionFilter(database, tableName string, partition int) string {
+	schema, table := splitTableName(tableName)
+	return topics.PartitionFilter(database, schema, table, partition)
+}
+
+// partitionConsumer returns the name of the durable consumer reading a table partition, e.g.
+// dstream-publisher-inventory-dbo-cars-0
+func partitionConsumer(database, tableName string, partition int) string {
+	schema, table := splitTableName(tableName)
+	return fmt.Sprintf("%s-%s-%s-%s-%d", publisherConsumer, topics.Token(database), topics.Token(schema), topics.Token(table), partition)
+}
+
+// eventPartition returns the partition of a change event, chosen by hashing its primary key values so
+// that all events of a row share a partition. Events without row data, such as transaction markers,
+// and events of tables without a primary key go to partition 0.
+func eventPartition(change map[string]interface{}, keyColumns []string, partitions int) int {
+	data, ok := change["data"].(map[string]interface{})
+	if !ok || len(keyColumns) == 0 || partitions <= 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(rowKey(data, keyColumns)))
+	return int(hash.Sum32() % uint32(partitions))
+}
+
+// newEventMessage builds the stream message of a change event, stored on the subject of its table,
+// partition and operation. Events with a position carry a message id, so an event published again after
+// a failed publish acknowledgement is stored only once.
+func newEventMessage(database, tableName string, data []byte, change map[string]interface{}, partition int) *nats.Msg {
+	var op string
+	if metadata := changeMetadata(change); metadata != nil {
+		op, _ = metadata["OperationType"].(string)
+	}
+	msg := nats.NewMsg(partitionSubject(database, tableName, op, partition))
+	msg.Data = data
+	msg.Header.Set(headerTableName, tableName)
+	msg.Header.Set(headerPartition, strconv.Itoa(partition))
+	if position, ok := changePosition(change); ok {
+		msg.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s:%s", tableName, position))
+	}
+	return msg
+}
+
+// newCheckpointMessages builds a copy of a checkpoint marker for every partition, published on the
+// table's subjects with the operation token "checkpoint". Copies published again after a failed
+// publish are stored only once.
+func newCheckpointMessages(database string, req SaveLastLSNRequest, partitions int) []*nats.Msg {
+	data, _ := json.Marshal(req)
+	id := checkpointMarkerID(req)
+	msgs := make([]*nats.Msg, partitions)
+	for partition := range msgs {
+		msg := nats.NewMsg(partitionSubject(database, req.TableName, messageTypeCheckpoint, partition))
+		msg.Data = data
+		msg.Header.Set(headerMessageType, messageTypeCheckpoint)
+		msg.Header.Set(headerTableName, req.TableName)
+		msg.Header.Set(headerPartition, strconv.Itoa(partition))
+		msg.Header.Set(headerPartitions, strconv.Itoa(partitions))
+		msg.Header.Set(headerCheckpointID, id)
+		msg.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s.%d", id, partition))
+		msgs[partition] = msg
+	}
+	return msgs
+}
+
+// checkpointMarkerID identifies a checkpoint marker by table, position and fencing token. Markers with
+// equal ids save the same checkpoint, so it does not matter which of them completes.
+func checkpointMarkerID(req SaveLastLSNRequest) string {
+	return fmt.Sprintf("%s.l%x.s%x.o%d.t%d", checkpointKey(req.TableName), req.LastLSN, req.LastSeqVal, req.LastOperation, req.FencingToken)
+}
+
+// EnsureCheckpointMarkerBucket creates the bucket recording which partitions reached a checkpoint marker.
+// Entries of markers that were never completed, e.g. because they were purged, expire after ttl.
+func EnsureCheckpointMarkerBucket(ctx context.Context, js jetstream.JetStream, ttl time.Duration) (jetstream.KeyValue, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: checkpointMarkerBucket, TTL: ttl})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint marker bucket: %w", err)
+	}
+	return kv, nil
+}
+
+// reachCheckpoint records that a partition reached a copy of a checkpoint marker and reports whether
+// every partition has now reached it
+func reachCheckpoint(ctx context.Context, kv jetstream.KeyValue, id string, partition, partitions int) (bool, error) {
+	if partitions <= 1 {
+		return true, nil
+	}
+	for {
+		var reached []int
+		var err error
+		entry, getErr := kv.Get(ctx, id)
+		switch {
+		case errors.Is(getErr, jetstream.ErrKeyNotFound):
+			reached = []int{partition}
+			data, _ := json.Marshal(reached)
+			_, err = kv.Create(ctx, id, data)
+		case getErr != nil:
+			return false, getErr
+		default:
+			if err := json.Unmarshal(entry.Value(), &reached); err != nil {
+				return false, err
+			}
+			if slices.Contains(reached, partition) {
+				return len(reached) == partitions, nil
+			}
+			reached = append(reached, partition)
+			data, _ := json.Marshal(reached)
+			_, err = kv.Update(ctx, id, data, entry.Revision())
+		}
+
+		if isRevisionConflict(err) {
+			continue // Another partition recorded the marker at the same time
+		}
+		if err != nil {
+			return false, err
+		}
+		return len(reached) == partitions, nil
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// recordingSink records delivered events per table and fails the first delivery
+type recordingSink struct {
+	mutex     sync.Mutex
+	delivered []string
+	failed    bool
+}
+
+func (s *recordingSink) Deliver(ctx context.Context, tableName string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.failed {
+		s.failed = true
+		return errors.New("sink unavailable")
+	}
+	s.delivered = append(s.delivered, tableName+":"+string(data))
+	return nil
+}
+
+func (s *recordingSink) events() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.delivered...)
+}
+
+// newTestEventFetcher starts an embedded bus with a checkpoint worker and an in-memory event stream,
+// and returns a fetcher publishing to it with the given number of partitions
+func newTestEventFetcher(t *testing.T, store CheckpointStore, partitions int) *ChangeDataFetcher {
+	t.Helper()
+
+	nc := startTestEmbeddedBus(t, config.EmbeddedBusConfig{InProcess: true})
+	if err := NewCheckpointWorker(store, nc, 3, FlushPolicy{}).Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := EnsureEventStream(context.TODO(), js, config.EventStreamConfig{Storage: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewChangeDataFetcher("TestFetcher", nc, js, events, nil, "inventory", partitions, "", "test")
+}
+
+func TestPublisherSavesCheckpointsAfterDelivery(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	fetcher := newTestEventFetcher(t, store, 1)
+
+	first := Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}
+	second := Position{LSN: []byte{2}, SeqVal: []byte{1}, Operation: 2}
+	publish := func(data string, position Position) {
+		t.Helper()
+		if err := fetcher.publishEvent(newEventMessage("inventory", "Cars", []byte(data), newTestChange(position, "1"), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("first", first)
+	publish("first", first) // Republished after a lost publish acknowledgement; stored once
+	publish("second", second)
+	if err := fetcher.StreamCheckpoint("Cars", second, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// An instance fenced off the table cannot stream further checkpoints
+	store.Save(context.TODO(), Checkpoint{TableName: "Persons", FencingToken: 5})
+	if err := fetcher.StreamCheckpoint("Persons", first, 1, 4); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected the stale token to be refused, got %v", err)
+	}
+
+	// A checkpoint it streamed before it was fenced off is dropped without blocking the stream
+	for _, msg := range newCheckpointMessages("inventory", fetcher.saveRequest("Persons", first, 1, 4), 1) {
+		if err := fetcher.publishEvent(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink := &recordingSink{}
+	publisher := NewPublisherWorker("TestPublisher", fetcher.conn, sink, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- publisher.Consume(ctx, fetcher.events, config.EventStreamConfig{}, "inventory", []string{"Cars", "Persons"})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if checkpoint, _ := store.Load(context.TODO(), "Cars"); checkpoint != nil && checkpoint.LastLSN != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	checkpoint, _ := store.Load(context.TODO(), "Cars")
+	if checkpoint == nil || comparePositions(checkpoint.Position(), second) != 0 {
+		t.Fatalf("expected checkpoint at %s, got %+v", second, checkpoint)
+	}
+	if got := sink.events(); len(got) != 2 || got[0] != "Cars:first" || got[1] != "Cars:second" {
+		t.Fatalf("expected both events delivered once and in order before the checkpoint, got %v", got)
+	}
+	if persons, _ := store.Load(context.TODO(), "Persons"); persons.LastLSN != nil {
+		t.Fatalf("expected the fenced checkpoint to be dropped, got %+v", persons)
+	}
+}
+
+func TestPublisherPartitions(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	fetcher := newTestEventFetcher(t, store, 3)
+	keyColumns := []string{"ID"}
+
+	// Three updates each of several rows, spread over the partitions by key
+	for version := 0; version < 3; version++ {
+		for id := 0; id < 6; id++ {
+			change := map[string]interface{}{"data": map[string]interface{}{"ID": id}}
+			data := fmt.Sprintf("%d-%d", id, version)
+			msg := newEventMessage("inventory", "Cars", []byte(data), change, eventPartition(change, keyColumns, 3))
+			if err := fetcher.publishEvent(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	last := Position{LSN: []byte{9}}
+	if err := fetcher.StreamCheckpoint("Cars", last, 18, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two publisher processes share the table partitions, each delivered by the process holding its lock
+	sink := &recordingSink{failed: true}
+	locks := newMemoryLockProvider(3 * time.Second)
+	for _, name := range []string{"first", "second"} {
+		publisher := NewPublisherWorker(name, fetcher.conn, sink, 10)
+		publisher.Locks = locks
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- publisher.Consume(ctx, fetcher.events, config.EventStreamConfig{Partitions: 3, Workers: 2, BatchSize: 4}, "inventory", []string{"Cars"})
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if checkpoint, _ := store.Load(context.TODO(), "Cars"); checkpoint != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if checkpoint, _ := store.Load(context.TODO(), "Cars"); checkpoint == nil || comparePositions(checkpoint.Position(), last) != 0 {
+		t.Fatalf("expected checkpoint at %s once all partitions reached it, got %+v", last, checkpoint)
+	}
+
+	// Every event was delivered once before the checkpoint, and the updates of a row in order
+	events := sink.events()
+	if len(events) != 18 {
+		t.Fatalf("expected 18 events, got %d: %v", len(events), events)
+	}
+	versions := map[string]int{}
+	for _, event := range events {
+		var id string
+		var version int
+		fmt.Sscanf(strings.TrimPrefix(event, "Cars:"), "%1s-%d", &id, &version)
+		if version != versions[id] {
+			t.Fatalf("expected version %d of row %s, got %s in %v", versions[id], id, event, events)
+		}
+		versions[id]++
+	}
+}
+
+func TestPublisherTablesDoNotBlockEachOther(t *testing.T) {
+	fetcher := newTestEventFetcher(t, newMemoryCheckpointStore(), 1)
+	for i, table := range []string{"Persons", "Cars", "Cars"} {
+		change := newTestChange(Position{LSN: []byte{byte(i + 1)}, SeqVal: []byte{1}, Operation: 2}, "1")
+		if err := fetcher.publishEvent(newEventMessage("inventory", table, []byte(fmt.Sprintf("poison-%d", i)), change, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Persons keeps failing and is never dead-lettered, while the events of Cars are delivered
+	sink := &rejectingSink{}
+	publisher := NewPublisherWorker("TestPublisher", fetcher.conn, tableSink{"Cars": &recordingSink{failed: true}, "Persons": sink}, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- publisher.Consume(ctx, fetcher.events, config.EventStreamConfig{}, "inventory", []string{"Persons", "Cars"})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	cars := publisher.Sink.(tableSink)["Cars"].(*recordingSink)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) && len(cars.events()) < 2 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := cars.events(); len(got) != 2 || got[0] != "Cars:poison-1" || got[1] != "Cars:poison-2" {
+		t.Fatalf("expected the events of Cars delivered in order, got %v", got)
+	}
+	if got := sink.events(); len(got) != 0 {
+		t.Fatalf("expected Persons to be held up, got %v", got)
+	}
+}
+
+// tableSink delivers the events of each table to its own sink
+type tableSink map[string]Sink
+
+func (s tableSink) Deliver(ctx context.Context, tableName string, data []byte) error {
+	return s[tableName].Deliver(ctx, tableName, data)
+}
+
+func TestPurgeEvents(t *testing.T) {
+	fetcher := newTestEventFetcher(t, newMemoryCheckpointStore(), 2)
+
+	for _, table := range []string{"Cars", "Persons"} {
+		if err := fetcher.StreamCheckpoint(table, Position{LSN: []byte{1}}, 0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fetcher.PurgeEvents(context.TODO(), "Cars"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fetcher.events.Info(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 2 {
+		t.Fatalf("expected only the other table's marker copies to remain, got %d", info.State.Msgs)
+	}
+}
+
+func TestEventStreamConfig(t *testing.T) {
+	streamConfig, err := eventStreamConfig(config.EventStreamConfig{MaxBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamConfig.Storage != jetstream.FileStorage || streamConfig.Discard != jetstream.DiscardNew {
+		t.Fatalf("expected file storage refusing new events when full, got %+v", streamConfig)
+	}
+	if streamConfig.MaxBytes != 1024 || streamConfig.MaxMsgs != -1 {
+		t.Fatalf("expected a byte limit only, got max_bytes %d, max_msgs %d", streamConfig.MaxBytes, streamConfig.MaxMsgs)
+	}
+
+	if _, err := eventStreamConfig(config.EventStreamConfig{Storage: "disk"}); err == nil {
+		t.Fatal("expected an error for an unknown storage type")
+	}
+}
+
+func TestEventSubjects(t *testing.T) {
+	if got, want := topics.EventSubject("inventory", "sales", "Order Lines", "Insert"), "cdc.event.inventory.sales.order_lines.insert"; got != want {
+		t.Fatalf("EventSubject = %q, want %q", got, want)
+	}
+	if got, want := partitionSubject("inventory", "Cars", "", 3), "cdc.partition.inventory.dbo.cars.3.unknown"; got != want {
+		t.Fatalf("partitionSubject = %q, want %q", got, want)
+	}
+	if got, want := topics.EventFilter("inventory", "", "", "Delete"), "cdc.event.inventory.*.*.delete"; got != want {
+		t.Fatalf("EventFilter = %q, want %q", got, want)
+	}
+	if got, want := topics.PartitionFilter("inventory", "dbo", "Cars", 2), "cdc.partition.inventory.dbo.cars.2.*"; got != want {
+		t.Fatalf("PartitionFilter = %q, want %q", got, want)
+	}
+	if got, want := tableEventFilter("inventory", "sales.Orders"), "cdc.partition.inventory.sales.orders.*.*"; got != want {
+		t.Fatalf("tableEventFilter = %q, want %q", got, want)
+	}
+
+	// The database and table tokens match the sink topic names
+	connectionString := "sqlserver://localhost?database=Inventory"
+	db, schema, table, op, ok := topics.ParseEventSubject(topics.EventSubject(config.DatabaseName(connectionString), "dbo", "Cars", "Update"))
+	if !ok || schema != "dbo" || op != "update" {
+		t.Fatalf("failed to parse event subject: %s %s %s %s %v", db, schema, table, op, ok)
+	}
+	if got := fmt.Sprintf("%s-%s-events", db, table); got != config.GenTopicName(connectionString, "Cars") {
+		t.Fatalf("expected subject tokens to match topic %s, got %s", config.GenTopicName(connectionString, "Cars"), got)
+	}
+
+	if _, _, _, _, ok := topics.ParseEventSubject("cdc.schema"); ok {
+		t.Fatal("expected a schema subject not to parse as an event subject")
+	}
+	if _, _, _, _, ok := topics.ParseEventSubject(partitionSubject("inventory", "Cars", "insert", 0)); ok {
+		t.Fatal("expected a partition subject not to parse as an event subject")
+	}
+}
+
+func TestEventsRepublishedOnEventSubjects(t *testing.T) {
+	fetcher := newTestEventFetcher(t, newMemoryCheckpointStore(), 4)
+
+	sub, err := fetcher.conn.SubscribeSync(topics.EventFilter("inventory", "", "Cars", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}, "1")
+	changeMetadata(change)["OperationType"] = "Insert"
+	if err := fetcher.publishEvent(newEventMessage("inventory", "Cars", []byte("event"), change, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "cdc.event.inventory.dbo.cars.insert" || string(msg.Data) != "event" {
+		t.Fatalf("expected the event on its event subject, got %s: %s", msg.Subject, msg.Data)
+	}
+	if got := msg.Header.Get(headerPartition); got != "3" {
+		t.Fatalf("expected the partition in a header, got %q", got)
+	}
+}
+
+func TestWaitForPosition(t *testing.T) {
+	store := newMemoryCheckpointStore()
+	fetcher := newTestEventFetcher(t, store, 1)
+	handoff := Position{LSN: []byte{5}}
+	if err := fetcher.StreamCheckpoint("Cars", handoff, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handoff is not saved before a publisher delivered the stream up to it
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := fetcher.waitForPosition(ctx, "Cars", handoff); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for the publisher, got %v", err)
+	}
+
+	publisher := NewPublisherWorker("TestPublisher", fetcher.conn, &recordingSink{failed: true}, 10)
+	consumeCtx, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- publisher.Consume(consumeCtx, fetcher.events, config.EventStreamConfig{}, "inventory", []string{"Cars"})
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer waitCancel()
+	if err := fetcher.waitForPosition(waitCtx, "Cars", handoff); err != nil {
+		t.Fatal(err)
+	}
+}
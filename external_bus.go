@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/nats-io/nats.go"
+)
+
+// ConnectExternalBus connects to an external NATS cluster. The connection reconnects on its own,
+// waiting twice as long after every failed attempt up to the configured maximum.
+func ConnectExternalBus(c config.ExternalBusConfig, name string) (*nats.Conn, error) {
+	opts, err := externalBusOptions(c, name)
+	if err != nil {
+		return nil, err
+	}
+
+	natsConn, err := nats.Connect(strings.Join(c.URLs, ","), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS cluster %s: %w", strings.Join(c.URLs, ","), err)
+	}
+	log.Printf("[ExternalBus] Connected to NATS server %s", natsConn.ConnectedUrlRedacted())
+	return natsConn, nil
+}
+
+// externalBusOptions builds the connection options from the external_bus block
+func externalBusOptions(c config.ExternalBusConfig, name string) ([]nats.Option, error) {
+	if len(c.URLs) == 0 {
+		return nil, fmt.Errorf("external_bus requires at least one URL")
+	}
+	reconnectWait, err := c.GetReconnectWait()
+	if err != nil {
+		return nil, fmt.Errorf("invalid reconnect_wait: %w", err)
+	}
+	maxReconnectWait, err := c.GetMaxReconnectWait()
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_reconnect_wait: %w", err)
+	}
+	maxReconnects := c.MaxReconnects
+	if maxReconnects <= 0 {
+		maxReconnects = -1
+	}
+
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(maxReconnects),
+		nats.CustomReconnectDelay(reconnectDelay(reconnectWait, maxReconnectWait)),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("[ExternalBus] Disconnected from NATS: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("[ExternalBus] Reconnected to NATS server %s", nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(_ *nats.Conn) {
+			log.Printf("[ExternalBus] NATS connection closed")
+		}),
+	}
+
+	if c.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(c.CredsFile))
+	}
+	if c.NKeySeedFile != "" {
+		nkey, err := nats.NkeyOptionFromSeed(c.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load NKey seed: %w", err)
+		}
+		opts = append(opts, nkey)
+	}
+	if c.TLSCAFile != "" {
+		opts = append(opts, nats.RootCAs(c.TLSCAFile))
+	}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		opts = append(opts, nats.ClientCert(c.TLSCertFile, c.TLSKeyFile))
+	}
+	return opts, nil
+}
+
+// reconnectDelay returns a reconnect delay function doubling the delay with every attempt, capped at maxWait
+func reconnectDelay(wait, maxWait time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		delay := wait
+		for i := 1; i < attempts && delay < maxWait; i++ {
+			delay *= 2
+		}
+		if delay > maxWait {
+			delay = maxWait
+		}
+		return delay
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/nats-io/nats-server/v2/test"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	delay := reconnectDelay(time.Second, 10*time.Second)
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 50: 10 * time.Second} {
+		if got := delay(attempts); got != want {
+			t.Errorf("delay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestConnectExternalBus(t *testing.T) {
+	natsServer := test.RunRandClientPortServer()
+	defer natsServer.Shutdown()
+
+	nc, err := ConnectExternalBus(config.ExternalBusConfig{URLs: []string{"nats://127.0.0.1:1", natsServer.ClientURL()}}, "dstream-test")
+	if err != nil {
+		t.Fatalf("expected to connect to one of the URLs: %v", err)
+	}
+	defer nc.Close()
+	if nc.ConnectedUrl() != natsServer.ClientURL() {
+		t.Fatalf("expected to connect to %s, got %s", natsServer.ClientURL(), nc.ConnectedUrl())
+	}
+}
+
+func TestExternalBusRequiresURLs(t *testing.T) {
+	if _, err := externalBusOptions(config.ExternalBusConfig{}, "dstream-test"); err == nil {
+		t.Fatal("expected an error without URLs")
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles("fetcher, Checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !roles.Has(RoleFetcher) || !roles.Has(RoleCheckpoint) || roles.Has(RolePublisher) {
+		t.Fatalf("unexpected roles: %s", roles)
+	}
+
+	roles, err = ParseRoles(RoleAll)
+	if err != nil || roles.String() != "checkpoint,fetcher,publisher" {
+		t.Fatalf("expected all roles, got %s (%v)", roles, err)
+	}
+
+	if _, err := ParseRoles("sink"); err == nil {
+		t.Fatal("expected an error for an unknown role")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/katasec/dstream/topics"
+	"github.com/katasec/dstream/utils"
+	"github.com/nats-io/nats.go"
+)
+
+// SignalTypeSnapshot is the signal table type that requests an incremental snapshot
+const SignalTypeSnapshot = "snapshot"
+
+// adminRequestTimeout bounds the database and stream work done for an admin request
+const adminRequestTimeout = 10 * time.Second
+
+// SnapshotStatusResponse is the reply to admin snapshot trigger and status requests
+type SnapshotStatusResponse struct {
+	TableName string            `json:"table_name"`
+	Progress  *SnapshotProgress `json:"progress,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// snapshotChunk holds a chunk read between a low and high watermark, waiting to be merged with CDC events
+type snapshotChunk struct {
+	keyColumns []string
+	lowLSN     []byte
+	highLSN    []byte
+	events     []map[string]interface{}
+	lastKey    []SnapshotKey
+}
+
+// initializeSignalTable creates the signal table used to request incremental snapshots if it does not exist.
+// Insert a row with type 'snapshot' and the table name to trigger a snapshot of that table.
+func initializeSignalTable(ctx context.Context, db *sql.DB, signalTable string) error {
+	query := fmt.Sprintf(`
+    IF OBJECT_ID(N'%[1]s', N'U') IS NULL
+    BEGIN
+        CREATE TABLE %[1]s (
+            id BIGINT IDENTITY PRIMARY KEY,
+            type NVARCHAR(50) NOT NULL,
+            table_name NVARCHAR(255) NOT NULL,
+            created_at DATETIME DEFAULT GETDATE(),
+            processed_at DATETIME NULL
+        );
+    END`, quoteTableName(signalTable))
+
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create signal table %s: %w", signalTable, err)
+	}
+	return nil
+}
+
+// subscribeAdmin registers the monitor's admin handlers and returns their subscriptions
+func (m *SQLServerTableMonitor) subscribeAdmin() ([]*nats.Subscription, error) {
+	return utils.SubscribeAll("SQLServerTableMonitor", m.natsConn, "", map[string]nats.MsgHandler{
+		topics.Admin.SnapshotTrigger + "." + m.tableName: m.snapshotTriggerHandler,
+		topics.Admin.SnapshotStatus + "." + m.tableName:  m.snapshotStatusHandler,
+		topics.Admin.Rewind + "." + m.tableName:          m.rewindHandler,
+	})
+}
+
+// snapshotTriggerHandler A handler for topics.Admin.SnapshotTrigger requests
+func (m *SQLServerTableMonitor) snapshotTriggerHandler(msg *nats.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+
+	resp := SnapshotStatusResponse{TableName: m.tableName}
+	if err := m.TriggerIncrementalSnapshot(ctx); err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Progress = m.IncrementalSnapshotProgress()
+
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("Failed to respond to snapshot trigger for table %s: %v", m.tableName, err)
+	}
+}
+
+// snapshotStatusHandler A handler for topics.Admin.SnapshotStatus requests
+func (m *SQLServerTableMonitor) snapshotStatusHandler(msg *nats.Msg) {
+	resp := SnapshotStatusResponse{TableName: m.tableName, Progress: m.IncrementalSnapshotProgress()}
+	respData, _ := json.Marshal(resp)
+	if err := msg.Respond(respData); err != nil {
+		log.Printf("Failed to respond to snapshot status for table %s: %v", m.tableName, err)
+	}
+}
+
+// TriggerIncrementalSnapshot schedules an incremental snapshot of the table. Chunks are read between
+// polls and interleaved with live changes, so streaming continues while the snapshot runs.
+// Tables whose primary key cannot be paged through are refused.
+func (m *SQLServerTableMonitor) TriggerIncrementalSnapshot(ctx context.Context) error {
+	keyColumns, err := fetchPrimaryKeyColumns(ctx, m.dbConn, m.tableName)
+	if err != nil {
+		return err
+	}
+	if len(keyColumns) == 0 {
+		return fmt.Errorf("table %s has no primary key; cannot snapshot", m.tableName)
+	}
+	if _, err := fetchKeyColumnTypes(ctx, m.dbConn, m.tableName, keyColumns); err != nil {
+		return err
+	}
+
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+
+	if m.incremental != nil && m.incremental.Status == SnapshotStatusRunning {
+		return fmt.Errorf("an incremental snapshot of table %s is already running", m.tableName)
+	}
+
+	now := time.Now().UTC()
+	m.incremental = &SnapshotProgress{
+		Status:      SnapshotStatusRunning,
+		Incremental: true,
+		StartedAt:   now,
+		UpdatedAt:   now,
+	}
+	log.Printf("Incremental snapshot of table %s triggered", m.tableName)
+	return m.saveSnapshotProgress(*m.incremental)
+}
+
+// IncrementalSnapshotProgress returns a copy of the current incremental snapshot progress, if any
+func (m *SQLServerTableMonitor) IncrementalSnapshotProgress() *SnapshotProgress {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+
+	if m.incremental == nil {
+		return nil
+	}
+	progress := *m.incremental
+	return &progress
+}
+
+// checkSignals triggers an incremental snapshot when an unprocessed snapshot signal exists for the table
+func (m *SQLServerTableMonitor) checkSignals(ctx context.Context) error {
+	if m.signalTable == "" {
+		return nil
+	}
+
+	query := fmt.Sprintf(`
+        UPDATE s SET processed_at = GETDATE()
+        OUTPUT inserted.id
+        FROM %s AS s
+        WHERE s.processed_at IS NULL AND s.type = @type AND s.table_name = @tableName
+    `, quoteTableName(m.signalTable))
+
+	rows, err := m.dbConn.QueryContext(ctx, query, sql.Named("type", SignalTypeSnapshot), sql.Named("tableName", m.tableName))
+	if err != nil {
+		return fmt.Errorf("failed to read signals for %s: %w", m.tableName, err)
+	}
+	defer rows.Close()
+
+	signalled := false
+	for rows.Next() {
+		signalled = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if signalled {
+		if err := m.TriggerIncrementalSnapshot(ctx); err != nil {
+			log.Printf("Ignoring snapshot signal for table %s: %v", m.tableName, err)
+		}
+	}
+	return nil
+}
+
+// readIncrementalChunk reads the next incremental snapshot chunk between a low and high watermark.
+// It returns nil when no incremental snapshot is running.
+func (m *SQLServerTableMonitor) readIncrementalChunk(ctx context.Context) (*snapshotChunk, error) {
+	progress := m.IncrementalSnapshotProgress()
+	if progress == nil || progress.Status != SnapshotStatusRunning {
+		return nil, nil
+	}
+
+	keyColumns, err := fetchPrimaryKeyColumns(ctx, m.dbConn, m.tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyColumns) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key; cannot snapshot", m.tableName)
+	}
+	keyTypes, err := fetchKeyColumnTypes(ctx, m.dbConn, m.tableName, keyColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	lowLSN, err := fetchMaxLSN(ctx, m.dbConn)
+	if err != nil {
+		return nil, err
+	}
+	events, lastKey, err := m.fetchSnapshotChunk(ctx, keyColumns, keyTypes, progress.LastKey, m.tableConfig.GetSnapshotChunkSize(), lowLSN)
+	if err != nil {
+		return nil, err
+	}
+	highLSN, err := fetchMaxLSN(ctx, m.dbConn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		metadata := changeMetadata(event)
+		metadata["LSN"] = hex.EncodeToString(highLSN)
+		metadata["Incremental"] = true
+	}
+
+	return &snapshotChunk{
+		keyColumns: keyColumns,
+		lowLSN:     lowLSN,
+		highLSN:    highLSN,
+		events:     events,
+		lastKey:    lastKey,
+	}, nil
+}
+
+// interleave merges the chunk into an ordered list of CDC changes. Chunk rows whose key changed
+// between the low and high watermark are dropped since the CDC event is at least as new, and the
+// remaining rows are placed after all changes up to the high watermark.
+func (c *snapshotChunk) interleave(changes []map[string]interface{}) []map[string]interface{} {
+	merged := make([]map[string]interface{}, 0, len(changes)+len(c.events))
+	changedKeys := map[string]bool{}
+	inserted := false
+
+	for _, change := range changes {
+		lsn, _ := hex.DecodeString(fmt.Sprint(changeMetadata(change)["LSN"]))
+
+		if !inserted && bytes.Compare(lsn, c.highLSN) > 0 {
+			merged = append(merged, c.remaining(changedKeys)...)
+			inserted = true
+		}
+		if data, ok := change["data"].(map[string]interface{}); ok && bytes.Compare(lsn, c.lowLSN) > 0 && bytes.Compare(lsn, c.highLSN) <= 0 {
+			changedKeys[rowKey(data, c.keyColumns)] = true
+		}
+		merged = append(merged, change)
+	}
+
+	if !inserted {
+		merged = append(merged, c.remaining(changedKeys)...)
+	}
+	return merged
+}
+
+// remaining returns the chunk rows whose keys were not changed inside the watermark window
+func (c *snapshotChunk) remaining(changedKeys map[string]bool) []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, event := range c.events {
+		data, _ := event["data"].(map[string]interface{})
+		if !changedKeys[rowKey(data, c.keyColumns)] {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// completeIncrementalChunk records the chunk in the snapshot progress and finishes the snapshot after the last chunk
+func (m *SQLServerTableMonitor) completeIncrementalChunk(chunk *snapshotChunk) error {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+
+	if len(chunk.events) > 0 {
+		m.incremental.LastKey = chunk.lastKey
+		m.incremental.RowsRead += int64(len(chunk.events))
+	}
+	if len(chunk.events) < m.tableConfig.GetSnapshotChunkSize() {
+		m.incremental.Status = SnapshotStatusCompleted
+		log.Printf("Incremental snapshot of table %s completed after %d rows", m.tableName, m.incremental.RowsRead)
+	}
+	m.incremental.UpdatedAt = time.Now().UTC()
+
+	return m.saveSnapshotProgress(*m.incremental)
+}
+
+// rowKey builds a comparable key from the primary key values of a row
+func rowKey(data map[string]interface{}, keyColumns []string) string {
+	values := make([]string, len(keyColumns))
+	for i, col := range keyColumns {
+		values[i] = fmt.Sprint(data[col])
+	}
+	return strings.Join(values, "\x00")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// newTestSnapshotRow builds the Read event a snapshot chunk read at lsn makes for the row with the given ID
+func newTestSnapshotRow(lsn byte, id string) map[string]interface{} {
+	return newSnapshotEvent([]byte{lsn}, []string{"ID"}, []interface{}{&sql.NullString{String: id, Valid: true}})
+}
+
+func TestSnapshotChunkInterleave(t *testing.T) {
+	chunk := &snapshotChunk{
+		keyColumns: []string{"ID"},
+		lowLSN:     []byte{0x10},
+		highLSN:    []byte{0x20},
+		events: []map[string]interface{}{
+			newTestSnapshotRow(0x20, "1"),
+			newTestSnapshotRow(0x20, "2"),
+			newTestSnapshotRow(0x20, "3"),
+		},
+	}
+	changes := []map[string]interface{}{
+		newTestChange(Position{LSN: []byte{0x05}, SeqVal: []byte{1}, Operation: 4}, "1"), // before the window: snapshot row is newer
+		newTestChange(Position{LSN: []byte{0x15}, SeqVal: []byte{1}, Operation: 4}, "2"), // inside the window: snapshot row is dropped
+		newTestChange(Position{LSN: []byte{0x25}, SeqVal: []byte{1}, Operation: 4}, "3"), // after the window: snapshot row goes first
+	}
+
+	merged := chunk.interleave(changes)
+
+	expected := []struct{ op, id string }{
+		{"Update", "1"}, {"Update", "2"}, {OperationTypeRead, "1"}, {OperationTypeRead, "3"}, {"Update", "3"},
+	}
+	if len(merged) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(merged))
+	}
+	for i, e := range expected {
+		op := changeMetadata(merged[i])["OperationType"]
+		id := merged[i]["data"].(map[string]interface{})["ID"]
+		if op != e.op || id != e.id {
+			t.Errorf("event %d: expected %s %s, got %v %v", i, e.op, e.id, op, id)
+		}
+	}
+}
+
+func TestQuoteTableName(t *testing.T) {
+	if got, want := quoteTableName("ops.dstream_signals"), "[ops].[dstream_signals]"; got != want {
+		t.Fatalf("quoteTableName = %q, want %q", got, want)
+	}
+	if got, want := quoteTableName("signals]x"), "[dbo].[signals]]x]"; got != want {
+		t.Fatalf("quoteTableName = %q, want %q", got, want)
+	}
+}
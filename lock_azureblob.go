@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+)
+
+// Azure Blob leases last between 15 and 60 seconds
+const (
+	minBlobLeaseDuration = 15 * time.Second
+	maxBlobLeaseDuration = 60 * time.Second
+)
+
+// AzureBlobLockProvider implements locks as leases on blobs named <lock>.lock in the locks container.
+// An expired lease can be acquired by any instance, which is how a crashed holder is taken over.
+type AzureBlobLockProvider struct {
+	containerClient *container.Client
+	leaseDuration   time.Duration
+	instanceID      string
+}
+
+// NewAzureBlobLockProvider creates a lock provider on the given container, creating the container if needed
+func NewAzureBlobLockProvider(ctx context.Context, connectionString string, containerName string, leaseDuration time.Duration, instanceID string) (*AzureBlobLockProvider, error) {
+	if leaseDuration < minBlobLeaseDuration || leaseDuration > maxBlobLeaseDuration {
+		return nil, fmt.Errorf("Azure Blob lease duration must be between %s and %s, got %s", minBlobLeaseDuration, maxBlobLeaseDuration, leaseDuration)
+	}
+
+	containerClient, err := container.NewClientFromConnectionString(connectionString, containerName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+	}
+
+	_, err = containerClient.Create(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil, fmt.Errorf("failed to ensure Azure Blob container %s: %w", containerName, err)
+	}
+
+	return &AzureBlobLockProvider{
+		containerClient: containerClient,
+		leaseDuration:   leaseDuration,
+		instanceID:      instanceID,
+	}, nil
+}
+
+// LeaseDuration returns how long a lease is held without renewal
+func (p *AzureBlobLockProvider) LeaseDuration() time.Duration {
+	return p.leaseDuration
+}
+
+// Acquire takes a lease on the lock blob, creating the blob on first use
+func (p *AzureBlobLockProvider) Acquire(ctx context.Context, name string) (Lock, error) {
+	blobClient := p.containerClient.NewBlockBlobClient(name + ".lock")
+
+	_, err := blobClient.Upload(ctx, streaming.NopCloser(bytes.NewReader(nil)), &blockblob.UploadOptions{
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)}},
+	})
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet, bloberror.LeaseIDMissing) {
+		return nil, fmt.Errorf("failed to create lock blob for %s: %w", name, err)
+	}
+
+	leaseClient, err := lease.NewBlobClient(blobClient, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lease client for %s: %w", name, err)
+	}
+	_, err = leaseClient.AcquireLease(ctx, int32(p.leaseDuration/time.Second), nil)
+	if bloberror.HasCode(err, bloberror.LeaseAlreadyPresent, bloberror.LeaseIsBreakingAndCannotBeAcquired) {
+		return nil, fmt.Errorf("%w: %s", ErrLockHeld, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to acquire lease on %s: %w", name, err)
+	}
+
+	// Only the lease holder writes the blob, so incrementing the token stored on it is safe
+	props, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		leaseClient.ReleaseLease(context.WithoutCancel(ctx), nil)
+		return nil, fmt.Errorf("failed to read fencing token of %s: %w", name, err)
+	}
+	token := lockToken(props.Metadata) + 1
+
+	// Record the holder on the blob so operators can see who owns the lock
+	metadata := map[string]*string{"owner": to.Ptr(p.instanceID), "token": to.Ptr(strconv.FormatInt(token, 10))}
+	_, err = blobClient.SetMetadata(ctx, metadata, &blob.SetMetadataOptions{
+		AccessConditions: &blob.AccessConditions{LeaseAccessConditions: &blob.LeaseAccessConditions{LeaseID: leaseClient.LeaseID()}},
+	})
+	if err != nil {
+		leaseClient.ReleaseLease(context.WithoutCancel(ctx), nil)
+		return nil, fmt.Errorf("failed to record owner of %s: %w", name, err)
+	}
+
+	return &azureBlobLock{name: name, token: token, leaseClient: leaseClient}, nil
+}
+
+// HeldLocks lists the lock blobs starting with prefix whose lease has not expired or been released
+func (p *AzureBlobLockProvider) HeldLocks(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	pager := p.containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: to.Ptr(prefix)})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list locks with prefix %s: %w", prefix, err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || !strings.HasSuffix(*item.Name, ".lock") {
+				continue
+			}
+			if item.Properties == nil || item.Properties.LeaseState == nil || *item.Properties.LeaseState != lease.StateTypeLeased {
+				continue
+			}
+			names = append(names, strings.TrimSuffix(*item.Name, ".lock"))
+		}
+	}
+	return names, nil
+}
+
+// lockToken reads the fencing token from lock blob metadata, whose keys may come back in any case
+func lockToken(metadata map[string]*string) int64 {
+	for key, value := range metadata {
+		if strings.EqualFold(key, "token") && value != nil {
+			token, _ := strconv.ParseInt(*value, 10, 64)
+			return token
+		}
+	}
+	return 0
+}
+
+// azureBlobLock is a lease held on a lock blob
+type azureBlobLock struct {
+	name        string
+	token       int64
+	leaseClient *lease.BlobClient
+}
+
+// Name returns the lock name
+func (l *azureBlobLock) Name() string {
+	return l.name
+}
+
+// Token returns the fencing token stored on the blob when the lease was acquired
+func (l *azureBlobLock) Token() int64 {
+	return l.token
+}
+
+// Renew renews the lease; it fails with ErrLockLost once another instance has taken the lease over
+func (l *azureBlobLock) Renew(ctx context.Context) error {
+	_, err := l.leaseClient.RenewLease(ctx, nil)
+	if bloberror.HasCode(err, bloberror.LeaseIDMismatchWithLeaseOperation, bloberror.LeaseNotPresentWithLeaseOperation,
+		bloberror.LeaseIsBrokenAndCannotBeRenewed, bloberror.LeaseLost) {
+		return fmt.Errorf("%w: %s: %v", ErrLockLost, l.name, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to renew lease on %s: %w", l.name, err)
+	}
+	return nil
+}
+
+// Release releases the lease so another instance can acquire the lock right away
+func (l *azureBlobLock) Release(ctx context.Context) error {
+	_, err := l.leaseClient.ReleaseLease(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.LeaseIDMismatchWithLeaseOperation, bloberror.LeaseNotPresentWithLeaseOperation) {
+		return fmt.Errorf("failed to release lease on %s: %w", l.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestAzureBlobLockProvider creates a provider on a fresh container on the emulator configured by
+// DSTREAM_AZURITE_CONNECTION_STRING, skipping the test when it is not set
+func newTestAzureBlobLockProvider(t *testing.T, containerName string, instanceID string) *AzureBlobLockProvider {
+	t.Helper()
+
+	connString := os.Getenv("DSTREAM_AZURITE_CONNECTION_STRING")
+	if connString == "" {
+		t.Skip("DSTREAM_AZURITE_CONNECTION_STRING is not set")
+	}
+
+	provider, err := NewAzureBlobLockProvider(context.TODO(), connString, containerName, minBlobLeaseDuration, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.containerClient.Delete(context.TODO(), nil) })
+	return provider
+}
+
+func TestAzureBlobLockProvider(t *testing.T) {
+	containerName := fmt.Sprintf("dstream-locks-%d", time.Now().UnixNano())
+	first := newTestAzureBlobLockProvider(t, containerName, "first")
+	second := newTestAzureBlobLockProvider(t, containerName, "second")
+
+	lock, err := first.Acquire(context.TODO(), "leader")
+	if err != nil {
+		t.Fatalf("failed to acquire a free lock: %v", err)
+	}
+	if _, err := second.Acquire(context.TODO(), "leader"); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+	if err := lock.Renew(context.TODO()); err != nil {
+		t.Fatalf("failed to renew the lock: %v", err)
+	}
+
+	if err := lock.Release(context.TODO()); err != nil {
+		t.Fatalf("failed to release the lock: %v", err)
+	}
+	taken, err := second.Acquire(context.TODO(), "leader")
+	if err != nil {
+		t.Fatalf("expected to acquire the released lock: %v", err)
+	}
+	if taken.Token() <= lock.Token() {
+		t.Fatalf("expected a higher fencing token than %d, got %d", lock.Token(), taken.Token())
+	}
+	taken.Release(context.TODO())
+}
+
+func TestAzureBlobLockProviderTakeover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a lease to expire")
+	}
+	containerName := fmt.Sprintf("dstream-locks-%d", time.Now().UnixNano())
+	first := newTestAzureBlobLockProvider(t, containerName, "first")
+	second := newTestAzureBlobLockProvider(t, containerName, "second")
+
+	lock, err := first.Acquire(context.TODO(), "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first holder stops renewing; once the lease expires the second instance takes over
+	time.Sleep(minBlobLeaseDuration + time.Second)
+	taken, err := second.Acquire(context.TODO(), "leader")
+	if err != nil {
+		t.Fatalf("expected to take over the expired lock: %v", err)
+	}
+	defer taken.Release(context.TODO())
+
+	if err := lock.Renew(context.TODO()); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected ErrLockLost for the previous holder, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// LockKeeper holds a lock for as long as it can. Acquire waits until the lock is free, after which
+// the lock is renewed on a heartbeat of a third of the lease duration. Lost is closed when the lock
+// was taken over or could not be renewed twice in a row, before the lease runs out.
+type LockKeeper struct {
+	provider      LockProvider
+	name          string
+	retryInterval time.Duration // How often a held lock is retried
+
+	lock     Lock
+	lost     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewLockKeeper creates a keeper for the named lock
+func NewLockKeeper(provider LockProvider, name string) *LockKeeper {
+	return &LockKeeper{
+		provider:      provider,
+		name:          name,
+		retryInterval: provider.LeaseDuration() / 3,
+		lost:          make(chan struct{}),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Acquire blocks until the lock is acquired and starts renewing it. It returns ctx.Err() when ctx is
+// cancelled first.
+func (k *LockKeeper) Acquire(ctx context.Context) error {
+	for {
+		err := k.TryAcquire(ctx)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrLockHeld) {
+			log.Printf("[LockKeeper] Lock '%s' is held by another instance; retrying in %s", k.name, k.retryInterval)
+		} else {
+			log.Printf("[LockKeeper] Failed to acquire lock '%s', retrying in %s: %v", k.name, k.retryInterval, err)
+		}
+		if err := sleep(ctx, k.retryInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// TryAcquire makes a single attempt to acquire the lock, returning ErrLockHeld when another instance
+// holds it. Once acquired, the lock is renewed until it is released or lost.
+func (k *LockKeeper) TryAcquire(ctx context.Context) error {
+	attempted := time.Now()
+	lock, err := k.provider.Acquire(ctx, k.name)
+	if err != nil {
+		return err
+	}
+	log.Printf("[LockKeeper] Acquired lock '%s'", k.name)
+	k.lock = lock
+	go k.renew(attempted)
+	return nil
+}
+
+// Token returns the fencing token of the held lock
+func (k *LockKeeper) Token() int64 {
+	return k.lock.Token()
+}
+
+// Lost returns a channel that is closed when the lock is lost
+func (k *LockKeeper) Lost() <-chan struct{} {
+	return k.lost
+}
+
+// renew renews the lock until it is released or lost. Transient renewal errors are retried while the
+// next heartbeat can still renew the lease in time; after that the lock is reported lost before the
+// lease runs out, so that another instance never holds it while this one still acts on it. A renewal
+// taking longer than the heartbeat is abandoned. acquired is when the lock was requested.
+func (k *LockKeeper) renew(acquired time.Time) {
+	defer close(k.done)
+
+	interval := k.provider.LeaseDuration() / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	renewed := acquired // The lease runs at least until renewed plus the lease duration
+
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+
+		attempted := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := k.lock.Renew(ctx)
+		cancel()
+		if err == nil {
+			renewed = attempted
+			continue
+		}
+		if errors.Is(err, ErrLockLost) || k.provider.LeaseDuration()-time.Since(renewed) < interval {
+			log.Printf("[LockKeeper] Lost lock '%s': %v", k.name, err)
+			close(k.lost)
+			return
+		}
+		log.Printf("[LockKeeper] Failed to renew lock '%s', retrying: %v", k.name, err)
+	}
+}
+
+// Release stops renewing the lock and releases it. The release is given up once the lease would have
+// expired anyway.
+func (k *LockKeeper) Release() {
+	if k.lock == nil {
+		return
+	}
+	k.stopOnce.Do(func() { close(k.stop) })
+	<-k.done
+
+	select {
+	case <-k.lost:
+		return
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k.provider.LeaseDuration())
+	defer cancel()
+	if err := k.lock.Release(ctx); err != nil {
+		log.Printf("[LockKeeper] Failed to release lock '%s': %v", k.name, err)
+		return
+	}
+	log.Printf("[LockKeeper] Released lock '%s'", k.name)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLockProvider is an in-memory LockProvider for tests with expiring leases
+type memoryLockProvider struct {
+	leaseDuration time.Duration
+	mutex         sync.Mutex
+	holders       map[string]*memoryLock
+	tokens        map[string]int64
+	acquired      int
+	renewErr      error // Returned by every renewal while set
+}
+
+func newMemoryLockProvider(leaseDuration time.Duration) *memoryLockProvider {
+	return &memoryLockProvider{leaseDuration: leaseDuration, holders: map[string]*memoryLock{}, tokens: map[string]int64{}}
+}
+
+func (p *memoryLockProvider) LeaseDuration() time.Duration {
+	return p.leaseDuration
+}
+
+func (p *memoryLockProvider) Acquire(ctx context.Context, name string) (Lock, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if holder, ok := p.holders[name]; ok && time.Now().Before(holder.expires) {
+		return nil, fmt.Errorf("%w: %s", ErrLockHeld, name)
+	}
+	p.acquired++
+	p.tokens[name]++
+	lock := &memoryLock{provider: p, name: name, token: p.tokens[name], expires: time.Now().Add(p.leaseDuration)}
+	p.holders[name] = lock
+	return lock, nil
+}
+
+func (p *memoryLockProvider) HeldLocks(ctx context.Context, prefix string) ([]string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var names []string
+	for name, holder := range p.holders {
+		if strings.HasPrefix(name, prefix) && time.Now().Before(holder.expires) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// expire makes the current holder's lease run out
+func (p *memoryLockProvider) expire(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if holder, ok := p.holders[name]; ok {
+		holder.expires = time.Now()
+	}
+	delete(p.holders, name)
+}
+
+func (p *memoryLockProvider) held(name string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	holder, ok := p.holders[name]
+	return ok && time.Now().Before(holder.expires)
+}
+
+type memoryLock struct {
+	provider *memoryLockProvider
+	name     string
+	token    int64
+	expires  time.Time
+}
+
+func (l *memoryLock) Name() string { return l.name }
+
+func (l *memoryLock) Token() int64 { return l.token }
+
+func (l *memoryLock) Renew(ctx context.Context) error {
+	l.provider.mutex.Lock()
+	defer l.provider.mutex.Unlock()
+	if l.provider.renewErr != nil {
+		return l.provider.renewErr
+	}
+	if l.provider.holders[l.name] != l {
+		return fmt.Errorf("%w: %s", ErrLockLost, l.name)
+	}
+	l.expires = time.Now().Add(l.provider.leaseDuration)
+	return nil
+}
+
+func (l *memoryLock) Release(ctx context.Context) error {
+	l.provider.mutex.Lock()
+	defer l.provider.mutex.Unlock()
+	if l.provider.holders[l.name] == l {
+		delete(l.provider.holders, l.name)
+	}
+	return nil
+}
+
+func TestLockKeeperRenewsAndReleases(t *testing.T) {
+	provider := newMemoryLockProvider(60 * time.Millisecond)
+	keeper := NewLockKeeper(provider, "leader")
+	keeper.Acquire(context.TODO())
+
+	// The lock outlives several lease durations while it is renewed
+	time.Sleep(200 * time.Millisecond)
+	if !provider.held("leader") {
+		t.Fatal("expected the lock to be kept alive by renewals")
+	}
+
+	keeper.Release()
+	if provider.held("leader") {
+		t.Fatal("expected the lock to be released")
+	}
+}
+
+func TestLockKeeperWaitsForHolder(t *testing.T) {
+	provider := newMemoryLockProvider(60 * time.Millisecond)
+	first := NewLockKeeper(provider, "leader")
+	first.Acquire(context.TODO())
+
+	acquired := make(chan struct{})
+	second := NewLockKeeper(provider, "leader")
+	go func() {
+		second.Acquire(context.TODO())
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second keeper acquired a held lock")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// Waiting for a held lock ends when the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := NewLockKeeper(provider, "leader").Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Acquire to stop with the context, got %v", err)
+	}
+
+	first.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second keeper did not take over the released lock")
+	}
+	second.Release()
+}
+
+func TestLockKeeperReportsLoss(t *testing.T) {
+	provider := newMemoryLockProvider(60 * time.Millisecond)
+	keeper := NewLockKeeper(provider, "leader")
+	keeper.Acquire(context.TODO())
+
+	// Another instance takes the lock over after the lease expired
+	provider.expire("leader")
+	if _, err := provider.Acquire(context.TODO(), "leader"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-keeper.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("expected the keeper to report the lost lock")
+	}
+	keeper.Release()
+}
+
+func TestLockKeeperReportsLossBeforeExpiry(t *testing.T) {
+	provider := newMemoryLockProvider(300 * time.Millisecond)
+	keeper := NewLockKeeper(provider, "leader")
+	keeper.Acquire(context.TODO())
+
+	// Renewals keep failing, e.g. while the lock backend is unreachable
+	provider.mutex.Lock()
+	provider.renewErr = errors.New("connection refused")
+	provider.mutex.Unlock()
+
+	select {
+	case <-keeper.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("expected the keeper to report the lock lost")
+	}
+	// The lock is given up while the lease still runs, so no other instance can hold it yet
+	if !provider.held("leader") {
+		t.Fatal("expected the loss to be reported before the lease expired")
+	}
+	keeper.Release()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katasec/dstream/config"
+)
+
+// ErrLockHeld is returned by Acquire when another instance holds the lock
+var ErrLockHeld = errors.New("lock is held by another instance")
+
+// ErrLockLost is returned by Renew when the lock expired and may have been taken over
+var ErrLockLost = errors.New("lock was lost")
+
+// LockProvider hands out exclusive locks shared by all dstream instances. Locks expire unless
+// renewed, so a crashed instance's locks are taken over by the others.
+type LockProvider interface {
+	// Acquire takes the named lock, returning ErrLockHeld when another instance holds it
+	Acquire(ctx context.Context, name string) (Lock, error)
+	// LeaseDuration is how long a lock stays held without being renewed
+	LeaseDuration() time.Duration
+	// HeldLocks lists the names of the locks starting with prefix that are currently held by any instance
+	HeldLocks(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Lock is a lock held by this instance
+type Lock interface {
+	Name() string
+	// Token is the fencing token of this acquisition; every acquisition of a lock gets a higher token
+	// than the ones before it
+	Token() int64
+	// Renew extends the lock, returning ErrLockLost when it can no longer be extended
+	Renew(ctx context.Context) error
+	Release(ctx context.Context) error
+}
+
+// NewLockProvider creates the lock provider selected in the locks block
+func NewLockProvider(ctx context.Context, c *config.Config, dbConn *sql.DB) (LockProvider, error) {
+	leaseDuration, err := c.Locks.GetLeaseDuration()
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease_duration: %w", err)
+	}
+
+	switch strings.ToLower(c.Locks.Type) {
+	case "azure_blob", "azure_blob_db":
+		return NewAzureBlobLockProvider(ctx, c.Locks.ConnectionString, c.Locks.ContainerName, leaseDuration, c.GetInstanceID())
+	case "sqlserver":
+		return NewSQLServerLockProvider(ctx, dbConn, c.Locks.Schema, c.Locks.TableName, leaseDuration, c.GetInstanceID())
+	}
+	return nil, fmt.Errorf("unknown lock type: %s", c.Locks.Type)
+}
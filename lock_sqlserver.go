@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default table and schema of the instances table used by the sqlserver lock provider
+const (
+	defaultInstancesTableName = "instances"
+	defaultInstancesSchema    = "dbo"
+)
+
+// sp_getapplock returns -1 when the lock could not be granted before the timeout
+const applockTimeout = -1
+
+// SQLServerLockProvider implements locks as exclusive session-owned application locks taken with
+// sp_getapplock. Each lock is held on its own dedicated session, so SQL Server releases it as soon as
+// the holder's connection is gone. The holder of every lock is recorded in the instances table, whose
+// renewed_at column is refreshed on every renewal. Rows are kept after release so that the fencing
+// token of a lock keeps increasing.
+type SQLServerLockProvider struct {
+	dbConn         *sql.DB
+	instancesTable string // Quoted [schema].[table] name
+	leaseDuration  time.Duration
+	instanceID     string
+}
+
+// NewSQLServerLockProvider creates a lock provider on the given database and creates the instances
+// table if it does not exist
+func NewSQLServerLockProvider(ctx context.Context, dbConn *sql.DB, schema string, tableName string, leaseDuration time.Duration, instanceID string) (*SQLServerLockProvider, error) {
+	if schema == "" {
+		schema = defaultInstancesSchema
+	}
+	if tableName == "" {
+		tableName = defaultInstancesTableName
+	}
+
+	p := &SQLServerLockProvider{
+		dbConn:         dbConn,
+		instancesTable: quoteIdentifier(schema) + "." + quoteIdentifier(tableName),
+		leaseDuration:  leaseDuration,
+		instanceID:     instanceID,
+	}
+	if err := p.initializeInstancesTable(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// instancesColumns are the columns added to the instances table after its first version
+var instancesColumns = []struct{ name, definition string }{
+	{"fencing_token", "BIGINT NOT NULL DEFAULT 0"},
+	{"released_at", "DATETIME2"},
+}
+
+// initializeInstancesTable creates the table recording which instance holds which lock and adds
+// columns missing from older versions
+func (p *SQLServerLockProvider) initializeInstancesTable(ctx context.Context) error {
+	query := fmt.Sprintf(`
+    IF OBJECT_ID(N'%[1]s', N'U') IS NULL
+    BEGIN
+        CREATE TABLE %[1]s (
+            lock_name NVARCHAR(255) PRIMARY KEY,
+            instance_id NVARCHAR(255) NOT NULL,
+            acquired_at DATETIME2 NOT NULL,
+            renewed_at DATETIME2 NOT NULL
+        );
+    END`, p.instancesTable)
+	for _, column := range instancesColumns {
+		query += fmt.Sprintf(`
+    IF COL_LENGTH(N'%[1]s', '%[2]s') IS NULL
+    BEGIN
+        ALTER TABLE %[1]s ADD %[2]s %[3]s;
+    END`, p.instancesTable, column.name, column.definition)
+	}
+
+	if _, err := p.dbConn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to initialize %s table: %w", p.instancesTable, err)
+	}
+
+	log.Printf("Initialized instances table %s.", p.instancesTable)
+	return nil
+}
+
+// LeaseDuration returns how long a lock is considered held without renewal
+func (p *SQLServerLockProvider) LeaseDuration() time.Duration {
+	return p.leaseDuration
+}
+
+// Acquire takes the application lock on a new dedicated session and records this instance as its holder
+func (p *SQLServerLockProvider) Acquire(ctx context.Context, name string) (Lock, error) {
+	lock := &sqlServerLock{provider: p, name: name}
+	if err := lock.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// HeldLocks lists the unreleased locks starting with prefix whose holder renewed them within the lease duration
+func (p *SQLServerLockProvider) HeldLocks(ctx context.Context, prefix string) ([]string, error) {
+	query := fmt.Sprintf(`SELECT lock_name FROM %s WHERE lock_name LIKE @prefix + '%%' ESCAPE '\' AND released_at IS NULL AND renewed_at > DATEADD(millisecond, -CAST(@lease AS INT), SYSUTCDATETIME())`, p.instancesTable)
+	rows, err := p.dbConn.QueryContext(ctx, query, sql.Named("prefix", escapeLike(prefix)), sql.Named("lease", p.leaseDuration.Milliseconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks with prefix %s: %w", prefix, err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// sqlServerLock is an application lock held on a dedicated session
+type sqlServerLock struct {
+	provider *SQLServerLockProvider
+	name     string
+	token    int64
+	mutex    sync.Mutex
+	session  *sql.Conn
+}
+
+// Name returns the lock name
+func (l *sqlServerLock) Name() string {
+	return l.name
+}
+
+// Token returns the fencing token recorded in the instances table when the lock was acquired
+func (l *sqlServerLock) Token() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.token
+}
+
+// acquire opens a dedicated session and takes the application lock on it without waiting
+func (l *sqlServerLock) acquire(ctx context.Context) error {
+	session, err := l.provider.dbConn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open lock session for %s: %w", l.name, err)
+	}
+
+	var result int
+	err = session.QueryRowContext(ctx, `
+    DECLARE @result INT;
+    EXEC @result = sp_getapplock @Resource = @name, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0;
+    SELECT @result;`, sql.Named("name", l.name)).Scan(&result)
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("failed to acquire lock %s: %w", l.name, err)
+	}
+	if result == applockTimeout {
+		session.Close()
+		return fmt.Errorf("%w: %s", ErrLockHeld, l.name)
+	}
+	if result < 0 {
+		session.Close()
+		return fmt.Errorf("failed to acquire lock %s: sp_getapplock returned %d", l.name, result)
+	}
+
+	// Record the holder so operators can see who owns the lock, and take the next fencing token
+	var token int64
+	err = session.QueryRowContext(ctx, fmt.Sprintf(`
+    MERGE INTO %s AS target
+    USING (VALUES (@name, @instanceID)) AS source (lock_name, instance_id)
+    ON target.lock_name = source.lock_name
+    WHEN MATCHED THEN
+        UPDATE SET instance_id = source.instance_id, fencing_token = target.fencing_token + 1,
+            acquired_at = SYSUTCDATETIME(), renewed_at = SYSUTCDATETIME(), released_at = NULL
+    WHEN NOT MATCHED THEN
+        INSERT (lock_name, instance_id, fencing_token, acquired_at, renewed_at)
+        VALUES (source.lock_name, source.instance_id, 1, SYSUTCDATETIME(), SYSUTCDATETIME())
+    OUTPUT inserted.fencing_token;`,
+		l.provider.instancesTable), sql.Named("name", l.name), sql.Named("instanceID", l.provider.instanceID)).Scan(&token)
+	if err != nil {
+		discardSession(session)
+		return fmt.Errorf("failed to record owner of %s: %w", l.name, err)
+	}
+
+	l.session = session
+	l.token = token
+	return nil
+}
+
+// Renew checks that the session still holds the lock and refreshes its row in the instances table.
+// When the session was lost the lock is reacquired on a new session, failing with ErrLockLost if
+// another instance took it in the meantime.
+func (l *sqlServerLock) Renew(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var mode string
+	err := l.session.QueryRowContext(ctx, `SELECT APPLOCK_MODE('public', @name, 'Session')`, sql.Named("name", l.name)).Scan(&mode)
+	if err == nil && mode != "Exclusive" {
+		return fmt.Errorf("%w: %s: session no longer holds the lock", ErrLockLost, l.name)
+	}
+	if err != nil {
+		log.Printf("[SQLServerLockProvider] Session of lock '%s' failed, reacquiring: %v", l.name, err)
+		discardSession(l.session)
+		if err := l.acquire(ctx); err != nil {
+			if errors.Is(err, ErrLockHeld) {
+				return fmt.Errorf("%w: %s: taken over after the session was lost", ErrLockLost, l.name)
+			}
+			return err
+		}
+		return nil
+	}
+
+	_, err = l.session.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET renewed_at = SYSUTCDATETIME() WHERE lock_name = @name AND instance_id = @instanceID`, l.provider.instancesTable),
+		sql.Named("name", l.name), sql.Named("instanceID", l.provider.instanceID))
+	if err != nil {
+		return fmt.Errorf("failed to renew lock %s: %w", l.name, err)
+	}
+	return nil
+}
+
+// Release marks this instance's row in the instances table as released, releases the application lock
+// and closes its session
+func (l *sqlServerLock) Release(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	defer discardSession(l.session)
+
+	_, err := l.session.ExecContext(ctx, fmt.Sprintf(`
+    UPDATE %s SET released_at = SYSUTCDATETIME() WHERE lock_name = @name AND instance_id = @instanceID;
+    EXEC sp_releaseapplock @Resource = @name, @LockOwner = 'Session';`, l.provider.instancesTable),
+		sql.Named("name", l.name), sql.Named("instanceID", l.provider.instanceID))
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", l.name, err)
+	}
+	return nil
+}
+
+// discardSession closes a lock session without returning it to the connection pool, so any
+// application lock it still holds is released along with the connection
+func discardSession(session *sql.Conn) {
+	session.Raw(func(interface{}) error { return driver.ErrBadConn })
+	session.Close()
+}
+
+// escapeLike escapes the LIKE wildcards in s using \ as the escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `[`, `\[`).Replace(s)
+}
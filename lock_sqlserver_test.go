@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestSQLServerLockProviders creates two providers for different instances on a fresh instances
+// table in the database configured by DSTREAM_DB_CONNECTION_STRING, skipping the test when it is not set
+func newTestSQLServerLockProviders(t *testing.T) (*SQLServerLockProvider, *SQLServerLockProvider) {
+	t.Helper()
+
+	connString := os.Getenv("DSTREAM_DB_CONNECTION_STRING")
+	if connString == "" {
+		t.Skip("DSTREAM_DB_CONNECTION_STRING is not set")
+	}
+	db, err := sql.Open("sqlserver", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	tableName := fmt.Sprintf("dstream_instances_%d", time.Now().UnixNano())
+	first, err := NewSQLServerLockProvider(context.TODO(), db, "", tableName, 15*time.Second, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE " + first.instancesTable) })
+	second, err := NewSQLServerLockProvider(context.TODO(), db, "", tableName, 15*time.Second, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func TestSQLServerLockProvider(t *testing.T) {
+	first, second := newTestSQLServerLockProviders(t)
+	name := fmt.Sprintf("table-test-%d", time.Now().UnixNano())
+
+	lock, err := first.Acquire(context.TODO(), name)
+	if err != nil {
+		t.Fatalf("failed to acquire a free lock: %v", err)
+	}
+	if _, err := second.Acquire(context.TODO(), name); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+	if err := lock.Renew(context.TODO()); err != nil {
+		t.Fatalf("failed to renew the lock: %v", err)
+	}
+
+	held, err := second.HeldLocks(context.TODO(), "table-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 1 || held[0] != name {
+		t.Fatalf("expected %s to be listed as held, got %v", name, held)
+	}
+
+	if err := lock.Release(context.TODO()); err != nil {
+		t.Fatalf("failed to release the lock: %v", err)
+	}
+	taken, err := second.Acquire(context.TODO(), name)
+	if err != nil {
+		t.Fatalf("expected to acquire the released lock: %v", err)
+	}
+	if taken.Token() <= lock.Token() {
+		t.Fatalf("expected a higher fencing token than %d, got %d", lock.Token(), taken.Token())
+	}
+	taken.Release(context.TODO())
+}
+
+func TestSQLServerLockReacquiresAfterSessionLoss(t *testing.T) {
+	first, _ := newTestSQLServerLockProviders(t)
+	name := fmt.Sprintf("table-test-%d", time.Now().UnixNano())
+
+	lock, err := first.Acquire(context.TODO(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(context.TODO())
+
+	// Dropping the session releases the application lock; renewing takes it again on a new session
+	discardSession(lock.(*sqlServerLock).session)
+	if err := lock.Renew(context.TODO()); err != nil {
+		t.Fatalf("expected the lock to be reacquired, got %v", err)
+	}
+	if err := lock.Renew(context.TODO()); err != nil {
+		t.Fatalf("expected the reacquired lock to renew, got %v", err)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if got, want := escapeLike(`table-a_b%[c]\`), `table-a\_b\%\[c]\\`; got != want {
+		t.Fatalf("escapeLike = %q, want %q", got, want)
+	}
+}
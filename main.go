@@ -1,16 +1,53 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	_ "github.com/denisenkom/go-mssqldb"
 )
 
 func main() {
 	//fetchLastLSNs()
 	//select {}
-	doServerStuff()
+	role := flag.String("role", RoleAll, "Comma-separated components to run: all, fetcher, checkpoint, publisher")
+	flag.Parse()
+
+	roles, err := ParseRoles(*role)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doServerStuff(roles)
 }
 
-func doServerStuff() {
-	server := NewServer()
-	server.Start()
+// doServerStuff runs the server until it receives SIGINT or SIGTERM or a component fails, and then
+// shuts it down within the configured deadline
+func doServerStuff(roles Roles) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop() // A second signal kills the process at once, even while shutting down
+	}()
+
+	server := NewServer(ctx, roles)
+	err := server.Start(ctx)
+	if err != nil {
+		log.Printf("Server failed: %v", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.shutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.Printf("Shutdown did not complete: %v", shutdownErr)
+		err = shutdownErr
+	}
+	if err != nil {
+		cancel()
+		os.Exit(1)
+	}
 }
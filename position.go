@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// checkpointRowInterval is the number of delivered events after which the monitor checkpoints its
+// position within a batch, so a restart in the middle of a large transaction resumes at the row.
+// The checkpoint worker coalesces these saves, so they are cheap.
+const checkpointRowInterval = 100
+
+// Position identifies a row in a change table by its transaction's start LSN, its sequence value
+// within the transaction and its operation. A nil SeqVal marks the whole transaction as delivered.
+type Position struct {
+	LSN       []byte
+	SeqVal    []byte
+	Operation int
+}
+
+// String formats the position for logging
+func (p Position) String() string {
+	if p.SeqVal == nil {
+		return hex.EncodeToString(p.LSN)
+	}
+	return fmt.Sprintf("%s:%s:%d", hex.EncodeToString(p.LSN), hex.EncodeToString(p.SeqVal), p.Operation)
+}
+
+// comparePositions returns -1, 0 or 1 as a is before, equal to or after b. A completed transaction
+// sorts after all of its rows.
+func comparePositions(a, b Position) int {
+	if c := bytes.Compare(a.LSN, b.LSN); c != 0 {
+		return c
+	}
+	switch {
+	case a.SeqVal == nil && b.SeqVal == nil:
+		return 0
+	case a.SeqVal == nil:
+		return 1
+	case b.SeqVal == nil:
+		return -1
+	}
+	if c := bytes.Compare(a.SeqVal, b.SeqVal); c != 0 {
+		return c
+	}
+	switch {
+	case a.Operation < b.Operation:
+		return -1
+	case a.Operation > b.Operation:
+		return 1
+	}
+	return 0
+}
+
+// changePosition returns the position of a change event. Commit markers complete their transaction;
+// Begin markers and snapshot events have no position.
+func changePosition(change map[string]interface{}) (Position, bool) {
+	metadata := changeMetadata(change)
+	if metadata == nil {
+		return Position{}, false
+	}
+	lsnHex, _ := metadata["LSN"].(string)
+	lsn, err := hex.DecodeString(lsnHex)
+	if err != nil || lsnHex == "" {
+		return Position{}, false
+	}
+
+	if metadata["OperationType"] == OperationTypeCommit {
+		return Position{LSN: lsn}, true
+	}
+	seqValHex, ok := metadata["SeqVal"].(string)
+	if !ok {
+		return Position{}, false
+	}
+	seqVal, err := hex.DecodeString(seqValHex)
+	if err != nil {
+		return Position{}, false
+	}
+	operation, _ := metadata["OperationCode"].(int)
+	return Position{LSN: lsn, SeqVal: seqVal, Operation: operation}, true
+}
+
+// resumeAfter drops the events of a partially delivered transaction that are at or before the
+// position, including its Begin marker. Other events are returned unchanged.
+func resumeAfter(changes []map[string]interface{}, position Position) []map[string]interface{} {
+	if position.SeqVal == nil {
+		return changes
+	}
+	lsnHex := hex.EncodeToString(position.LSN)
+
+	remaining := make([]map[string]interface{}, 0, len(changes))
+	for _, change := range changes {
+		if p, ok := changePosition(change); ok {
+			if comparePositions(p, position) <= 0 {
+				continue
+			}
+		} else if metadata := changeMetadata(change); metadata["OperationType"] == OperationTypeBegin && metadata["LSN"] == lsnHex {
+			continue
+		}
+		remaining = append(remaining, change)
+	}
+	return remaining
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// newTestChange builds the change event parseChange makes for the row with the given ID at a position
+func newTestChange(position Position, id string) map[string]interface{} {
+	commitTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return parseChange(position, commitTime, []string{"ID"}, []interface{}{&sql.NullString{String: id, Valid: true}})
+}
+
+func TestComparePositions(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Position
+		want int
+	}{
+		{"lower LSN", Position{LSN: []byte{1}}, Position{LSN: []byte{2}}, -1},
+		{"same completed LSN", Position{LSN: []byte{1}}, Position{LSN: []byte{1}}, 0},
+		{"row before completed transaction", Position{LSN: []byte{1}, SeqVal: []byte{9}}, Position{LSN: []byte{1}}, -1},
+		{"lower seqval", Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 4}, Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 2}, -1},
+		{"update before image first", Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 3}, Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 4}, -1},
+		{"row of a later transaction", Position{LSN: []byte{2}, SeqVal: []byte{0}}, Position{LSN: []byte{1}}, 1},
+	}
+	for _, tt := range tests {
+		if got := comparePositions(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestResumeAfterPartialTransaction(t *testing.T) {
+	changes := groupTransactions([]map[string]interface{}{
+		newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}, "1"), newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 3}, "1"), newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 4}, "1"), newTestChange(Position{LSN: []byte{2}, SeqVal: []byte{1}, Operation: 2}, "1"),
+	}, true)
+
+	// The insert and the before image of the update were delivered
+	remaining := resumeAfter(changes, Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 3})
+
+	expected := []struct {
+		operationType string
+		sequence      interface{}
+	}{{"Update", 3}, {OperationTypeCommit, nil}, {OperationTypeBegin, nil}, {"Insert", 1}, {OperationTypeCommit, nil}}
+	if len(remaining) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(remaining))
+	}
+	for i, e := range expected {
+		metadata := changeMetadata(remaining[i])
+		if metadata["OperationType"] != e.operationType || metadata["TransactionSequence"] != e.sequence {
+			t.Errorf("event %d: unexpected metadata %v", i, metadata)
+		}
+	}
+}
+
+func TestResumeAfterCompletedTransaction(t *testing.T) {
+	changes := []map[string]interface{}{newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}, "1"), newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 2}, "1")}
+	if remaining := resumeAfter(changes, Position{LSN: []byte{1}}); len(remaining) != 2 {
+		t.Fatalf("a completed position must not filter the rows read after it, got %d events", len(remaining))
+	}
+}
+
+func TestChangePosition(t *testing.T) {
+	position, ok := changePosition(newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 4}, "1"))
+	if !ok || comparePositions(position, Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 4}) != 0 {
+		t.Fatalf("unexpected row position %s (ok=%v)", position, ok)
+	}
+
+	grouped := groupTransactions([]map[string]interface{}{newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 4}, "1")}, true)
+	if _, ok := changePosition(grouped[0]); ok {
+		t.Errorf("a Begin marker must not have a position")
+	}
+	if position, ok := changePosition(grouped[2]); !ok || position.SeqVal != nil {
+		t.Errorf("a Commit marker must complete its transaction, got %s (ok=%v)", position, ok)
+	}
+}
@@ -1,32 +1,359 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/katasec/dstream/utils"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
-// PublisherWorker struct represents a worker that subscribes to a topic and prints data
+// Delays between attempts to deliver an event or save a checkpoint that failed
+const (
+	publisherRetryInterval    = time.Second
+	publisherMaxRetryInterval = 30 * time.Second
+)
+
+// publisherIdleInterval is how long a worker waits after finding none of its partitions with events
+const publisherIdleInterval = 250 * time.Millisecond
+
+// PublisherWorker struct represents a worker that reads events from the event stream and delivers them to a sink
 type PublisherWorker struct {
-	Name     string
-	NATSConn *nats.Conn
+	Name        string
+	NATSConn    *nats.Conn
+	Sink        Sink
+	MaxAttempts int          // Delivery attempts before an event the sink refused is dead-lettered
+	Locks       LockProvider // Gives every table partition a single publisher on a bus shared by several processes; nil otherwise
+
+	js      jetstream.JetStream
+	markers jetstream.KeyValue // Partitions that reached each checkpoint marker
 }
 
-// NewPublisherWorker creates a new worker that subscribes to a topic and prints data
-func NewPublisherWorker(name string, conn *nats.Conn) *PublisherWorker {
+// NewPublisherWorker creates a new worker that reads events from the event stream and delivers them to a
+// sink, dead-lettering events the sink refused with ErrEventRefused maxAttempts times
+func NewPublisherWorker(name string, conn *nats.Conn, sink Sink, maxAttempts int) *PublisherWorker {
 	return &PublisherWorker{
-		Name:     name,
-		NATSConn: conn,
+		Name:        name,
+		NATSConn:    conn,
+		Sink:        sink,
+		MaxAttempts: maxAttempts,
+	}
+}
+
+// Consume reads the partitions of the given tables from the event stream until ctx is cancelled. Every
+// table partition has a durable consumer shared by all publisher processes like a queue group. A consumer
+// hands out a batch of events at most, and the batch is acknowledged only once all of its events were
+// delivered in order. With Locks set, a process delivers a table partition only while it holds the table
+// partition's lock, so events of a partition are delivered in order no matter how many publishers run.
+// The configured number of workers take turns delivering the table partitions in parallel; a table
+// partition being delivered or retried is skipped by the other workers, so a failing table holds up one
+// worker only. Events are acknowledged once the sink accepted them or they were dead-lettered, and
+// checkpoint markers are saved once every partition reached them, so a checkpoint never passes an event
+// that was not handled. Once ctx is cancelled, Consume returns after the batches being handled are done;
+// messages left unacknowledged are redelivered.
+func (w *PublisherWorker) Consume(ctx context.Context, stream jetstream.Stream, c config.EventStreamConfig, database string, tables []string) error {
+	ackWait, err := c.GetAckWait()
+	if err != nil {
+		return fmt.Errorf("invalid event_stream ack_wait: %w", err)
+	}
+	maxAge, err := c.GetMaxAge()
+	if err != nil {
+		return fmt.Errorf("invalid event_stream max_age: %w", err)
+	}
+	if w.js, err = jetstream.New(w.NATSConn); err != nil {
+		return err
+	}
+	if w.markers, err = EnsureCheckpointMarkerBucket(ctx, w.js, maxAge); err != nil {
+		return err
+	}
+
+	var consumers []*tablePartition
+	for _, tableName := range tables {
+		for partition := 0; partition < c.GetPartitions(); partition++ {
+			name := partitionConsumer(database, tableName, partition)
+			consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+				Durable:       name,
+				DeliverPolicy: jetstream.DeliverAllPolicy,
+				AckPolicy:     jetstream.AckExplicitPolicy,
+				AckWait:       ackWait,
+				MaxAckPending: c.GetBatchSize(),
+				FilterSubject: partitionFilter(database, tableName, partition),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create consumer %s: %w", name, err)
+			}
+			consumers = append(consumers, &tablePartition{name: name, consumer: consumer})
+		}
+	}
+	if len(consumers) == 0 {
+		return errors.New("no tables to publish")
+	}
+	workers := c.GetWorkers(len(consumers))
+	log.Printf("[%s] Consuming %d table partitions of stream %s with %d workers", w.Name, len(consumers), c.GetName(), workers)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.consumePartitions(ctx, consumers, worker, c.GetBatchSize(), ackWait)
+		}()
 	}
+	wg.Wait()
+
+	for _, partition := range consumers {
+		if partition.keeper != nil {
+			partition.keeper.Release()
+		}
+	}
+	return nil
+}
+
+// tablePartition is the consumer of a table partition and, on a shared bus, the lock of the process delivering it
+type tablePartition struct {
+	name     string
+	consumer jetstream.Consumer
+	busy     sync.Mutex // Held by the worker delivering the table partition
+
+	keeper  *LockKeeper     // Holds the table partition's lock; nil while this process does not
+	owned   context.Context // Cancelled when the lock is lost
+	retryAt time.Time       // When to try to take the lock again
 }
 
-// Subscribe subscribes to a topic and prints received messages
-func (w *PublisherWorker) Subscribe(topic string) {
-	_, err := w.NATSConn.Subscribe(topic, func(msg *nats.Msg) {
-		log.Printf("[%s] Received message on topic '%s': %s", w.Name, topic, msg.Data)
+// consumePartitions delivers batches of the given table partitions, taking turns between them from the
+// offset-th one and skipping those another worker is delivering, until ctx is cancelled
+func (w *PublisherWorker) consumePartitions(ctx context.Context, consumers []*tablePartition, offset, batchSize int, ackWait time.Duration) {
+	for ctx.Err() == nil {
+		idle := true
+		for i := range consumers {
+			partition := consumers[(offset+i)%len(consumers)]
+			if !partition.busy.TryLock() {
+				continue
+			}
+			if owned, ok := w.own(ctx, partition); ok {
+				idle = !w.consumeBatch(owned, partition.consumer, batchSize, ackWait) && idle
+			}
+			partition.busy.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		if idle && sleep(ctx, publisherIdleInterval) != nil {
+			return
+		}
+	}
+}
+
+// own reports whether this process may deliver a table partition, taking the table partition's lock when
+// it is free, and returns a context that is cancelled once the lock is lost. Without Locks every table
+// partition is owned.
+func (w *PublisherWorker) own(ctx context.Context, partition *tablePartition) (context.Context, bool) {
+	if w.Locks == nil {
+		return ctx, true
+	}
+	if partition.keeper != nil {
+		select {
+		case <-partition.keeper.Lost():
+			log.Printf("[%s] Lost table partition %s; standing by", w.Name, partition.name)
+			partition.keeper = nil
+		default:
+			return partition.owned, true
+		}
+	}
+	if time.Now().Before(partition.retryAt) {
+		return nil, false
+	}
+
+	keeper := NewLockKeeper(w.Locks, partition.name)
+	if err := keeper.TryAcquire(ctx); err != nil {
+		if !errors.Is(err, ErrLockHeld) {
+			log.Printf("[%s] Failed to take table partition %s: %v", w.Name, partition.name, err)
+		}
+		partition.retryAt = time.Now().Add(w.Locks.LeaseDuration() / 3)
+		return nil, false
+	}
+	owned, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-keeper.Lost():
+		case <-ctx.Done():
+		}
+	}()
+	partition.keeper, partition.owned = keeper, owned
+	return owned, true
+}
+
+// consumeBatch handles a batch of a table partition in order and acknowledges it once every message was
+// handled, so that the consumer hands out later messages of the partition only after these were delivered.
+// Messages of the batch are kept from being redelivered while the batch is handled. It reports whether the
+// batch had any messages. When ctx is cancelled first, the batch is left unacknowledged to be redelivered.
+func (w *PublisherWorker) consumeBatch(ctx context.Context, consumer jetstream.Consumer, batchSize int, ackWait time.Duration) bool {
+	batch, err := consumer.FetchNoWait(batchSize)
+	if err != nil {
+		log.Printf("[%s] Failed to fetch events: %v", w.Name, err)
+		return false
+	}
+	var msgs []jetstream.Msg
+	for msg := range batch.Messages() {
+		msgs = append(msgs, msg)
+	}
+	if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && ctx.Err() == nil {
+		log.Printf("[%s] Failed to fetch events: %v", w.Name, err)
+	}
+
+	touched := time.Now()
+	keepAlive := func() {
+		if time.Since(touched) < ackWait/3 {
+			return
+		}
+		for _, msg := range msgs {
+			if err := msg.InProgress(); err != nil {
+				log.Printf("[%s] Failed to extend ack deadline: %v", w.Name, err)
+			}
+		}
+		touched = time.Now()
+	}
+	for _, msg := range msgs {
+		keepAlive()
+		if err := w.handleMessage(ctx, msg, keepAlive); err != nil {
+			return true
+		}
+	}
+	for _, msg := range msgs {
+		if err := msg.Ack(); err != nil {
+			log.Printf("[%s] Failed to acknowledge message on %s: %v", w.Name, msg.Subject(), err)
+		}
+	}
+	return len(msgs) > 0
+}
+
+// handleMessage delivers an event or records a checkpoint marker, retrying until it succeeds and calling
+// keepAlive between attempts. An event the sink refused with ErrEventRefused is dead-lettered once it was
+// attempted MaxAttempts times, counting the attempts of earlier deliveries of the message; other failures,
+// such as an unavailable sink, hold up the table partition until they are resolved. It returns ctx.Err()
+// when ctx is cancelled before the message was handled.
+func (w *PublisherWorker) handleMessage(ctx context.Context, msg jetstream.Msg, keepAlive func()) error {
+	isCheckpoint := msg.Headers().Get(headerMessageType) == messageTypeCheckpoint
+	handle := func() error {
+		return w.Sink.Deliver(ctx, msg.Headers().Get(headerTableName), msg.Data())
+	}
+	if isCheckpoint {
+		// A marker in hand is recorded even when the publisher is stopping; only retries end with ctx
+		handle = func() error { return w.reachCheckpoint(context.WithoutCancel(ctx), msg) }
+	}
+
+	// A redelivered message was attempted at least once by every earlier delivery
+	attempt := 0
+	if metadata, err := msg.Metadata(); err == nil {
+		attempt = int(metadata.NumDelivered) - 1
+	}
+
+	backoff := NewBackoffManager(publisherRetryInterval, publisherMaxRetryInterval)
+	var firstFailedAt time.Time
+	for {
+		attempt++
+		err := handle()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// A delivery cut short by the shutdown is redelivered, since the batch is not acknowledged
+			return ctx.Err()
+		}
+		if firstFailedAt.IsZero() {
+			firstFailedAt = time.Now().UTC()
+		}
+		if !isCheckpoint && errors.Is(err, ErrEventRefused) && w.MaxAttempts > 0 && attempt >= w.MaxAttempts {
+			err = w.deadLetter(ctx, msg, err, attempt, firstFailedAt)
+			if err == nil {
+				return nil
+			}
+		}
+		log.Printf("[%s] Failed to handle message on %s, retrying in %s: %v", w.Name, msg.Subject(), backoff.GetInterval(), err)
+
+		// Keep the batch from being redelivered to another publisher while retrying
+		keepAlive()
+		if err := sleep(ctx, backoff.GetInterval()); err != nil {
+			return err
+		}
+		backoff.IncreaseInterval()
+	}
+}
+
+// deadLetter stores an event the sink refused in the dead letter stream, with its subject and
+// headers so that it can be replayed
+func (w *PublisherWorker) deadLetter(ctx context.Context, msg jetstream.Msg, cause error, attempts int, firstFailedAt time.Time) error {
+	headers := map[string]string{}
+	for key := range msg.Headers() {
+		headers[key] = msg.Headers().Get(key)
+	}
+	return publishDeadLetter(ctx, w.js, DeadLetter{
+		TableName:     msg.Headers().Get(headerTableName),
+		Source:        DeadLetterSourcePublisher,
+		Subject:       msg.Subject(),
+		Headers:       headers,
+		Data:          msg.Data(),
+		Error:         cause.Error(),
+		Attempts:      attempts,
+		FirstFailedAt: firstFailedAt,
+		LastFailedAt:  time.Now().UTC(),
 	})
+}
+
+// reachCheckpoint records that the message's partition reached a checkpoint marker and saves the
+// checkpoint when it was the last partition to do so
+func (w *PublisherWorker) reachCheckpoint(ctx context.Context, msg jetstream.Msg) error {
+	id := msg.Headers().Get(headerCheckpointID)
+	partition, _ := strconv.Atoi(msg.Headers().Get(headerPartition))
+	partitions, _ := strconv.Atoi(msg.Headers().Get(headerPartitions))
+
+	complete, err := reachCheckpoint(ctx, w.markers, id, partition, partitions)
+	if err != nil || !complete {
+		return err
+	}
+	if err := w.saveCheckpoint(msg.Data()); err != nil {
+		return err
+	}
+	if partitions > 1 {
+		if err := w.markers.Delete(ctx, id); err != nil {
+			log.Printf("[%s] Failed to remove completed checkpoint marker %s: %v", w.Name, id, err)
+		}
+	}
+	return nil
+}
+
+// saveCheckpoint saves a checkpoint marker via the checkpoint worker. A marker refused for its fencing
+// token was written by an instance that no longer streams the table and is dropped.
+func (w *PublisherWorker) saveCheckpoint(data []byte) error {
+	req, err := utils.UnmarshalJSON[SaveLastLSNRequest](data)
+	if err != nil {
+		log.Printf("[%s] Dropping unreadable checkpoint marker: %v", w.Name, err)
+		return nil
+	}
+
+	msg, err := w.NATSConn.Request(topics.Checkpoints.Save, data, 2*time.Second)
 	if err != nil {
-		log.Fatalf("[%s] Error subscribing to topic '%s': %v", w.Name, topic, err)
+		return fmt.Errorf("failed to save checkpoint for table '%s': %w", req.TableName, err)
+	}
+	resp, err := utils.UnmarshalJSON[SaveLastLSNResponse](msg.Data)
+	if err != nil {
+		return err
+	}
+	if resp.Fenced {
+		log.Printf("[%s] Dropping checkpoint of table '%s' from a previous owner: %s", w.Name, req.TableName, resp.Error)
+		return nil
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
 	}
-	log.Printf("[%s] Subscribed to topic '%s'", w.Name, topic)
+	return nil
 }
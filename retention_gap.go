@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/katasec/dstream/topics"
+)
+
+// Retention gap policies
+const (
+	RetentionGapPolicyFail     = "fail"
+	RetentionGapPolicySkip     = "skip"
+	RetentionGapPolicySnapshot = "snapshot"
+)
+
+// RetentionGapEvent is published on topics.CDC.Gap when changes after the checkpoint were removed by CDC cleanup
+type RetentionGapEvent struct {
+	TableName       string    `json:"table_name"`
+	CaptureInstance string    `json:"capture_instance"`
+	LastLSN         string    `json:"last_lsn"`
+	MinLSN          string    `json:"min_lsn"`
+	Policy          string    `json:"policy"`
+	DetectedAt      time.Time `json:"detected_at"`
+}
+
+// RetentionGapError is returned when a retention gap is detected and the table's policy is fail
+type RetentionGapError struct {
+	TableName string
+	LastLSN   []byte
+	MinLSN    []byte
+}
+
+func (e *RetentionGapError) Error() string {
+	return fmt.Sprintf("changes for table %s between LSN %s and %s were removed by CDC cleanup",
+		e.TableName, hex.EncodeToString(e.LastLSN), hex.EncodeToString(e.MinLSN))
+}
+
+// checkRetentionGap compares the current position with the capture instance's min LSN and applies the
+// table's retention gap policy. It returns the position to continue from, or an error when the policy is fail.
+func (m *SQLServerTableMonitor) checkRetentionGap(ctx context.Context, position Position) (Position, error) {
+	// A zero LSN means streaming from the beginning of the capture instance
+	lastLSN := position.LSN
+	if isZeroLSN(lastLSN) {
+		return position, nil
+	}
+	// The rest of a partly delivered transaction must still be retained
+	if position.SeqVal != nil {
+		lastLSN = decrementLSN(lastLSN)
+	} else if bytes.Compare(m.polledLSN, lastLSN) > 0 {
+		// Nothing was changed between the position and the LSN the last empty poll covered
+		lastLSN = m.polledLSN
+	}
+
+	minLSN, err := fetchMinLSN(ctx, m.dbConn, m.captureInstance.Name)
+	if err != nil {
+		return Position{}, err
+	}
+	if !hasRetentionGap(lastLSN, minLSN) {
+		return position, nil
+	}
+
+	policy, err := m.tableConfig.GetRetentionGapPolicy()
+	if err != nil {
+		return Position{}, err
+	}
+
+	log.Printf("Retention gap detected for table %s: last LSN %s is below min LSN %s of %s (policy: %s)",
+		m.tableName, hex.EncodeToString(lastLSN), hex.EncodeToString(minLSN), m.captureInstance.Name, policy)
+
+	event := RetentionGapEvent{
+		TableName:       m.tableName,
+		CaptureInstance: m.captureInstance.Name,
+		LastLSN:         hex.EncodeToString(lastLSN),
+		MinLSN:          hex.EncodeToString(minLSN),
+		Policy:          policy,
+		DetectedAt:      time.Now().UTC(),
+	}
+	if err := m.publishRetentionGap(event); err != nil {
+		log.Printf("Failed to publish retention gap event for table %s: %v", m.tableName, err)
+	}
+
+	switch policy {
+	case RetentionGapPolicySkip:
+		return Position{LSN: decrementLSN(minLSN)}, nil
+	case RetentionGapPolicySnapshot:
+		if err := m.TriggerIncrementalSnapshot(ctx); err != nil {
+			log.Printf("Snapshot after retention gap for table %s not started: %v", m.tableName, err)
+		}
+		return Position{LSN: decrementLSN(minLSN)}, nil
+	}
+	return Position{}, &RetentionGapError{TableName: m.tableName, LastLSN: lastLSN, MinLSN: minLSN}
+}
+
+// publishRetentionGap publishes a retention gap event to NATS
+func (m *SQLServerTableMonitor) publishRetentionGap(event RetentionGapEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal retention gap: %w", err)
+	}
+	return m.natsConn.Publish(topics.CDC.Gap, data)
+}
+
+// hasRetentionGap reports whether LSNs between lastLSN and minLSN may have been cleaned up
+func hasRetentionGap(lastLSN, minLSN []byte) bool {
+	if minLSN == nil {
+		return false
+	}
+	return bytes.Compare(incrementLSN(lastLSN), minLSN) < 0
+}
+
+// polledUpTo returns the highest LSN a poll started at maxLSN has read all changes up to, below upperLSN if set
+func polledUpTo(maxLSN, upperLSN []byte) []byte {
+	if upperLSN != nil && bytes.Compare(maxLSN, upperLSN) >= 0 {
+		return decrementLSN(upperLSN)
+	}
+	return maxLSN
+}
+
+// isZeroLSN reports whether an LSN is empty or all zero bytes
+func isZeroLSN(lsn []byte) bool {
+	for _, b := range lsn {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// incrementLSN returns the LSN immediately after lsn
+func incrementLSN(lsn []byte) []byte {
+	next := append([]byte(nil), lsn...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// decrementLSN returns the LSN immediately before lsn, so that fetching changes after it includes lsn
+func decrementLSN(lsn []byte) []byte {
+	prev := append([]byte(nil), lsn...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHasRetentionGap(t *testing.T) {
+	minLSN := []byte{0x00, 0x00, 0x01, 0x00}
+
+	if hasRetentionGap([]byte{0x00, 0x00, 0x00, 0xff}, minLSN) {
+		t.Error("expected no gap when the next LSN is the min LSN")
+	}
+	if hasRetentionGap([]byte{0x00, 0x00, 0x02, 0x00}, minLSN) {
+		t.Error("expected no gap when the last LSN is above the min LSN")
+	}
+	if !hasRetentionGap([]byte{0x00, 0x00, 0x00, 0x10}, minLSN) {
+		t.Error("expected a gap when the last LSN is below the min LSN")
+	}
+}
+
+func TestLSNArithmetic(t *testing.T) {
+	lsn := []byte{0x00, 0x01, 0x00}
+	if prev := decrementLSN(lsn); !bytes.Equal(prev, []byte{0x00, 0x00, 0xff}) {
+		t.Errorf("unexpected decrement: %x", prev)
+	}
+	if next := incrementLSN(decrementLSN(lsn)); !bytes.Equal(next, lsn) {
+		t.Errorf("unexpected increment: %x", next)
+	}
+	if !isZeroLSN(make([]byte, 10)) || isZeroLSN(lsn) {
+		t.Error("unexpected zero LSN check")
+	}
+}
+
+func TestPolledUpTo(t *testing.T) {
+	maxLSN := []byte{0x00, 0x00, 0x02, 0x00}
+
+	if polled := polledUpTo(maxLSN, nil); !bytes.Equal(polled, maxLSN) {
+		t.Errorf("expected the max LSN without an upper bound, got %x", polled)
+	}
+	if polled := polledUpTo(maxLSN, []byte{0x00, 0x00, 0x03, 0x00}); !bytes.Equal(polled, maxLSN) {
+		t.Errorf("expected the max LSN below the upper bound, got %x", polled)
+	}
+	if polled := polledUpTo(maxLSN, []byte{0x00, 0x00, 0x01, 0x00}); !bytes.Equal(polled, []byte{0x00, 0x00, 0x00, 0xff}) {
+		t.Errorf("expected the LSN before the upper bound, got %x", polled)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Components a process can run. RoleAll runs every component in one process.
+const (
+	RoleAll        = "all"
+	RoleFetcher    = "fetcher"    // Streams table changes to the bus
+	RoleCheckpoint = "checkpoint" // Serves checkpoint requests from the checkpoint store
+	RolePublisher  = "publisher"  // Delivers events from the bus to the sink
+)
+
+// Roles is the set of components run by this process
+type Roles map[string]bool
+
+// ParseRoles parses a comma-separated list of roles, e.g. "fetcher,checkpoint"
+func ParseRoles(s string) (Roles, error) {
+	roles := Roles{}
+	for _, role := range strings.Split(s, ",") {
+		switch role = strings.ToLower(strings.TrimSpace(role)); role {
+		case RoleAll:
+			roles[RoleFetcher] = true
+			roles[RoleCheckpoint] = true
+			roles[RolePublisher] = true
+		case RoleFetcher, RoleCheckpoint, RolePublisher:
+			roles[role] = true
+		default:
+			return nil, fmt.Errorf("unknown role: %q", role)
+		}
+	}
+	return roles, nil
+}
+
+// Has reports whether the role is run by this process
+func (r Roles) Has(role string) bool {
+	return r[role]
+}
+
+// String returns the roles as a sorted comma-separated list
+func (r Roles) String() string {
+	names := make([]string, 0, len(r))
+	for role := range r {
+		names = append(names, role)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
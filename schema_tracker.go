@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Monitor status values reported in schema change events
+const (
+	MonitorStatusStreaming                 = "streaming"
+	MonitorStatusAwaitingCaptureInstance   = "awaiting_capture_instance"
+	SchemaChangeKindInitial                = "initial"
+	SchemaChangeKindDDL                    = "ddl"
+	SchemaChangeKindCaptureInstanceChanged = "capture_instance_changed"
+)
+
+// CaptureInstance describes a CDC capture instance for a source table
+type CaptureInstance struct {
+	Name      string
+	StartLSN  []byte
+	CreatedAt time.Time
+}
+
+// DDLChange is a single entry from cdc.ddl_history
+type DDLChange struct {
+	Command string
+	LSN     []byte
+	Time    time.Time // In UTC
+}
+
+// SchemaChangeEvent is published on topics.CDC.Schema whenever the source schema or capture instance changes
+type SchemaChangeEvent struct {
+	TableName       string     `json:"table_name"`
+	CaptureInstance string     `json:"capture_instance"`
+	Kind            string     `json:"kind"`
+	Status          string     `json:"status"`
+	DDLCommand      string     `json:"ddl_command,omitempty"`
+	DDLLSN          string     `json:"ddl_lsn,omitempty"`
+	DDLTime         *time.Time `json:"ddl_time,omitempty"` // Absent for events without a DDL change
+	Columns         []string   `json:"columns"`
+	MissingColumns  []string   `json:"missing_columns,omitempty"`
+}
+
+// splitTableName splits "schema.table" into its parts, defaulting the schema to dbo
+func splitTableName(tableName string) (string, string) {
+	if parts := strings.SplitN(tableName, ".", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "dbo", tableName
+}
+
+// fetchCaptureInstances returns the capture instances for a source table ordered by creation time
+func fetchCaptureInstances(ctx context.Context, db *sql.DB, tableName string) ([]CaptureInstance, error) {
+	schema, table := splitTableName(tableName)
+	query := `
+        SELECT ct.capture_instance, ct.start_lsn, ct.create_date
+        FROM cdc.change_tables AS ct
+        WHERE ct.source_object_id = OBJECT_ID(QUOTENAME(@schema) + '.' + QUOTENAME(@table))
+        ORDER BY ct.create_date, ct.start_lsn
+    `
+	rows, err := db.QueryContext(ctx, query, sql.Named("schema", schema), sql.Named("table", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query capture instances for %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	var instances []CaptureInstance
+	for rows.Next() {
+		var ci CaptureInstance
+		if err := rows.Scan(&ci.Name, &ci.StartLSN, &ci.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan capture instance: %w", err)
+		}
+		instances = append(instances, ci)
+	}
+	return instances, rows.Err()
+}
+
+// fetchCapturedColumns returns the columns captured by a capture instance in ordinal order
+func fetchCapturedColumns(ctx context.Context, db *sql.DB, captureInstance string) ([]string, error) {
+	query := `
+        SELECT cc.column_name
+        FROM cdc.captured_columns AS cc
+        JOIN cdc.change_tables AS ct ON cc.object_id = ct.object_id
+        WHERE ct.capture_instance = @captureInstance
+        ORDER BY cc.column_ordinal
+    `
+	rows, err := db.QueryContext(ctx, query, sql.Named("captureInstance", captureInstance))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query captured columns for %s: %w", captureInstance, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var columnName string
+		if err := rows.Scan(&columnName); err != nil {
+			return nil, err
+		}
+		columns = append(columns, columnName)
+	}
+	return columns, rows.Err()
+}
+
+// fetchDDLChanges returns DDL statements recorded for a capture instance after the given LSN
+func fetchDDLChanges(ctx context.Context, db *sql.DB, captureInstance string, sinceLSN []byte) ([]DDLChange, error) {
+	query := fmt.Sprintf(`
+        SELECT dh.ddl_command, dh.ddl_lsn, %s
+        FROM cdc.ddl_history AS dh
+        JOIN cdc.change_tables AS ct ON dh.object_id = ct.object_id
+        WHERE ct.capture_instance = @captureInstance AND dh.ddl_lsn > @sinceLSN
+        ORDER BY dh.ddl_lsn
+    `, serverTimeToUTC("dh.ddl_time"))
+	if sinceLSN == nil {
+		sinceLSN = make([]byte, 10)
+	}
+	rows, err := db.QueryContext(ctx, query, sql.Named("captureInstance", captureInstance), sql.Named("sinceLSN", sinceLSN))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DDL history for %s: %w", captureInstance, err)
+	}
+	defer rows.Close()
+
+	var changes []DDLChange
+	for rows.Next() {
+		var ddl DDLChange
+		if err := rows.Scan(&ddl.Command, &ddl.LSN, &ddl.Time); err != nil {
+			return nil, fmt.Errorf("failed to scan DDL history: %w", err)
+		}
+		changes = append(changes, ddl)
+	}
+	return changes, rows.Err()
+}
+
+// missingColumns returns the source columns that are not captured by the capture instance
+func missingColumns(sourceColumns, capturedColumns []string) []string {
+	captured := make(map[string]bool, len(capturedColumns))
+	for _, col := range capturedColumns {
+		captured[strings.ToLower(col)] = true
+	}
+
+	var missing []string
+	for _, col := range sourceColumns {
+		if !captured[strings.ToLower(col)] {
+			missing = append(missing, col)
+		}
+	}
+	return missing
+}
+
+// newSchemaChangeEvent builds a schema change event for the monitor's current state
+func (m *SQLServerTableMonitor) newSchemaChangeEvent(kind string, ddl *DDLChange, missing []string) SchemaChangeEvent {
+	event := SchemaChangeEvent{
+		TableName:       m.tableName,
+		CaptureInstance: m.captureInstance.Name,
+		Kind:            kind,
+		Status:          m.Status(),
+		Columns:         m.columns,
+		MissingColumns:  missing,
+	}
+	if ddl != nil {
+		event.DDLCommand = ddl.Command
+		event.DDLLSN = hex.EncodeToString(ddl.LSN)
+		event.DDLTime = &ddl.Time
+	}
+	return event
+}
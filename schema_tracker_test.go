@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingColumns(t *testing.T) {
+	source := []string{"ID", "BrandName", "Color", "Year"}
+	captured := []string{"id", "BrandName", "Color"}
+
+	missing := missingColumns(source, captured)
+	if !reflect.DeepEqual(missing, []string{"Year"}) {
+		t.Fatalf("expected [Year], got %v", missing)
+	}
+
+	if missing := missingColumns(captured, source); len(missing) != 0 {
+		t.Fatalf("expected no missing columns, got %v", missing)
+	}
+}
+
+func TestSplitTableName(t *testing.T) {
+	if schema, table := splitTableName("Cars"); schema != "dbo" || table != "Cars" {
+		t.Fatalf("expected dbo.Cars, got %s.%s", schema, table)
+	}
+	if schema, table := splitTableName("sales.Orders"); schema != "sales" || table != "Orders" {
+		t.Fatalf("expected sales.Orders, got %s.%s", schema, table)
+	}
+}
@@ -1,39 +1,60 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/katasec/dstream/config"
-	"github.com/katasec/dstream/topics"
 	"github.com/nats-io/nats-server/v2/server"
-	"github.com/nats-io/nats-server/v2/test"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 // Server struct encapsulates the messaging server and its resources
 type Server struct {
-	natsServer *server.Server
+	natsServer *server.Server // Embedded NATS server, nil when connected to an external cluster
 	natsConn   *nats.Conn
+	events     jetstream.Stream // Buffers change events between the fetcher and the publisher
 	config     *config.Config
 	dbConn     *sql.DB
+	roles      Roles
 
-	checkpointWorker *CheckpointWorker
+	checkpointWorker *CheckpointWorker // Set when running the checkpoint role
+	checkpointLocks  LockProvider      // Elects the active checkpoint worker on an external bus; nil otherwise
 	cdcFetcher       *ChangeDataFetcher
-	publisher        *PublisherWorker
+	publisher        *PublisherWorker  // Set when running the publisher role
+	deadLetterAdmin  *DeadLetterAdmin  // Set when running the publisher role
+	coordinator      *TableCoordinator // Splits the tables over all running instances; set when running the fetcher role
+	supervisor       *TableSupervisor  // Restarts failed tables; set when running the fetcher role
+	stop             context.CancelFunc
+	stopped          chan struct{} // Closed once Start returned and all components it started stopped
+	shutdownTimeout  time.Duration // Deadline for a graceful shutdown
 }
 
-// NewServer creates and initializes a new messaging server
-func NewServer() *Server {
-	// Start an embedded NATS server
-	natsServer := test.RunDefaultServer()
+// NewServer creates and initializes a new messaging server running the given roles. ctx bounds the
+// setup of the streams and the checkpoint store.
+func NewServer(ctx context.Context, roles Roles) *Server {
+	cfg := config.NewConfig()
 
-	// Connect to the NATS server
-	natsConn, err := nats.Connect(nats.DefaultURL)
+	// Connect to the shared NATS cluster, or start the embedded NATS server with JetStream enabled
+	// for the key-value checkpoint store
+	var natsServer *server.Server
+	var natsConn *nats.Conn
+	var err error
+	if cfg.ExternalBus != nil {
+		natsConn, err = ConnectExternalBus(*cfg.ExternalBus, "dstream-"+cfg.GetInstanceID())
+	} else {
+		natsServer, natsConn, err = StartEmbeddedBus(cfg.GetEmbeddedBusConfig())
+	}
 	if err != nil {
-		log.Fatalf("Error connecting to NATS server: %v", err)
+		log.Fatalf("Error connecting to NATS: %v", err)
 	}
 
 	// Initialize database connection
@@ -42,70 +63,275 @@ func NewServer() *Server {
 		log.Fatalf("Failed to connect to the database: %v", err)
 	}
 
-	server := &Server{
-		natsServer: natsServer,
-		natsConn:   natsConn,
-		config:     config.NewConfig(),
-		dbConn:     dbConn,
+	// Create the stream the fetcher publishes change events to and the publisher consumes them from
+	js, err := jetstream.New(natsConn)
+	if err != nil {
+		log.Fatalf("Failed to create JetStream context: %v", err)
+	}
+	var events, deadLetters jetstream.Stream
+	if roles.Has(RoleFetcher) || roles.Has(RolePublisher) {
+		if events, err = EnsureEventStream(ctx, js, cfg.GetEventStreamConfig()); err != nil {
+			log.Fatalf("Failed to create event stream: %v", err)
+		}
+		if deadLetters, err = EnsureDeadLetterStream(ctx, js, cfg.GetDeadLetterConfig()); err != nil {
+			log.Fatalf("Failed to create dead letter stream: %v", err)
+		}
+	}
 
-		checkpointWorker: NewCheckpointWorker(dbConn, natsConn),
-		cdcFetcher:       NewChangeDataFetcher("CDCFetcher", natsConn, dbConn),
-		publisher:        NewPublisherWorker("Publisher", natsConn),
+	shutdownTimeout, err := cfg.GetShutdownTimeout()
+	if err != nil {
+		log.Fatalf("Invalid shutdown_timeout: %v", err)
 	}
 
-	return server
-}
+	s := &Server{
+		natsServer:      natsServer,
+		natsConn:        natsConn,
+		events:          events,
+		config:          cfg,
+		dbConn:          dbConn,
+		roles:           roles,
+		cdcFetcher:      NewChangeDataFetcher("CDCFetcher", natsConn, js, events, dbConn, config.DatabaseName(cfg.DBConnectionString), cfg.GetEventStreamConfig().GetPartitions(), cfg.SignalTable, cfg.GetInstanceID()),
+		stopped:         make(chan struct{}),
+		shutdownTimeout: shutdownTimeout,
+	}
 
-func (s *Server) Start() {
-	log.Println("Starting server...")
+	if roles.Has(RolePublisher) {
+		// Create the sink events are delivered to
+		sink, err := NewSink(cfg)
+		if err != nil {
+			log.Fatalf("Failed to create sink: %v", err)
+		}
+		s.publisher = NewPublisherWorker("Publisher", natsConn, sink, cfg.GetDeadLetterConfig().GetMaxAttempts())
+		s.deadLetterAdmin = NewDeadLetterAdmin(natsConn, js, deadLetters)
+	}
 
-	// Start Checkpoint Worker
-	log.Println("Starting Checkpoint Worker...")
-	s.checkpointWorker.Start()
+	if roles.Has(RoleCheckpoint) {
+		// Create the checkpoint store
+		checkpointStore, err := NewCheckpointStore(ctx, cfg, dbConn, natsConn)
+		if err != nil {
+			log.Fatalf("Failed to create checkpoint store: %v", err)
+		}
+
+		// Coalesce checkpoint writes according to the flush policy
+		checkpointConfig := cfg.GetCheckpointConfig()
+		flushInterval, err := checkpointConfig.GetFlushInterval()
+		if err != nil {
+			log.Fatalf("Invalid checkpoint flush_interval: %v", err)
+		}
+		flushPolicy := FlushPolicy{Events: checkpointConfig.GetFlushEvents(), Interval: flushInterval}
+		s.checkpointWorker = NewCheckpointWorker(checkpointStore, natsConn, checkpointConfig.GetHistorySize(), flushPolicy)
+	}
+
+	// Create the lock provider used to split the tables over the running instances and, on a bus
+	// shared by several processes, to elect the one checkpoint worker serving requests and the one
+	// publisher delivering each table partition
+	var lockProvider LockProvider
+	if roles.Has(RoleFetcher) || ((roles.Has(RoleCheckpoint) || roles.Has(RolePublisher)) && cfg.ExternalBus != nil) {
+		if lockProvider, err = NewLockProvider(ctx, cfg, dbConn); err != nil {
+			log.Fatalf("Failed to create lock provider: %v", err)
+		}
+	}
+	if roles.Has(RoleCheckpoint) && cfg.ExternalBus != nil {
+		s.checkpointLocks = lockProvider
+	}
+	if roles.Has(RolePublisher) && cfg.ExternalBus != nil {
+		s.publisher.Locks = lockProvider
+	}
+
+	if roles.Has(RoleFetcher) {
+
+		// Restart tables whose streaming failed without affecting the others
+		supervisorConfig := cfg.GetSupervisorConfig()
+		restartInterval, err := supervisorConfig.GetRestartInterval()
+		if err != nil {
+			log.Fatalf("Invalid supervisor restart_interval: %v", err)
+		}
+		maxRestartInterval, err := supervisorConfig.GetMaxRestartInterval()
+		if err != nil {
+			log.Fatalf("Invalid supervisor max_restart_interval: %v", err)
+		}
+		s.supervisor = NewTableSupervisor(s.streamTable, restartInterval, maxRestartInterval, supervisorConfig.GetUnhealthyAfter())
+		s.coordinator = NewTableCoordinator(lockProvider, cfg.Tables, cfg.Locks.Capacity, cfg.GetInstanceID(), s.supervisor.Supervise, s.releaseTable)
+	}
+
+	return s
+}
+
+// Start runs the server's roles until ctx is cancelled or one of them fails, and returns the failure.
+// It returns without waiting for the components to stop; Shutdown waits for them within its deadline
+// and stops the remaining components in order either way.
+func (s *Server) Start(ctx context.Context) error {
+	log.Printf("Starting server with roles %s...", s.roles)
 
-	// Subscribe Publisher to CDC Events
-	log.Println("Starting Publisher Worker...")
-	s.publisher.Subscribe(topics.CDC.Event)
+	ctx, cancel := context.WithCancel(ctx)
+	s.stop = cancel
+	var workers sync.WaitGroup
+	defer func() {
+		go func() {
+			workers.Wait()
+			close(s.stopped)
+		}()
+	}()
+	defer cancel()
 
-	// WaitGroup to manage goroutines
-	var wg sync.WaitGroup
+	// The first component to fail stops the others
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+		cancel()
+	}
 
-	// Loop through tables in the config
-	for _, table := range s.config.Tables {
-		tableName := table.Name
-		log.Printf("[Server] Preparing to process CDC changes for table '%s'...", tableName)
+	// Start Checkpoint Worker
+	if s.checkpointWorker != nil {
+		log.Println("Starting Checkpoint Worker...")
+		if s.checkpointLocks != nil {
+			s.checkpointWorker.StartElected(s.checkpointLocks)
+		} else if err := s.checkpointWorker.Start(); err != nil {
+			return fmt.Errorf("failed to start checkpoint worker: %w", err)
+		}
+	}
 
-		// Fetch the last LSN for the table
-		lastLSN := s.cdcFetcher.FetchLastLSN(tableName)
+	// Deliver CDC events from the event stream
+	if s.publisher != nil {
+		log.Println("Starting Publisher Worker...")
+		if err := s.deadLetterAdmin.Start(); err != nil {
+			return fmt.Errorf("failed to start dead letter admin: %w", err)
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			var tables []string
+			for _, table := range s.config.Tables {
+				tables = append(tables, table.Name)
+			}
+			database := config.DatabaseName(s.config.DBConnectionString)
+			if err := s.publisher.Consume(ctx, s.events, s.config.GetEventStreamConfig(), database, tables); err != nil {
+				fail(fmt.Errorf("publisher failed: %w", err))
+			}
+		}()
+	}
 
-		// Increment the WaitGroup counter
-		wg.Add(1)
+	if s.coordinator != nil {
+		// Create the signal table used to trigger incremental snapshots
+		if s.config.SignalTable != "" {
+			if err := initializeSignalTable(ctx, s.dbConn, s.config.SignalTable); err != nil {
+				return err
+			}
+		}
+		if err := s.supervisor.Start(s.natsConn, s.config.GetInstanceID()); err != nil {
+			return fmt.Errorf("failed to start table supervisor: %w", err)
+		}
 
-		// Launch a goroutine per table to process CDC changes
-		go s.launchProcessCDCChange(tableName, lastLSN, &wg)
+		// Stream this instance's share of the tables until the server is shut down
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.coordinator.Run(ctx)
+			log.Println("Server stopped streaming.")
+		}()
 	}
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+	<-ctx.Done()
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
+	}
+}
 
-	log.Println("All CDC changes processed. Server started successfully.")
+// streamTable streams a table from its last checkpoint while its lock is held. The checkpoint is
+// fenced with the lock's token before it is read, so a previous holder can no longer move it. Errors
+// are returned to the supervisor, which restarts the table.
+func (s *Server) streamTable(ctx context.Context, table config.TableConfig, token int64) error {
+	if err := s.cdcFetcher.FenceCheckpoint(table.Name, token); err != nil {
+		if errors.Is(err, ErrStaleFencingToken) {
+			log.Printf("[Server] Not streaming table '%s': %v", table.Name, err)
+			return nil
+		}
+		return err
+	}
+	lastPosition, hasCheckpoint, err := s.cdcFetcher.FetchLastPosition(table.Name)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Server] Processing CDC changes for table '%s'...", table.Name)
+	return s.cdcFetcher.ProcessCDCChanges(ctx, table, lastPosition, hasCheckpoint, token)
 }
 
-func (s *Server) launchProcessCDCChange(tableName string, lastLSN []byte, wg *sync.WaitGroup) {
-	defer wg.Done() // Decrement the counter when the goroutine completes
-	log.Printf("[Server] Processing CDC changes for table '%s'...", tableName)
-	s.cdcFetcher.ProcessCDCChanges(tableName, lastLSN)
+// releaseTable writes the table's buffered checkpoint before its lock is handed to another instance
+func (s *Server) releaseTable(tableName string) {
+	if err := s.cdcFetcher.FlushCheckpoint(tableName); err != nil {
+		log.Printf("[Server] Failed to flush checkpoint for table '%s': %v", tableName, err)
+	}
 }
 
-// Shutdown gracefully shuts down all server components
-func (s *Server) Shutdown() {
+// Shutdown stops the server in order, giving up on steps still running when ctx is done. Streaming
+// stops first: polls end, batches in flight are delivered, and every table flushes its checkpoint and
+// releases its lock. The checkpoint worker then writes the checkpoints it still buffers and the
+// checkpoint store is closed, after which NATS and finally the database connection are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
 	log.Println("Shutting down server...")
+	var err error
 
-	s.natsServer.Shutdown()
+	// Stop streaming and delivering events, and hand the tables over
+	if s.stop != nil {
+		s.stop()
+		if waitErr := waitUntil(ctx, s.stopped); waitErr != nil {
+			log.Printf("[Server] Components did not stop in time: %v", waitErr)
+			err = waitErr
+		}
+	}
 
-	if err := s.dbConn.Close(); err != nil {
-		log.Printf("Error closing database connection: %v", err)
+	// Write checkpoints still buffered by the flush policy
+	if s.checkpointWorker != nil {
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			s.checkpointWorker.Stop(ctx)
+		}()
+		if waitErr := waitUntil(ctx, flushed); waitErr != nil {
+			log.Printf("[Server] Checkpoints were not flushed in time: %v", waitErr)
+			err = waitErr
+		} else if closer, ok := s.checkpointWorker.store.(io.Closer); ok {
+			// Stores holding files open, such as bolt, are closed once nothing writes to them
+			if closeErr := closer.Close(); closeErr != nil {
+				log.Printf("[Server] Error closing checkpoint store: %v", closeErr)
+			}
+		}
+	}
+
+	// Stop answering admin and health requests before the connection closes
+	if s.deadLetterAdmin != nil {
+		s.deadLetterAdmin.Stop()
+	}
+	if s.supervisor != nil {
+		s.supervisor.Stop()
+	}
+
+	s.natsConn.Close()
+	if s.natsServer != nil {
+		s.natsServer.Shutdown()
+		s.natsServer.WaitForShutdown()
+	}
+
+	if closeErr := s.dbConn.Close(); closeErr != nil {
+		log.Printf("Error closing database connection: %v", closeErr)
 	}
 
 	log.Println("Server shutdown complete.")
+	return err
+}
+
+// waitUntil waits for done to be closed, returning ctx.Err() if ctx is done first
+func waitUntil(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
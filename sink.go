@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/katasec/dstream/config"
+)
+
+// Sink delivers CDC events to the configured output. Deliver returns only once the output has accepted the event,
+// or with an error once ctx is done. An error wrapping ErrEventRefused means the output can never accept the event;
+// other errors are retried.
+type Sink interface {
+	Deliver(ctx context.Context, tableName string, data []byte) error
+}
+
+// ErrEventRefused is wrapped by sink errors for events the output can never accept, which are dead-lettered
+var ErrEventRefused = errors.New("event refused by the sink")
+
+// NewSink creates the sink configured in the output block
+func NewSink(cfg *config.Config) (Sink, error) {
+	switch strings.ToLower(cfg.Output.Type) {
+	case "console", "":
+		return &ConsoleSink{}, nil
+	case "servicebus":
+		return NewServiceBusSink(cfg.Output.ConnectionString, cfg.DBConnectionString)
+	case "eventhub":
+		return NewEventHubSink(cfg.Output.ConnectionString, cfg.DBConnectionString)
+	}
+	return nil, fmt.Errorf("output type %s is not supported by the publisher", cfg.Output.Type)
+}
+
+// ConsoleSink writes events to the log
+type ConsoleSink struct{}
+
+// Deliver logs the event
+func (s *ConsoleSink) Deliver(ctx context.Context, tableName string, data []byte) error {
+	log.Printf("[ConsoleSink] %s: %s", tableName, data)
+	return nil
+}
+
+// ServiceBusSink sends events to one Service Bus topic per table, named by config.GenTopicName
+type ServiceBusSink struct {
+	client             *azservicebus.Client
+	dbConnectionString string
+	senders            map[string]*azservicebus.Sender
+	mutex              sync.Mutex
+}
+
+// NewServiceBusSink creates a sink for the given Service Bus connection string
+func NewServiceBusSink(connectionString string, dbConnectionString string) (*ServiceBusSink, error) {
+	client, err := azservicebus.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Service Bus client: %w", err)
+	}
+
+	return &ServiceBusSink{
+		client:             client,
+		dbConnectionString: dbConnectionString,
+		senders:            make(map[string]*azservicebus.Sender),
+	}, nil
+}
+
+// Deliver sends the event to the table's topic. An event larger than the topic accepts is refused.
+func (s *ServiceBusSink) Deliver(ctx context.Context, tableName string, data []byte) error {
+	sender, err := s.sender(tableName)
+	if err != nil {
+		return err
+	}
+
+	batch, err := sender.NewMessageBatch(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to send event for table %s: %w", tableName, err)
+	}
+	err = batch.AddMessage(&azservicebus.Message{Body: data}, nil)
+	if errors.Is(err, azservicebus.ErrMessageTooLarge) {
+		return fmt.Errorf("%w: event for table %s of %d bytes is too large", ErrEventRefused, tableName, len(data))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send event for table %s: %w", tableName, err)
+	}
+	if err := sender.SendMessageBatch(ctx, batch, nil); err != nil {
+		return fmt.Errorf("failed to send event for table %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// sender returns the cached sender for a table's topic, creating it on first use
+func (s *ServiceBusSink) sender(tableName string) (*azservicebus.Sender, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topicName := config.GenTopicName(s.dbConnectionString, tableName)
+	if sender, ok := s.senders[topicName]; ok {
+		return sender, nil
+	}
+
+	sender, err := s.client.NewSender(topicName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sender for topic %s: %w", topicName, err)
+	}
+	s.senders[topicName] = sender
+	return sender, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/katasec/dstream/config"
+)
+
+// eventHubTokenLifetime is how long a shared access signature sent with an event is valid
+const eventHubTokenLifetime = time.Hour
+
+// EventHubSink sends events to Azure Event Hubs over its HTTPS send API. Every table goes to its own
+// event hub named by config.GenTopicName, unless the connection string names one with EntityPath.
+// Events are sent with the table as partition key, so the events of a table stay in order.
+type EventHubSink struct {
+	endpoint           string // https://<namespace>.servicebus.windows.net
+	keyName            string
+	key                string
+	entityPath         string // Event hub all tables go to; empty for one event hub per table
+	dbConnectionString string
+	client             *http.Client
+}
+
+// NewEventHubSink creates a sink for an Event Hubs connection string of the form
+// Endpoint=sb://<namespace>.servicebus.windows.net/;SharedAccessKeyName=<name>;SharedAccessKey=<key>[;EntityPath=<hub>]
+func NewEventHubSink(connectionString string, dbConnectionString string) (*EventHubSink, error) {
+	sink := &EventHubSink{dbConnectionString: dbConnectionString, client: &http.Client{Timeout: time.Minute}}
+	for _, part := range strings.Split(connectionString, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(key) {
+		case "endpoint":
+			endpoint, err := url.Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Event Hubs endpoint: %w", err)
+			}
+			sink.endpoint = "https://" + endpoint.Host
+		case "sharedaccesskeyname":
+			sink.keyName = value
+		case "sharedaccesskey":
+			sink.key = value
+		case "entitypath":
+			sink.entityPath = value
+		}
+	}
+	if sink.endpoint == "" || sink.keyName == "" || sink.key == "" {
+		return nil, fmt.Errorf("Event Hubs connection string needs Endpoint, SharedAccessKeyName and SharedAccessKey")
+	}
+	return sink, nil
+}
+
+// Deliver sends the event to the table's event hub. An event the service rejects as malformed or too
+// large is refused; authorization, missing event hubs and service errors are retried.
+func (s *EventHubSink) Deliver(ctx context.Context, tableName string, data []byte) error {
+	hub := s.entityPath
+	if hub == "" {
+		hub = config.GenTopicName(s.dbConnectionString, tableName)
+	}
+	resource := s.endpoint + "/" + hub
+	properties, _ := json.Marshal(map[string]string{"PartitionKey": tableName})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, resource+"/messages?api-version=2014-01", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to send event for table %s: %w", tableName, err)
+	}
+	req.Header.Set("Authorization", s.signature(resource, time.Now().Add(eventHubTokenLifetime)))
+	req.Header.Set("Content-Type", "application/atom+xml;type=entry;charset=utf-8")
+	req.Header.Set("BrokerProperties", string(properties))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send event for table %s: %w", tableName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("%w: event hub %s rejected event for table %s: %s: %s", ErrEventRefused, hub, tableName, resp.Status, body)
+	}
+	return fmt.Errorf("failed to send event for table %s to event hub %s: %s: %s", tableName, hub, resp.Status, body)
+}
+
+// signature returns a shared access signature for a resource, valid until expiry
+func (s *EventHubSink) signature(resource string, expiry time.Time) string {
+	encoded := url.QueryEscape(strings.ToLower(resource))
+	seconds := fmt.Sprint(expiry.Unix())
+	mac := hmac.New(sha256.New, []byte(s.key))
+	mac.Write([]byte(encoded + "\n" + seconds))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", encoded, url.QueryEscape(sig), seconds, url.QueryEscape(s.keyName))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventHubSink(t *testing.T) {
+	if _, err := NewEventHubSink("Endpoint=sb://dstream.servicebus.windows.net/", ""); err == nil {
+		t.Fatal("expected an error for a connection string without a key")
+	}
+	sink, err := NewEventHubSink("Endpoint=sb://dstream.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=c2VjcmV0", "sqlserver://localhost?database=Inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.endpoint != "https://dstream.servicebus.windows.net" || sink.entityPath != "" {
+		t.Fatalf("unexpected sink: %+v", sink)
+	}
+
+	var paths, bodies []string
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedAccessSignature sr=") || !strings.Contains(r.Header.Get("BrokerProperties"), `"PartitionKey":"Cars"`) {
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		paths, bodies = append(paths, r.URL.Path), append(bodies, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	sink.endpoint = server.URL
+
+	// Every table has its own event hub named like its Service Bus topic
+	if err := sink.Deliver(context.TODO(), "Cars", []byte("event")); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/inventory-cars-events/messages" || bodies[0] != "event" {
+		t.Fatalf("unexpected request: %v %v", paths, bodies)
+	}
+
+	// Events the service can never accept are refused; other failures are retried
+	status = http.StatusRequestEntityTooLarge
+	if err := sink.Deliver(context.TODO(), "Cars", []byte("large")); !errors.Is(err, ErrEventRefused) {
+		t.Fatalf("expected a refused event, got %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := sink.Deliver(context.TODO(), "Cars", []byte("event")); err == nil || errors.Is(err, ErrEventRefused) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+}
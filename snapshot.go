@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// Snapshot modes and states
+const (
+	SnapshotModeInitial    = "initial"
+	SnapshotModeNever      = "never"
+	SnapshotModeWhenNeeded = "when_needed"
+
+	SnapshotStatusRunning   = "running"
+	SnapshotStatusCompleted = "completed"
+
+	OperationTypeRead = "Read"
+)
+
+// SnapshotProgress records how far a table snapshot has progressed so it can resume after a crash
+type SnapshotProgress struct {
+	Status      string        `json:"status"`
+	Incremental bool          `json:"incremental,omitempty"` // Runs alongside streaming instead of before it
+	HandoffLSN  []byte        `json:"handoff_lsn"`           // CDC resumes after this LSN once the snapshot completes
+	LastKey     []SnapshotKey `json:"last_key,omitempty"`
+	RowsRead    int64         `json:"rows_read"`
+	StartedAt   time.Time     `json:"started_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// SnapshotKey is a primary key value of the last row read by a snapshot, stored with its SQL type so
+// that the next chunk compares against it as that type
+type SnapshotKey struct {
+	Type  string `json:"type"`  // Declared type of the key column, e.g. int or nvarchar(50)
+	Value string `json:"value"` // Value as text that SQL Server casts back to the type without loss
+}
+
+// snapshotKeyTypes are the key column types a snapshot can page through
+var snapshotKeyTypes = map[string]bool{
+	"tinyint": true, "smallint": true, "int": true, "bigint": true, "bit": true,
+	"decimal": true, "numeric": true, "money": true, "smallmoney": true, "float": true, "real": true,
+	"char": true, "varchar": true, "nchar": true, "nvarchar": true, "uniqueidentifier": true,
+	"date": true, "time": true, "datetime": true, "datetime2": true, "smalldatetime": true, "datetimeoffset": true,
+}
+
+// declaredTypePattern matches the declared key types that are put into snapshot queries
+var declaredTypePattern = regexp.MustCompile(`^[a-z0-9]+(\((max|\d+)(,\d+)?\))?$`)
+
+// shouldSnapshot decides whether a table needs a snapshot before streaming
+func shouldSnapshot(mode string, hasCheckpoint bool, checkpointAvailable bool, progress *SnapshotProgress) bool {
+	if mode == SnapshotModeNever {
+		return false
+	}
+
+	// Always finish an interrupted snapshot; incremental snapshots resume while streaming instead
+	if progress != nil && progress.Status == SnapshotStatusRunning && !progress.Incremental {
+		return true
+	}
+
+	switch mode {
+	case SnapshotModeInitial:
+		return !hasCheckpoint && progress == nil
+	case SnapshotModeWhenNeeded:
+		return !hasCheckpoint || !checkpointAvailable
+	}
+	return false
+}
+
+// RunSnapshot reads the base table in primary key order and publishes every row as a Read event.
+// Progress is saved after each chunk so an interrupted snapshot resumes from the last key.
+// The returned progress carries the LSN at which CDC streaming should take over.
+func (m *SQLServerTableMonitor) RunSnapshot(ctx context.Context, progress *SnapshotProgress, saveProgress func(SnapshotProgress) error) (*SnapshotProgress, error) {
+	keyColumns, err := fetchPrimaryKeyColumns(ctx, m.dbConn, m.tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyColumns) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key; cannot snapshot", m.tableName)
+	}
+	keyTypes, err := fetchKeyColumnTypes(ctx, m.dbConn, m.tableName, keyColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	if progress == nil || progress.Status != SnapshotStatusRunning || progress.Incremental {
+		// Events and checkpoints of earlier streaming are superseded by the snapshot
+		if err := m.purgeEvents(ctx); err != nil {
+			return nil, fmt.Errorf("failed to purge pending events of table %s: %w", m.tableName, err)
+		}
+
+		// Capture the handoff position before reading any rows
+		handoffLSN, err := fetchMaxLSN(ctx, m.dbConn)
+		if err != nil {
+			return nil, err
+		}
+		progress = &SnapshotProgress{
+			Status:     SnapshotStatusRunning,
+			HandoffLSN: handoffLSN,
+			StartedAt:  time.Now().UTC(),
+			UpdatedAt:  time.Now().UTC(),
+		}
+		if err := saveProgress(*progress); err != nil {
+			return nil, err
+		}
+		log.Printf("Starting snapshot of table %s; CDC will resume after LSN %s", m.tableName, hex.EncodeToString(handoffLSN))
+	} else {
+		log.Printf("Resuming snapshot of table %s after key %v (%d rows read)", m.tableName, progress.LastKey, progress.RowsRead)
+	}
+
+	chunkSize := m.tableConfig.GetSnapshotChunkSize()
+	for {
+		events, lastKey, err := m.fetchSnapshotChunk(ctx, keyColumns, keyTypes, progress.LastKey, chunkSize, progress.HandoffLSN)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := m.deliverChanges(ctx, events); err != nil {
+			return nil, err
+		}
+
+		if len(events) > 0 {
+			progress.LastKey = lastKey
+			progress.RowsRead += int64(len(events))
+			progress.UpdatedAt = time.Now().UTC()
+			if err := saveProgress(*progress); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(events) < chunkSize {
+			break
+		}
+	}
+
+	log.Printf("Snapshot of table %s read %d rows", m.tableName, progress.RowsRead)
+	return progress, nil
+}
+
+// fetchSnapshotChunk reads the next chunk of rows after lastKey and returns them as Read events
+func (m *SQLServerTableMonitor) fetchSnapshotChunk(ctx context.Context, keyColumns, keyTypes []string, lastKey []SnapshotKey, chunkSize int, handoffLSN []byte) ([]map[string]interface{}, []SnapshotKey, error) {
+	for _, key := range lastKey {
+		if !declaredTypePattern.MatchString(key.Type) {
+			return nil, nil, fmt.Errorf("invalid snapshot key type %q for %s", key.Type, m.tableName)
+		}
+	}
+	query := buildSnapshotChunkQuery(m.tableName, keyColumns, m.columns, lastKey)
+
+	args := []interface{}{sql.Named("chunkSize", chunkSize)}
+	for i := range lastKey {
+		args = append(args, sql.Named(fmt.Sprintf("k%d", i), lastKey[i].Value))
+	}
+
+	rows, err := m.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot chunk for %s: %w", m.tableName, err)
+	}
+	defer rows.Close()
+
+	var events []map[string]interface{}
+	var chunkLastKey []SnapshotKey
+	for rows.Next() {
+		values := make([]interface{}, len(keyColumns)+len(m.columns))
+		for i := range values {
+			if i < len(keyColumns) {
+				values[i] = new(interface{})
+			} else {
+				values[i] = new(sql.NullString)
+			}
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan snapshot row: %w", err)
+		}
+
+		chunkLastKey = make([]SnapshotKey, len(keyColumns))
+		for i := range keyColumns {
+			if chunkLastKey[i], err = newSnapshotKey(keyTypes[i], *values[i].(*interface{})); err != nil {
+				return nil, nil, fmt.Errorf("failed to read key column %s of %s: %w", keyColumns[i], m.tableName, err)
+			}
+		}
+		events = append(events, newSnapshotEvent(handoffLSN, m.columns, values[len(keyColumns):]))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot rows for %s: %w", m.tableName, err)
+	}
+
+	return events, chunkLastKey, nil
+}
+
+// buildSnapshotChunkQuery builds a keyset paginated query over the base table. Key columns are
+// selected first, followed by the data columns. With a lastKey the query continues after the key
+// passed as @k0..@kN, each cast to its key type.
+func buildSnapshotChunkQuery(tableName string, keyColumns, columns []string, lastKey []SnapshotKey) string {
+	schema, table := splitTableName(tableName)
+
+	where := ""
+	if lastKey != nil {
+		// (k0 > @k0) OR (k0 = @k0 AND k1 > @k1) OR ...
+		var clauses []string
+		for i := range keyColumns {
+			var terms []string
+			for j := 0; j < i; j++ {
+				terms = append(terms, fmt.Sprintf("t.[%s] = CAST(@k%d AS %s)", keyColumns[j], j, lastKey[j].Type))
+			}
+			terms = append(terms, fmt.Sprintf("t.[%s] > CAST(@k%d AS %s)", keyColumns[i], i, lastKey[i].Type))
+			clauses = append(clauses, "("+strings.Join(terms, " AND ")+")")
+		}
+		where = "WHERE " + strings.Join(clauses, " OR ")
+	}
+
+	return fmt.Sprintf(`
+        SELECT TOP (@chunkSize) %s, %s
+        FROM [%s].[%s] AS t
+        %s
+        ORDER BY %s
+    `, quoteColumns("t", keyColumns), quoteColumns("t", columns), schema, table, where, quoteColumns("t", keyColumns))
+}
+
+// newSnapshotKey converts a scanned key column value to text that casts back to keyType without loss
+func newSnapshotKey(keyType string, value interface{}) (SnapshotKey, error) {
+	key := SnapshotKey{Type: keyType}
+	dataType, _, _ := strings.Cut(keyType, "(")
+
+	switch v := value.(type) {
+	case int64:
+		key.Value = strconv.FormatInt(v, 10)
+	case bool:
+		key.Value = "0"
+		if v {
+			key.Value = "1"
+		}
+	case float64:
+		key.Value = strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		key.Value = v
+	case []byte:
+		switch dataType {
+		case "uniqueidentifier":
+			var id mssql.UniqueIdentifier
+			if err := id.Scan(v); err != nil {
+				return key, err
+			}
+			key.Value = id.String()
+		case "decimal", "numeric", "money", "smallmoney":
+			key.Value = string(v)
+		default:
+			return key, fmt.Errorf("unsupported key type %s", keyType)
+		}
+	case time.Time:
+		switch dataType {
+		case "date":
+			key.Value = v.Format("2006-01-02")
+		case "time":
+			key.Value = v.Format("15:04:05.9999999")
+		case "datetime":
+			// datetime keeps 1/300 seconds, which round trip through milliseconds
+			key.Value = v.Round(time.Millisecond).Format("2006-01-02T15:04:05.000")
+		case "datetimeoffset":
+			key.Value = v.Format("2006-01-02T15:04:05.9999999-07:00")
+		default:
+			key.Value = v.Format("2006-01-02T15:04:05.9999999")
+		}
+	case nil:
+		return key, fmt.Errorf("key value is NULL")
+	default:
+		return key, fmt.Errorf("unsupported key type %s", keyType)
+	}
+	return key, nil
+}
+
+// newSnapshotEvent builds a Read event for a snapshot row
+func newSnapshotEvent(handoffLSN []byte, columns []string, columnData []interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+	for i, col := range columns {
+		if val, ok := columnData[i].(*sql.NullString); ok && val.Valid {
+			data[col] = val.String
+		} else {
+			data[col] = nil
+		}
+	}
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"LSN":           hex.EncodeToString(handoffLSN),
+			"OperationType": OperationTypeRead,
+			"Snapshot":      true,
+		},
+		"data": data,
+	}
+}
+
+// fetchPrimaryKeyColumns returns the primary key columns of a table in key order
+func fetchPrimaryKeyColumns(ctx context.Context, db *sql.DB, tableName string) ([]string, error) {
+	schema, table := splitTableName(tableName)
+	query := `
+        SELECT kcu.COLUMN_NAME
+        FROM INFORMATION_SCHEMA.TABLE_CONSTRAINTS AS tc
+        JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE AS kcu
+            ON tc.CONSTRAINT_NAME = kcu.CONSTRAINT_NAME
+            AND tc.TABLE_SCHEMA = kcu.TABLE_SCHEMA
+            AND tc.TABLE_NAME = kcu.TABLE_NAME
+        WHERE tc.CONSTRAINT_TYPE = 'PRIMARY KEY' AND tc.TABLE_SCHEMA = @schema AND tc.TABLE_NAME = @table
+        ORDER BY kcu.ORDINAL_POSITION
+    `
+	rows, err := db.QueryContext(ctx, query, sql.Named("schema", schema), sql.Named("table", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query primary key for %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var columnName string
+		if err := rows.Scan(&columnName); err != nil {
+			return nil, err
+		}
+		columns = append(columns, columnName)
+	}
+	return columns, rows.Err()
+}
+
+// fetchKeyColumnTypes returns the declared types of a table's primary key columns, such as nvarchar(50).
+// Tables keyed by a type a snapshot cannot page through, such as varbinary, are refused.
+func fetchKeyColumnTypes(ctx context.Context, db *sql.DB, tableName string, keyColumns []string) ([]string, error) {
+	schema, table := splitTableName(tableName)
+	query := `
+        SELECT COLUMN_NAME, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, DATETIME_PRECISION
+        FROM INFORMATION_SCHEMA.COLUMNS
+        WHERE TABLE_SCHEMA = @schema AND TABLE_NAME = @table
+    `
+	rows, err := db.QueryContext(ctx, query, sql.Named("schema", schema), sql.Named("table", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query column types for %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	declared := map[string]string{}
+	for rows.Next() {
+		var columnName, dataType string
+		var length, precision, scale, datetimePrecision sql.NullInt64
+		if err := rows.Scan(&columnName, &dataType, &length, &precision, &scale, &datetimePrecision); err != nil {
+			return nil, err
+		}
+		declared[columnName] = declaredType(dataType, length, precision, scale, datetimePrecision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	types := make([]string, len(keyColumns))
+	for i, col := range keyColumns {
+		dataType, _, _ := strings.Cut(declared[col], "(")
+		if !snapshotKeyTypes[dataType] {
+			return nil, fmt.Errorf("table %s cannot be snapshotted: primary key column %s has unsupported type %s", tableName, col, declared[col])
+		}
+		types[i] = declared[col]
+	}
+	return types, nil
+}
+
+// declaredType builds a column's declared type from its INFORMATION_SCHEMA.COLUMNS attributes
+func declaredType(dataType string, length, precision, scale, datetimePrecision sql.NullInt64) string {
+	dataType = strings.ToLower(dataType)
+	switch dataType {
+	case "char", "varchar", "nchar", "nvarchar", "binary", "varbinary":
+		if length.Int64 == -1 {
+			return dataType + "(max)"
+		}
+		return fmt.Sprintf("%s(%d)", dataType, length.Int64)
+	case "decimal", "numeric":
+		return fmt.Sprintf("%s(%d,%d)", dataType, precision.Int64, scale.Int64)
+	case "datetime2", "datetimeoffset", "time":
+		return fmt.Sprintf("%s(%d)", dataType, datetimePrecision.Int64)
+	}
+	return dataType
+}
+
+// fetchMaxLSN returns the highest LSN recorded by CDC, or the zero LSN if there is none yet
+func fetchMaxLSN(ctx context.Context, db *sql.DB) ([]byte, error) {
+	var lsn []byte
+	if err := db.QueryRowContext(ctx, `SELECT sys.fn_cdc_get_max_lsn()`).Scan(&lsn); err != nil {
+		return nil, fmt.Errorf("failed to query max LSN: %w", err)
+	}
+	if lsn == nil {
+		lsn = make([]byte, 10)
+	}
+	return lsn, nil
+}
+
+// fetchMinLSN returns the lowest LSN still available for a capture instance
+func fetchMinLSN(ctx context.Context, db *sql.DB, captureInstance string) ([]byte, error) {
+	var lsn []byte
+	err := db.QueryRowContext(ctx, `SELECT sys.fn_cdc_get_min_lsn(@captureInstance)`, sql.Named("captureInstance", captureInstance)).Scan(&lsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query min LSN for %s: %w", captureInstance, err)
+	}
+	return lsn, nil
+}
+
+// CheckpointAvailable reports whether changes after lastLSN are still retained by the current capture instance
+func (m *SQLServerTableMonitor) CheckpointAvailable(ctx context.Context, lastLSN []byte) (bool, error) {
+	minLSN, err := fetchMinLSN(ctx, m.dbConn, m.captureInstance.Name)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Compare(lastLSN, minLSN) >= 0, nil
+}
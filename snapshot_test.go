@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldSnapshot(t *testing.T) {
+	running := &SnapshotProgress{Status: SnapshotStatusRunning}
+	completed := &SnapshotProgress{Status: SnapshotStatusCompleted}
+	incremental := &SnapshotProgress{Status: SnapshotStatusRunning, Incremental: true}
+
+	tests := []struct {
+		name          string
+		mode          string
+		hasCheckpoint bool
+		available     bool
+		progress      *SnapshotProgress
+		expected      bool
+	}{
+		{"never", SnapshotModeNever, false, true, nil, false},
+		{"never ignores running snapshot", SnapshotModeNever, false, true, running, false},
+		{"initial without checkpoint", SnapshotModeInitial, false, true, nil, true},
+		{"initial with checkpoint", SnapshotModeInitial, true, true, nil, false},
+		{"initial already completed", SnapshotModeInitial, false, true, completed, false},
+		{"initial resumes running snapshot", SnapshotModeInitial, true, true, running, true},
+		{"incremental snapshot resumes while streaming", SnapshotModeInitial, true, true, incremental, false},
+		{"when_needed with valid checkpoint", SnapshotModeWhenNeeded, true, true, completed, false},
+		{"when_needed with expired checkpoint", SnapshotModeWhenNeeded, true, false, completed, true},
+		{"when_needed without checkpoint", SnapshotModeWhenNeeded, false, true, nil, true},
+	}
+
+	for _, tt := range tests {
+		if got := shouldSnapshot(tt.mode, tt.hasCheckpoint, tt.available, tt.progress); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestBuildSnapshotChunkQuery(t *testing.T) {
+	lastKey := []SnapshotKey{{Type: "nvarchar(20)", Value: "North"}, {Type: "int", Value: "42"}}
+	query := buildSnapshotChunkQuery("sales.Orders", []string{"Region", "ID"}, []string{"Amount"}, lastKey)
+
+	expected := []string{
+		"FROM [sales].[Orders] AS t",
+		"WHERE (t.[Region] > CAST(@k0 AS nvarchar(20))) OR (t.[Region] = CAST(@k0 AS nvarchar(20)) AND t.[ID] > CAST(@k1 AS int))",
+		"ORDER BY t.[Region], t.[ID]",
+	}
+	for _, e := range expected {
+		if !strings.Contains(query, e) {
+			t.Errorf("expected query to contain %q, got:\n%s", e, query)
+		}
+	}
+
+	if first := buildSnapshotChunkQuery("Cars", []string{"ID"}, []string{"Color"}, nil); strings.Contains(first, "WHERE") {
+		t.Errorf("expected first chunk query without WHERE, got:\n%s", first)
+	}
+}
+
+func TestNewSnapshotKey(t *testing.T) {
+	at := time.Date(2024, 3, 1, 10, 30, 15, 3333333, time.FixedZone("", 2*3600))
+	tests := []struct {
+		keyType  string
+		value    interface{}
+		expected string
+	}{
+		{"bigint", int64(9007199254740993), "9007199254740993"},
+		{"bit", true, "1"},
+		{"float", 0.1, "0.1"},
+		{"decimal(18,2)", []byte("12.50"), "12.50"},
+		{"nvarchar(50)", "Zoë", "Zoë"},
+		{"uniqueidentifier", []byte{0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}, "01234567-89AB-CDEF-0123-456789ABCDEF"},
+		{"date", at, "2024-03-01"},
+		{"datetime", at, "2024-03-01T10:30:15.003"},
+		{"datetime2(7)", at, "2024-03-01T10:30:15.0033333"},
+		{"datetimeoffset(7)", at, "2024-03-01T10:30:15.0033333+02:00"},
+	}
+	for _, tt := range tests {
+		key, err := newSnapshotKey(tt.keyType, tt.value)
+		if err != nil || key != (SnapshotKey{Type: tt.keyType, Value: tt.expected}) {
+			t.Errorf("%s: expected %q, got %+v (err=%v)", tt.keyType, tt.expected, key, err)
+		}
+	}
+
+	if _, err := newSnapshotKey("varbinary(16)", []byte{1, 2}); err == nil {
+		t.Error("expected binary keys to be refused")
+	}
+}
+
+func TestDeclaredType(t *testing.T) {
+	n := func(v int64) sql.NullInt64 { return sql.NullInt64{Int64: v, Valid: true} }
+	tests := []struct {
+		dataType                              string
+		length, precision, scale, dtPrecision sql.NullInt64
+		expected                              string
+	}{
+		{"int", sql.NullInt64{}, n(10), n(0), sql.NullInt64{}, "int"},
+		{"nvarchar", n(50), sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}, "nvarchar(50)"},
+		{"varchar", n(-1), sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}, "varchar(max)"},
+		{"decimal", sql.NullInt64{}, n(18), n(2), sql.NullInt64{}, "decimal(18,2)"},
+		{"datetime2", sql.NullInt64{}, sql.NullInt64{}, sql.NullInt64{}, n(3), "datetime2(3)"},
+	}
+	for _, tt := range tests {
+		if got := declaredType(tt.dataType, tt.length, tt.precision, tt.scale, tt.dtPrecision); got != tt.expected || !declaredTypePattern.MatchString(got) {
+			t.Errorf("%s: expected %s, got %s", tt.dataType, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/katasec/dstream/config"
+)
+
+// Lock name prefixes used by the table coordinator
+const (
+	instanceLockPrefix = "instance-"
+	tableLockPrefix    = "table-"
+)
+
+// TableCoordinator splits the configured tables over all running instances. Every table is guarded by
+// its own lock and an instance streams only the tables it holds. Instances announce themselves with an
+// instance lock; each takes an even share of the tables, capped by its capacity, so tables move to a
+// new instance when it joins and are picked up by the others when an instance leaves or crashes.
+type TableCoordinator struct {
+	provider   LockProvider
+	tables     []config.TableConfig
+	capacity   int // Maximum number of tables held, 0 for no limit
+	instanceID string
+	interval   time.Duration // How often the share is rebalanced
+
+	stream  func(ctx context.Context, table config.TableConfig, token int64) // Streams a table under the lock's fencing token until ctx is cancelled
+	release func(tableName string)                                           // Called after a table's stream stopped, before its lock is released
+
+	instance *LockKeeper
+	owned    map[string]*ownedTable
+}
+
+// ownedTable is a table streamed by this instance
+type ownedTable struct {
+	keeper *LockKeeper
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewTableCoordinator creates a coordinator for the given tables. stream runs a table's monitor and
+// release is called once it has stopped, before the table is handed to another instance.
+func NewTableCoordinator(provider LockProvider, tables []config.TableConfig, capacity int, instanceID string,
+	stream func(ctx context.Context, table config.TableConfig, token int64), release func(tableName string)) *TableCoordinator {
+	return &TableCoordinator{
+		provider:   provider,
+		tables:     tables,
+		capacity:   capacity,
+		instanceID: instanceID,
+		interval:   provider.LeaseDuration() / 3,
+		stream:     stream,
+		release:    release,
+		instance:   NewLockKeeper(provider, instanceLockPrefix+instanceID),
+		owned:      map[string]*ownedTable{},
+	}
+}
+
+// Run announces the instance and rebalances its tables until ctx is cancelled, after which all tables
+// are stopped and released
+func (c *TableCoordinator) Run(ctx context.Context) {
+	defer func() { c.instance.Release() }()
+	if c.instance.Acquire(ctx) != nil {
+		return
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.instance.Lost():
+			// The other instances no longer count this one, so its share would be taken twice
+			log.Printf("[TableCoordinator] Lost instance lock; releasing all tables")
+			c.stopAll()
+			c.instance = NewLockKeeper(c.provider, instanceLockPrefix+c.instanceID)
+			if c.instance.Acquire(ctx) != nil {
+				return
+			}
+		default:
+		}
+
+		c.rebalance(ctx)
+
+		select {
+		case <-ctx.Done():
+			c.stopAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rebalance drops lost tables, releases tables beyond the instance's share and acquires free tables up to it
+func (c *TableCoordinator) rebalance(ctx context.Context) {
+	for name, table := range c.owned {
+		select {
+		case <-table.keeper.Lost():
+			log.Printf("[TableCoordinator] Lost lock on table '%s'", name)
+			c.stopTable(name)
+		case <-table.done:
+			log.Printf("[TableCoordinator] Stream of table '%s' ended", name)
+			c.stopTable(name)
+		default:
+		}
+	}
+
+	instances, err := c.provider.HeldLocks(ctx, instanceLockPrefix)
+	if err != nil {
+		log.Printf("[TableCoordinator] Failed to list instances: %v", err)
+		return
+	}
+	target := tableShare(len(c.tables), len(instances), c.capacity)
+
+	// Hand the last tables over to other instances until this one holds its share
+	if excess := len(c.owned) - target; excess > 0 {
+		names := c.ownedNames()
+		for _, name := range names[len(names)-excess:] {
+			log.Printf("[TableCoordinator] Releasing table '%s' to rebalance %d tables over %d instances", name, len(c.tables), len(instances))
+			c.stopTable(name)
+		}
+	}
+
+	for _, table := range c.tables {
+		if len(c.owned) >= target {
+			break
+		}
+		if _, ok := c.owned[table.Name]; ok {
+			continue
+		}
+		keeper := NewLockKeeper(c.provider, tableLockPrefix+table.Name)
+		if err := keeper.TryAcquire(ctx); err != nil {
+			if !errors.Is(err, ErrLockHeld) {
+				log.Printf("[TableCoordinator] Failed to acquire table '%s': %v", table.Name, err)
+			}
+			continue
+		}
+		c.startTable(ctx, table, keeper)
+	}
+}
+
+// startTable streams a table whose lock was just acquired. Losing the lock stops the stream at once
+// since another instance may already be streaming the table.
+func (c *TableCoordinator) startTable(ctx context.Context, table config.TableConfig, keeper *LockKeeper) {
+	ctx, cancel := context.WithCancel(ctx)
+	owned := &ownedTable{keeper: keeper, cancel: cancel, done: make(chan struct{})}
+	c.owned[table.Name] = owned
+
+	token := keeper.Token()
+	log.Printf("[TableCoordinator] Streaming table '%s' with fencing token %d", table.Name, token)
+	go func() {
+		defer close(owned.done)
+		c.stream(ctx, table, token)
+	}()
+	go func() {
+		select {
+		case <-keeper.Lost():
+			cancel()
+		case <-owned.done:
+		}
+	}()
+}
+
+// stopTable stops streaming a table and releases its lock
+func (c *TableCoordinator) stopTable(name string) {
+	owned := c.owned[name]
+	delete(c.owned, name)
+
+	owned.cancel()
+	<-owned.done
+	c.release(name)
+	owned.keeper.Release()
+	log.Printf("[TableCoordinator] Stopped streaming table '%s'", name)
+}
+
+// stopAll stops and releases every table held by this instance
+func (c *TableCoordinator) stopAll() {
+	for _, name := range c.ownedNames() {
+		c.stopTable(name)
+	}
+}
+
+// ownedNames returns the names of the held tables in sorted order
+func (c *TableCoordinator) ownedNames() []string {
+	names := make([]string, 0, len(c.owned))
+	for name := range c.owned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tableShare returns how many of the tables one of the instances takes: an even share rounded up,
+// capped by capacity when it is set
+func tableShare(tables, instances, capacity int) int {
+	if instances < 1 {
+		instances = 1
+	}
+	share := (tables + instances - 1) / instances
+	if capacity > 0 && share > capacity {
+		share = capacity
+	}
+	return share
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katasec/dstream/config"
+)
+
+func TestTableShare(t *testing.T) {
+	tests := []struct {
+		tables, instances, capacity, want int
+	}{
+		{tables: 4, instances: 0, capacity: 0, want: 4},
+		{tables: 4, instances: 1, capacity: 0, want: 4},
+		{tables: 4, instances: 2, capacity: 0, want: 2},
+		{tables: 5, instances: 2, capacity: 0, want: 3},
+		{tables: 5, instances: 2, capacity: 2, want: 2},
+		{tables: 2, instances: 3, capacity: 0, want: 1},
+	}
+	for _, tt := range tests {
+		if got := tableShare(tt.tables, tt.instances, tt.capacity); got != tt.want {
+			t.Errorf("tableShare(%d, %d, %d) = %d, want %d", tt.tables, tt.instances, tt.capacity, got, tt.want)
+		}
+	}
+}
+
+// streamRecorder tracks which instance streams which table and fails on a table streamed twice
+type streamRecorder struct {
+	t       *testing.T
+	mutex   sync.Mutex
+	running map[string]string
+}
+
+func (r *streamRecorder) stream(instanceID string) func(ctx context.Context, table config.TableConfig, token int64) {
+	return func(ctx context.Context, table config.TableConfig, token int64) {
+		r.mutex.Lock()
+		if owner, ok := r.running[table.Name]; ok {
+			r.t.Errorf("table %s streamed by %s and %s", table.Name, owner, instanceID)
+		}
+		r.running[table.Name] = instanceID
+		r.mutex.Unlock()
+
+		<-ctx.Done()
+
+		r.mutex.Lock()
+		delete(r.running, table.Name)
+		r.mutex.Unlock()
+	}
+}
+
+// counts returns the number of tables streamed per instance
+func (r *streamRecorder) counts() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := map[string]int{}
+	for _, instanceID := range r.running {
+		counts[instanceID]++
+	}
+	return counts
+}
+
+func (r *streamRecorder) waitFor(want map[string]int) {
+	r.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		counts := r.counts()
+		if len(counts) == len(want) {
+			matched := true
+			for instanceID, n := range want {
+				matched = matched && counts[instanceID] == n
+			}
+			if matched {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.t.Fatalf("expected tables per instance %v, got %v", want, r.counts())
+}
+
+func TestTableCoordinatorRebalances(t *testing.T) {
+	provider := newMemoryLockProvider(60 * time.Millisecond)
+	tables := []config.TableConfig{{Name: "A"}, {Name: "B"}, {Name: "C"}, {Name: "D"}}
+	recorder := &streamRecorder{t: t, running: map[string]string{}}
+
+	var released sync.Map
+	release := func(tableName string) { released.Store(tableName, true) }
+
+	// A single instance streams every table
+	first := NewTableCoordinator(provider, tables, 0, "first", recorder.stream("first"), release)
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(firstCtx)
+		close(firstDone)
+	}()
+	recorder.waitFor(map[string]int{"first": 4})
+
+	// A second instance joining takes half of the tables
+	second := NewTableCoordinator(provider, tables, 0, "second", recorder.stream("second"), release)
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	secondDone := make(chan struct{})
+	go func() {
+		second.Run(secondCtx)
+		close(secondDone)
+	}()
+	recorder.waitFor(map[string]int{"first": 2, "second": 2})
+
+	// When the first instance leaves, the second takes all tables over
+	stopFirst()
+	<-firstDone
+	recorder.waitFor(map[string]int{"second": 4})
+	for _, table := range tables {
+		if _, ok := released.Load(table.Name); !ok {
+			t.Errorf("expected table %s to be released before the hand-over", table.Name)
+		}
+	}
+
+	stopSecond()
+	<-secondDone
+	if held, _ := provider.HeldLocks(context.TODO(), ""); len(held) != 0 {
+		t.Fatalf("expected all locks to be released, still held: %v", held)
+	}
+}
+
+func TestTableCoordinatorCapacity(t *testing.T) {
+	provider := newMemoryLockProvider(60 * time.Millisecond)
+	tables := []config.TableConfig{{Name: "A"}, {Name: "B"}, {Name: "C"}}
+	recorder := &streamRecorder{t: t, running: map[string]string{}}
+
+	coordinator := NewTableCoordinator(provider, tables, 2, "only", recorder.stream("only"), func(string) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		coordinator.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	recorder.waitFor(map[string]int{"only": 2})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/katasec/dstream/utils"
+	"github.com/nats-io/nats.go"
+)
+
+// Health states of a supervised table
+const (
+	TableStatusStreaming  = "streaming"  // Streaming without recent failures
+	TableStatusRestarting = "restarting" // Failed and restarted, but has not streamed long enough since to be trusted
+	TableStatusUnhealthy  = "unhealthy"  // Failed too many times in a row; restarts continue with backoff
+)
+
+// tableStableRun is how long a table has to stream before its earlier failures are forgotten
+const tableStableRun = time.Minute
+
+// TableHealth is the supervisor's view of a table streamed by this instance
+type TableHealth struct {
+	TableName     string     `json:"table_name"`
+	Status        string     `json:"status"`
+	Failures      int        `json:"failures"` // Consecutive failures
+	Restarts      int        `json:"restarts"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// TableHealthResponse is an instance's answer to a topics.Health request
+type TableHealthResponse struct {
+	InstanceID string        `json:"instance_id"`
+	Tables     []TableHealth `json:"tables"`
+}
+
+// TableSupervisor restarts the tables whose streaming failed, with backoff, so that a failing table
+// takes neither the process nor the other tables down
+type TableSupervisor struct {
+	run                func(ctx context.Context, table config.TableConfig, token int64) error
+	restartInterval    time.Duration
+	maxRestartInterval time.Duration
+	unhealthyAfter     int           // Consecutive failures before a table is reported unhealthy
+	stableRun          time.Duration // How long a table has to stream before its failures are forgotten
+
+	mutex  sync.Mutex
+	tables map[string]*TableHealth
+	subs   []*nats.Subscription // Subscription to health requests, while started
+}
+
+// NewTableSupervisor creates a supervisor streaming tables with run. A failed table is restarted after
+// restartInterval, doubling up to maxRestartInterval, and is reported unhealthy after unhealthyAfter
+// consecutive failures.
+func NewTableSupervisor(run func(ctx context.Context, table config.TableConfig, token int64) error, restartInterval, maxRestartInterval time.Duration, unhealthyAfter int) *TableSupervisor {
+	return &TableSupervisor{
+		run:                run,
+		restartInterval:    restartInterval,
+		maxRestartInterval: maxRestartInterval,
+		unhealthyAfter:     unhealthyAfter,
+		stableRun:          tableStableRun,
+		tables:             map[string]*TableHealth{},
+	}
+}
+
+// Supervise streams a table until ctx is cancelled or the table stops without an error, e.g. after another
+// instance took it over. A failed table is restarted with backoff and keeps being restarted after it was
+// reported unhealthy, so that it recovers once the cause is fixed.
+func (s *TableSupervisor) Supervise(ctx context.Context, table config.TableConfig, token int64) {
+	s.mutex.Lock()
+	s.tables[table.Name] = &TableHealth{TableName: table.Name, Status: TableStatusStreaming}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.tables, table.Name)
+		s.mutex.Unlock()
+	}()
+
+	backoff := NewBackoffManager(s.restartInterval, s.maxRestartInterval)
+	for {
+		started := time.Now().UTC()
+		stable := time.AfterFunc(s.stableRun, func() { s.recovered(table.Name, started) })
+		err := s.run(ctx, table, token)
+		stable.Stop()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			log.Printf("[TableSupervisor] Table '%s' stopped streaming", table.Name)
+			return
+		}
+		if time.Since(started) >= s.stableRun {
+			backoff.ResetInterval()
+		}
+
+		health := s.failed(table.Name, err)
+		log.Printf("[TableSupervisor] Table '%s' failed (%d in a row, %s), restarting in %s: %v",
+			table.Name, health.Failures, health.Status, backoff.GetInterval(), err)
+		if sleep(ctx, backoff.GetInterval()) != nil {
+			return
+		}
+		backoff.IncreaseInterval()
+
+		s.mutex.Lock()
+		s.tables[table.Name].Restarts++
+		s.mutex.Unlock()
+	}
+}
+
+// failed records a failure of a table and returns its updated health
+func (s *TableSupervisor) failed(tableName string, err error) TableHealth {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UTC()
+	health := s.tables[tableName]
+	health.Failures++
+	health.LastError = err.Error()
+	health.LastFailureAt = &now
+	health.Status = TableStatusRestarting
+	if health.Failures >= s.unhealthyAfter {
+		if health.Failures == s.unhealthyAfter {
+			log.Printf("[TableSupervisor] Table '%s' is unhealthy after %d consecutive failures", tableName, health.Failures)
+		}
+		health.Status = TableStatusUnhealthy
+	}
+	return *health
+}
+
+// recovered forgets the failures of a table that has been streaming since started for the stable run time
+func (s *TableSupervisor) recovered(tableName string, started time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	health, ok := s.tables[tableName]
+	if !ok || health.Failures == 0 || health.LastFailureAt.After(started) {
+		return
+	}
+	log.Printf("[TableSupervisor] Table '%s' recovered after %d consecutive failures", tableName, health.Failures)
+	health.Failures = 0
+	health.Status = TableStatusStreaming
+}
+
+// Health returns the health of the supervised tables sorted by name
+func (s *TableSupervisor) Health() []TableHealth {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tables := make([]TableHealth, 0, len(s.tables))
+	for _, health := range s.tables {
+		tables = append(tables, *health)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].TableName < tables[j].TableName })
+	return tables
+}
+
+// Start answers topics.Health requests with the health of the supervised tables. Every instance
+// answers, so a requester collecting all replies sees every streamed table.
+func (s *TableSupervisor) Start(nc *nats.Conn, instanceID string) error {
+	sub, err := utils.Subscribe("TableSupervisor", nc, topics.Health, func(msg *nats.Msg) {
+		respData, _ := json.Marshal(TableHealthResponse{InstanceID: instanceID, Tables: s.Health()})
+		if err := msg.Respond(respData); err != nil {
+			log.Printf("[TableSupervisor] Failed to send health response: %v", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.subs = append(s.subs, sub)
+	s.mutex.Unlock()
+	return nil
+}
+
+// Stop stops answering health requests
+func (s *TableSupervisor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	utils.Unsubscribe(s.subs)
+	s.subs = nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katasec/dstream/config"
+	"github.com/katasec/dstream/topics"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// flakyTables fails a table's runs until its remaining failures are used up, after which it streams until cancelled
+type flakyTables struct {
+	mutex    sync.Mutex
+	failures map[string]int // Remaining failures per table, -1 to fail forever
+	runs     map[string]int
+}
+
+func (f *flakyTables) run(ctx context.Context, table config.TableConfig, token int64) error {
+	f.mutex.Lock()
+	f.runs[table.Name]++
+	remaining := f.failures[table.Name]
+	if remaining > 0 {
+		f.failures[table.Name]--
+	}
+	f.mutex.Unlock()
+
+	if remaining != 0 {
+		return errors.New("capture instance missing")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// waitForHealth waits until the table reports the given status
+func waitForHealth(t *testing.T, s *TableSupervisor, tableName, status string) TableHealth {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, health := range s.Health() {
+			if health.TableName == tableName && health.Status == status {
+				return health
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("table %s did not become %s: %+v", tableName, status, s.Health())
+	return TableHealth{}
+}
+
+func TestTableSupervisor(t *testing.T) {
+	tables := &flakyTables{failures: map[string]int{"Broken": -1, "Flaky": 3}, runs: map[string]int{}}
+	supervisor := NewTableSupervisor(tables.run, time.Millisecond, 10*time.Millisecond, 3)
+	supervisor.stableRun = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, name := range []string{"Broken", "Flaky", "Healthy"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			supervisor.Supervise(ctx, config.TableConfig{Name: name}, 1)
+		}()
+	}
+
+	// A table failing repeatedly is reported unhealthy and keeps being restarted
+	broken := waitForHealth(t, supervisor, "Broken", TableStatusUnhealthy)
+	if broken.Failures < 3 || broken.LastError != "capture instance missing" || broken.LastFailureAt == nil {
+		t.Fatalf("unexpected health of the broken table: %+v", broken)
+	}
+
+	// A table that streams again after failing recovers once it ran for the stable run time
+	flaky := waitForHealth(t, supervisor, "Flaky", TableStatusStreaming)
+	if flaky.Failures != 0 || flaky.Restarts != 3 {
+		t.Fatalf("expected the flaky table to recover after 3 restarts, got %+v", flaky)
+	}
+
+	// The failing tables never stopped the healthy one
+	tables.mutex.Lock()
+	healthyRuns := tables.runs["Healthy"]
+	tables.mutex.Unlock()
+	if healthyRuns != 1 {
+		t.Fatalf("expected the healthy table to be started once, got %d runs", healthyRuns)
+	}
+
+	// Every instance answers health requests with the tables it streams
+	natsServer := test.RunRandClientPortServer()
+	t.Cleanup(natsServer.Shutdown)
+	nc, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	if err := supervisor.Start(nc, "instance-1"); err != nil {
+		t.Fatal(err)
+	}
+	resp := request[TableHealthResponse](t, nc, topics.Health, struct{}{})
+	if resp.InstanceID != "instance-1" || len(resp.Tables) != 3 || resp.Tables[0].TableName != "Broken" || resp.Tables[0].Status != TableStatusUnhealthy {
+		t.Fatalf("unexpected health response: %+v", resp)
+	}
+
+	// Stopped tables are no longer reported
+	cancel()
+	wg.Wait()
+	if health := supervisor.Health(); len(health) != 0 {
+		t.Fatalf("expected no supervised tables after stopping, got %+v", health)
+	}
+
+	// A stopped supervisor no longer answers health requests
+	supervisor.Stop()
+	if _, err := nc.Request(topics.Health, []byte("{}"), 200*time.Millisecond); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders after stopping, got %v", err)
+	}
+}
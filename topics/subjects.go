@@ -0,0 +1,100 @@
+package topics
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Tokens used for parts of an event subject that are unknown or left open
+const (
+	UnknownToken  = "unknown"
+	WildcardToken = "*"
+)
+
+// AnyPartition is passed to PartitionFilter to match every partition
+const AnyPartition = -1
+
+// EventSubject returns the subject a change event is published on, cdc.event.<db>.<schema>.<table>.<op>,
+// e.g. cdc.event.inventory.dbo.cars.insert. Tokens are lower-cased like the topic names of
+// config.GenTopicName, so a table's subject and its sink topic name the same database and table.
+func EventSubject(db, schema, table, op string) string {
+	return strings.Join([]string{CDC.Event, Token(db), Token(schema), Token(table), Token(op)}, ".")
+}
+
+// EventFilter returns a subject matching the change events of the given database, schema, table
+// and operation. Empty arguments match any value, e.g. EventFilter("inventory", "", "", "delete")
+// is cdc.event.inventory.*.*.delete.
+func EventFilter(db, schema, table, op string) string {
+	tokens := []string{CDC.Event}
+	for _, part := range []string{db, schema, table, op} {
+		tokens = append(tokens, filterToken(part))
+	}
+	return strings.Join(tokens, ".")
+}
+
+// ParseEventSubject splits an event subject into its database, schema, table and operation tokens.
+// It returns false for subjects that are not event subjects.
+func ParseEventSubject(subject string) (db, schema, table, op string, ok bool) {
+	rest, found := strings.CutPrefix(subject, CDC.Event+".")
+	if !found {
+		return "", "", "", "", false
+	}
+	tokens := strings.Split(rest, ".")
+	if len(tokens) != 4 {
+		return "", "", "", "", false
+	}
+	return tokens[0], tokens[1], tokens[2], tokens[3], true
+}
+
+// PartitionSubject returns the subject a change event is stored on in the event stream,
+// cdc.partition.<db>.<schema>.<table>.<partition>.<op>, e.g. cdc.partition.inventory.dbo.cars.0.insert.
+// Events of one row always share a partition, so they stay in order when partitions are consumed in
+// parallel. The stream republishes stored events on their EventSubject, see PartitionRepublish.
+func PartitionSubject(db, schema, table string, partition int, op string) string {
+	return strings.Join([]string{CDC.Partition, Token(db), Token(schema), Token(table), strconv.Itoa(partition), Token(op)}, ".")
+}
+
+// PartitionFilter returns a subject matching the stored events of a partition of a table, in any operation.
+// Empty names match any value and AnyPartition matches every partition, e.g. PartitionFilter("inventory",
+// "dbo", "cars", AnyPartition) is cdc.partition.inventory.dbo.cars.*.*.
+func PartitionFilter(db, schema, table string, partition int) string {
+	tokens := []string{CDC.Partition, filterToken(db), filterToken(schema), filterToken(table), WildcardToken, WildcardToken}
+	if partition != AnyPartition {
+		tokens[4] = strconv.Itoa(partition)
+	}
+	return strings.Join(tokens, ".")
+}
+
+// PartitionRepublish returns the subject transform republishing events stored on partition subjects
+// on the event subject of the same database, schema, table and operation
+func PartitionRepublish() (source, destination string) {
+	return PartitionFilter("", "", "", AnyPartition), CDC.Event + ".{{wildcard(1)}}.{{wildcard(2)}}.{{wildcard(3)}}.{{wildcard(5)}}"
+}
+
+// filterToken returns the subject token of a name, or a wildcard for an empty name
+func filterToken(name string) string {
+	if name == "" {
+		return WildcardToken
+	}
+	return Token(name)
+}
+
+// DeadLetterSubject returns the subject dead letters of a table are kept on, e.g. cdc.dlq.sales_orders
+func DeadLetterSubject(table string) string {
+	return CDC.DeadLetter + "." + Token(table)
+}
+
+// Token turns a name into a single subject token: it is lower-cased, and separators, wildcards and
+// whitespace are replaced with underscores. An empty name becomes UnknownToken.
+func Token(name string) string {
+	if name == "" {
+		return UnknownToken
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, strings.ToLower(name))
+}
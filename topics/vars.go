@@ -1,20 +1,80 @@
 package topics
 
 type checkpoint struct {
-	Load string
-	Save string
+	Load         string
+	Save         string
+	LoadSnapshot string
+	SaveSnapshot string
+	List         string
+	Delete       string
+	History      string
+	Rewind       string
+	Metrics      string
+	Fence        string
+	Flush        string
+	Validate     string
 }
 
 type cdcSubjects struct {
-	Event string
+	Event      string
+	Partition  string
+	Schema     string
+	Gap        string
+	DeadLetter string
 }
 
 // Directly export the Checkpoints and CDC variables
 var Checkpoints = checkpoint{
-	Load: "checkpoint.load",
-	Save: "checkpoint.save",
+	Load:         "checkpoint.load",
+	Save:         "checkpoint.save",
+	LoadSnapshot: "checkpoint.snapshot.load",
+	SaveSnapshot: "checkpoint.snapshot.save",
+	List:         "checkpoint.list",
+	Delete:       "checkpoint.delete",
+	History:      "checkpoint.history",
+	Rewind:       "checkpoint.rewind",
+	Metrics:      "checkpoint.metrics",
+	Fence:        "checkpoint.fence",
+	Flush:        "checkpoint.flush",
+	Validate:     "checkpoint.validate",
 }
 
+// CDC.Event is the prefix of the event subjects built by EventSubject
 var CDC = cdcSubjects{
-	Event: "cdc.event",
+	Event:      "cdc.event",
+	Partition:  "cdc.partition", // Events as stored in the event stream, see PartitionSubject
+	Schema:     "cdc.schema",
+	Gap:        "cdc.gap",
+	DeadLetter: "cdc.dlq", // Suffixed with the table, see DeadLetterSubject
+}
+
+type adminSubjects struct {
+	SnapshotTrigger string
+	SnapshotStatus  string
+	Rewind          string
+}
+
+type deadLetterSubjects struct {
+	List    string
+	Inspect string
+	Replay  string
+	Purge   string
+}
+
+// DeadLetters are the admin subjects managing the dead letter stream
+var DeadLetters = deadLetterSubjects{
+	List:    "admin.dlq.list",
+	Inspect: "admin.dlq.inspect",
+	Replay:  "admin.dlq.replay",
+	Purge:   "admin.dlq.purge",
+}
+
+// Health is the subject every fetcher answers with the health of the tables it streams
+var Health = "admin.health"
+
+// Admin subjects are suffixed with the table name, e.g. admin.snapshot.trigger.Cars
+var Admin = adminSubjects{
+	SnapshotTrigger: "admin.snapshot.trigger",
+	SnapshotStatus:  "admin.snapshot.status",
+	Rewind:          "admin.checkpoint.rewind",
 }
@@ -0,0 +1,63 @@
+package main
+
+// Operation types for transaction marker events
+const (
+	OperationTypeBegin  = "Begin"
+	OperationTypeCommit = "Commit"
+)
+
+// groupTransactions groups consecutive changes sharing a start LSN into a transaction and annotates
+// each change with the transaction id, its 1-based sequence and the transaction's row count.
+// When markers is true, Begin and Commit events are emitted around every transaction.
+func groupTransactions(changes []map[string]interface{}, markers bool) []map[string]interface{} {
+	grouped := make([]map[string]interface{}, 0, len(changes))
+
+	for start := 0; start < len(changes); {
+		txID := changeMetadata(changes[start])["LSN"]
+
+		// Find the end of the transaction
+		end := start + 1
+		for end < len(changes) && changeMetadata(changes[end])["LSN"] == txID {
+			end++
+		}
+		size := end - start
+		commitTime := changeMetadata(changes[start])["CommitTime"]
+
+		if markers {
+			grouped = append(grouped, newTransactionMarker(OperationTypeBegin, txID, size, commitTime))
+		}
+		for i, change := range changes[start:end] {
+			metadata := changeMetadata(change)
+			metadata["TransactionID"] = txID
+			metadata["TransactionSequence"] = i + 1
+			metadata["TransactionSize"] = size
+			grouped = append(grouped, change)
+		}
+		if markers {
+			grouped = append(grouped, newTransactionMarker(OperationTypeCommit, txID, size, commitTime))
+		}
+
+		start = end
+	}
+
+	return grouped
+}
+
+// newTransactionMarker builds a Begin or Commit marker event for a transaction
+func newTransactionMarker(operationType string, txID interface{}, size int, commitTime interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"LSN":             txID,
+			"OperationType":   operationType,
+			"CommitTime":      commitTime,
+			"TransactionID":   txID,
+			"TransactionSize": size,
+		},
+	}
+}
+
+// changeMetadata returns the metadata map of a change event
+func changeMetadata(change map[string]interface{}) map[string]interface{} {
+	metadata, _ := change["metadata"].(map[string]interface{})
+	return metadata
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestGroupTransactions(t *testing.T) {
+	changes := []map[string]interface{}{
+		newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}, "1"),
+		newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 2}, "2"),
+		newTestChange(Position{LSN: []byte{2}, SeqVal: []byte{1}, Operation: 2}, "3"),
+	}
+
+	grouped := groupTransactions(changes, false)
+	if len(grouped) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(grouped))
+	}
+
+	expected := []struct {
+		txID     string
+		sequence int
+		size     int
+	}{{"01", 1, 2}, {"01", 2, 2}, {"02", 1, 1}}
+	for i, e := range expected {
+		metadata := changeMetadata(grouped[i])
+		if metadata["TransactionID"] != e.txID || metadata["TransactionSequence"] != e.sequence || metadata["TransactionSize"] != e.size {
+			t.Fatalf("event %d: unexpected transaction metadata %v", i, metadata)
+		}
+	}
+}
+
+func TestGroupTransactionsWithMarkers(t *testing.T) {
+	changes := []map[string]interface{}{
+		newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{1}, Operation: 2}, "1"),
+		newTestChange(Position{LSN: []byte{1}, SeqVal: []byte{2}, Operation: 2}, "2"),
+		newTestChange(Position{LSN: []byte{2}, SeqVal: []byte{1}, Operation: 2}, "3"),
+	}
+
+	grouped := groupTransactions(changes, true)
+	operations := []string{"Begin", "Insert", "Insert", "Commit", "Begin", "Insert", "Commit"}
+	if len(grouped) != len(operations) {
+		t.Fatalf("expected %d events, got %d", len(operations), len(grouped))
+	}
+	for i, op := range operations {
+		if got := changeMetadata(grouped[i])["OperationType"]; got != op {
+			t.Fatalf("event %d: expected %s, got %v", i, op, got)
+		}
+	}
+}
@@ -9,12 +9,52 @@ import (
 )
 
 // Subscribe subscribes to a topic and prints received messages
-func Subscribe(module string, conn *nats.Conn, topic string, handler nats.MsgHandler) {
-	_, err := conn.Subscribe(topic, handler)
+func Subscribe(module string, conn *nats.Conn, topic string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	sub, err := conn.Subscribe(topic, handler)
 	if err != nil {
-		log.Fatalf("[%s] Error subscribing to topic '%s': %v", module, topic, err)
+		return nil, fmt.Errorf("error subscribing to topic '%s': %w", topic, err)
 	}
 	log.Printf("[%s] Subscribed to topic '%s'", module, topic)
+	return sub, nil
+}
+
+// QueueSubscribe subscribes to a topic as a member of a queue group, so that each message is handled
+// by only one member of the group
+func QueueSubscribe(module string, conn *nats.Conn, topic string, queue string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	sub, err := conn.QueueSubscribe(topic, queue, handler)
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to topic '%s' in queue group '%s': %w", topic, queue, err)
+	}
+	log.Printf("[%s] Subscribed to topic '%s' in queue group '%s'", module, topic, queue)
+	return sub, nil
+}
+
+// SubscribeAll subscribes each handler to its topic, as a member of the queue group unless queue is empty.
+// When a subscription fails, the subscriptions made before it are removed again.
+func SubscribeAll(module string, conn *nats.Conn, queue string, handlers map[string]nats.MsgHandler) ([]*nats.Subscription, error) {
+	subs := make([]*nats.Subscription, 0, len(handlers))
+	for topic, handler := range handlers {
+		var sub *nats.Subscription
+		var err error
+		if queue == "" {
+			sub, err = Subscribe(module, conn, topic, handler)
+		} else {
+			sub, err = QueueSubscribe(module, conn, topic, queue, handler)
+		}
+		if err != nil {
+			Unsubscribe(subs)
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// Unsubscribe removes the given subscriptions
+func Unsubscribe(subs []*nats.Subscription) {
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
 }
 
 // UnmarshalJSON unmarshals JSON data into a generic type T.